@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// keaDaemons are the daemons a Kea Control Agent forwards commands to.
+var keaDaemons = []string{"dhcp4", "dhcp6", "d2"}
+
+// controlAgentService is the service of commands for the Control Agent
+// itself, which are sent without a service.
+const controlAgentService = "ca"
+
+func validateDaemons(field string, t TargetConfig) []error {
+	if len(t.Daemons) == 0 {
+		return nil
+	}
+	var errs []error
+	if t.URL == "" {
+		errs = append(errs, fmt.Errorf("%s.daemons: requires url", field))
+	}
+	for i, d := range t.Daemons {
+		switch {
+		case d == "all":
+			if len(t.Daemons) > 1 {
+				errs = append(errs, fmt.Errorf("%s.daemons[%d]: 'all' must be the only entry", field, i))
+			}
+		case !slices.Contains(keaDaemons, d):
+			errs = append(errs, fmt.Errorf("%s.daemons[%d]: unknown daemon '%s', want 'all' or one of %s", field, i, d, strings.Join(keaDaemons, ", ")))
+		case slices.Index(t.Daemons, d) < i:
+			errs = append(errs, fmt.Errorf("%s.daemons[%d]: '%s' is listed twice", field, i, d))
+		}
+	}
+	if _, ok := t.Labels["daemon"]; ok {
+		errs = append(errs, fmt.Errorf("%s.labels: 'daemon' is reserved when daemons are set", field))
+	}
+	return errs
+}
+
+// agentCollector collects the status of a Kea Control Agent and of the
+// daemons behind it. The DHCPv4 server is collected by dhcp4; the other
+// daemons' statistics are exported as Kea reports them.
+type agentCollector struct {
+	target          TargetConfig
+	dhcp4           *jsonCollector4 // nil if dhcp4 is not queried
+	AgentUp         *prometheus.Desc
+	AgentStartTime  *prometheus.Desc
+	DaemonUp        *prometheus.Desc
+	DaemonStartTime *prometheus.Desc
+	DaemonStatistic *prometheus.Desc
+}
+
+func newAgentCollector(namespace string, target TargetConfig, dhcp4 *jsonCollector4, constLabels prometheus.Labels) *agentCollector {
+	return &agentCollector{
+		target:          target,
+		dhcp4:           dhcp4,
+		AgentUp:         prometheus.NewDesc(namespace+"_control_agent_up", "Whether querying the status of the Kea Control Agent succeeded (1) or not (0)", nil, constLabels),
+		AgentStartTime:  prometheus.NewDesc(namespace+"_control_agent_start_time_seconds", "Start time of the Kea Control Agent since unix epoch in seconds", nil, constLabels),
+		DaemonUp:        prometheus.NewDesc(namespace+"_daemon_up", "Whether querying the status of a Kea daemon through the Control Agent succeeded (1) or not (0)", []string{"daemon"}, constLabels),
+		DaemonStartTime: prometheus.NewDesc(namespace+"_daemon_start_time_seconds", "Start time of a Kea daemon since unix epoch in seconds", []string{"daemon"}, constLabels),
+		DaemonStatistic: prometheus.NewDesc(namespace+"_daemon_statistic", "Newest sample of a statistic of a Kea daemon other than dhcp4, as reported by statistic-get-all", []string{"daemon", "statistic"}, constLabels),
+	}
+}
+
+// service returns the target with commands going to service.
+func (a *agentCollector) service(service string) TargetConfig {
+	t := a.target
+	t.service = service
+	return t
+}
+
+func (a *agentCollector) collect(ctx context.Context, ch chan<- prometheus.Metric) {
+	up := 0.0
+	if status, err := queryStatus(ctx, a.service(controlAgentService)); err != nil {
+		logger.ErrorContext(ctx, "Could not get Control Agent status", "target", a.target.Name, "error", err)
+	} else {
+		up = 1
+		ch <- prometheus.MustNewConstMetric(a.AgentStartTime, prometheus.GaugeValue, float64(status.startTime(time.Now()).UnixNano())/1e9)
+	}
+	ch <- prometheus.MustNewConstMetric(a.AgentUp, prometheus.GaugeValue, up)
+
+	daemons, err := a.daemons(ctx)
+	if err != nil {
+		logger.ErrorContext(ctx, "Could not get daemons from Control Agent", "target", a.target.Name, "error", err)
+		if a.dhcp4 != nil {
+			// Not knowing whether dhcp4 is there, it counts as down.
+			a.dhcp4.collectFailure(ctx, ch, err)
+		}
+		return
+	}
+	var wg sync.WaitGroup
+	for _, d := range daemons {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			a.collectDaemon(ctx, ch, d)
+		}()
+	}
+	wg.Wait()
+}
+
+// daemons returns the daemons to query: those configured, or those the
+// Control Agent has a control socket for.
+func (a *agentCollector) daemons(ctx context.Context) ([]string, error) {
+	if !slices.Equal(a.target.Daemons, []string{"all"}) {
+		return a.target.Daemons, nil
+	}
+	rawJSON, err := queryKea(ctx, a.service(controlAgentService), configCommand)
+	if err != nil {
+		return nil, fmt.Errorf("could not query Control Agent for config: %w", err)
+	}
+	var resp struct {
+		Result    int    `json:"result"`
+		Text      string `json:"text"`
+		Arguments struct {
+			ControlAgent struct {
+				ControlSockets map[string]json.RawMessage `json:"control-sockets"`
+			} `json:"Control-agent"`
+		} `json:"arguments"`
+	}
+	if err := json.Unmarshal(rawJSON, &resp); err != nil {
+		return nil, fmt.Errorf("could not parse Control Agent config: %w", err)
+	}
+	if resp.Result != 0 {
+		return nil, fmt.Errorf("Kea returned result %d: %s", resp.Result, resp.Text)
+	}
+	return sortedKeys(resp.Arguments.ControlAgent.ControlSockets), nil
+}
+
+func (a *agentCollector) collectDaemon(ctx context.Context, ch chan<- prometheus.Metric, daemon string) {
+	t := a.service(daemon)
+	up := 0.0
+	if status, err := queryStatus(ctx, t); err != nil {
+		logger.ErrorContext(ctx, "Could not get Kea daemon status", "target", t.Name, "daemon", daemon, "error", err)
+	} else {
+		up = 1
+		ch <- prometheus.MustNewConstMetric(a.DaemonStartTime, prometheus.GaugeValue, float64(status.startTime(time.Now()).UnixNano())/1e9, daemon)
+	}
+	ch <- prometheus.MustNewConstMetric(a.DaemonUp, prometheus.GaugeValue, up, daemon)
+	if daemon == "dhcp4" {
+		if a.dhcp4 != nil {
+			a.dhcp4.collect(ctx, ch)
+		}
+		return
+	}
+	if up == 0 {
+		return
+	}
+	rawJSON, err := getStatsJSON(ctx, t)
+	if err != nil {
+		logger.ErrorContext(ctx, "Could not get Kea daemon statistics", "target", t.Name, "daemon", daemon, "error", err)
+		return
+	}
+	stats, err := parseRawStats(rawJSON)
+	if err != nil {
+		logger.ErrorContext(ctx, "Could not parse Kea daemon statistics", "target", t.Name, "daemon", daemon, "error", err)
+		return
+	}
+	for _, name := range sortedKeys(stats) {
+		ch <- prometheus.MustNewConstMetric(a.DaemonStatistic, prometheus.UntypedValue, stats[name], daemon, name)
+	}
+}
+
+// parseRawStats returns the newest sample of every statistic in a
+// statistic-get-all response.
+func parseRawStats(rawJSON []byte) (map[string]float64, error) {
+	var resp struct {
+		Result    int                        `json:"result"`
+		Text      string                     `json:"text"`
+		Arguments map[string]json.RawMessage `json:"arguments"`
+	}
+	if err := json.Unmarshal(rawJSON, &resp); err != nil {
+		return nil, err
+	}
+	if resp.Result != 0 {
+		return nil, fmt.Errorf("Kea returned result %d: %s", resp.Result, resp.Text)
+	}
+	stats := make(map[string]float64, len(resp.Arguments))
+	for name, samples := range resp.Arguments {
+		v, err := latestSampleValue(samples)
+		if err != nil {
+			return nil, fmt.Errorf("statistic '%s': %w", name, err)
+		}
+		stats[name] = v
+	}
+	return stats, nil
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"pkg.i-no.de/pkg/gkse/keatest"
+)
+
+// newAgentServer returns a fake Control Agent, which answers commands without
+// a service itself, with the fixtures of version behind it as dhcp4.
+func newAgentServer(t *testing.T, version string) *keatest.Server {
+	t.Helper()
+	kea := keatest.NewServer(t)
+	kea.HandleService("dhcp4", statsCommand, keatest.File(t, filepath.Join("testdata", version, "statistic-get-all.json")))
+	kea.HandleService("dhcp4", configCommand, keatest.File(t, filepath.Join("testdata", version, "config-get.json")))
+	return kea
+}
+
+func TestMetricsControlAgentDaemons(t *testing.T) {
+	kea := newAgentServer(t, "kea-2.6")
+	kea.Handle(statusCommand, keatest.JSON(`{"result": 0, "arguments": {"pid": 1, "uptime": 100}}`))
+	kea.Handle(configCommand, keatest.JSON(`{"result": 0, "arguments": {"Control-agent": {"control-sockets": {
+		"dhcp4": {"socket-type": "unix", "socket-name": "/run/kea/kea4-ctrl-socket"},
+		"dhcp6": {"socket-type": "unix", "socket-name": "/run/kea/kea6-ctrl-socket"},
+		"d2": {"socket-type": "unix", "socket-name": "/run/kea/kea-ddns-ctrl-socket"}}}}}`))
+	kea.HandleService("dhcp4", statusCommand, keatest.JSON(`{"result": 0, "arguments": {"pid": 2, "uptime": 50}}`))
+	kea.HandleService("d2", statusCommand, keatest.JSON(`{"result": 0, "arguments": {"pid": 3, "uptime": 50}}`))
+	kea.HandleService("d2", statsCommand, keatest.JSON(`{"result": 0, "arguments": {
+		"ncr-received": [[7, "2024-06-01 12:00:00.000000"], [5, "2024-06-01 11:00:00.000000"]],
+		"update-success": [[3, "2024-06-01 12:00:00.000000"]]}}`))
+	kea.HandleService("dhcp6", statusCommand, keatest.Result(1, "unable to forward command to the dhcp6 service"))
+
+	url := newTestExporter(t, TargetConfig{Name: "dhcp1", URL: kea.URL, Timeout: time.Second, Daemons: []string{"all"}})
+	got := scrapeKeaMetrics(t, url)
+	for _, want := range []string{
+		"kea_control_agent_up 1",
+		`kea_daemon_up{daemon="d2"} 1`,
+		`kea_daemon_up{daemon="dhcp4"} 1`,
+		`kea_daemon_up{daemon="dhcp6"} 0`,
+		`kea_daemon_statistic{daemon="d2",statistic="ncr-received"} 7`,
+		`kea_daemon_statistic{daemon="d2",statistic="update-success"} 3`,
+		`kea_up{daemon="dhcp4"} 1`,
+		`kea_subnet_addresses{daemon="dhcp4",subnet="192.0.2.0/24",subnetidx="1"} 191`,
+	} {
+		if !strings.Contains(got, want+"\n") {
+			t.Errorf("/metrics has no line %s", want)
+		}
+	}
+	for _, unwanted := range []string{`kea_daemon_statistic{daemon="dhcp4"`, `kea_daemon_statistic{daemon="dhcp6"`, "kea_start_time_seconds"} {
+		if strings.Contains(got, unwanted) {
+			t.Errorf("/metrics has %s", unwanted)
+		}
+	}
+}
+
+func TestMetricsControlAgentDaemonsListed(t *testing.T) {
+	kea := newAgentServer(t, "kea-2.6")
+	kea.Handle(statusCommand, keatest.Result(1, "status-get not supported"))
+	kea.HandleService("dhcp6", statusCommand, keatest.JSON(`{"result": 0, "arguments": {"pid": 2, "uptime": 50}}`))
+	kea.HandleService("dhcp6", statsCommand, keatest.JSON(`{"result": 0, "arguments": {"pkt6-received": [[11, "2024-06-01 12:00:00.000000"]]}}`))
+
+	url := newTestExporter(t, TargetConfig{Name: "dhcp1", URL: kea.URL, Timeout: time.Second, Daemons: []string{"dhcp6"}})
+	got := scrapeKeaMetrics(t, url)
+	for _, want := range []string{
+		"kea_control_agent_up 0",
+		`kea_daemon_up{daemon="dhcp6"} 1`,
+		`kea_daemon_statistic{daemon="dhcp6",statistic="pkt6-received"} 11`,
+	} {
+		if !strings.Contains(got, want+"\n") {
+			t.Errorf("/metrics has no line %s", want)
+		}
+	}
+	if strings.Contains(got, "kea_up") || kea.Requests(statsCommand) != 1 {
+		t.Errorf("dhcp4 was queried although it is not listed:\n%s", got)
+	}
+}
+
+func TestValidateDaemons(t *testing.T) {
+	for _, tc := range []struct {
+		target  TargetConfig
+		wantErr string
+	}{
+		{TargetConfig{URL: "http://kea:8000/", Daemons: []string{"dhcp4", "d2"}}, ""},
+		{TargetConfig{URL: "http://kea:8000/", Daemons: []string{"all"}}, ""},
+		{TargetConfig{Socket: "/run/kea.sock", Daemons: []string{"dhcp4"}}, "t.daemons: requires url"},
+		{TargetConfig{URL: "http://kea:8000/", Daemons: []string{"all", "dhcp4"}}, "t.daemons[0]: 'all' must be the only entry"},
+		{TargetConfig{URL: "http://kea:8000/", Daemons: []string{"dhcp7"}}, "t.daemons[0]: unknown daemon 'dhcp7'"},
+		{TargetConfig{URL: "http://kea:8000/", Daemons: []string{"d2", "d2"}}, "t.daemons[1]: 'd2' is listed twice"},
+		{TargetConfig{URL: "http://kea:8000/", Daemons: []string{"d2"}, Labels: map[string]string{"daemon": "x"}}, "t.labels: 'daemon' is reserved"},
+	} {
+		errs := validateDaemons("t", tc.target)
+		switch {
+		case tc.wantErr == "" && len(errs) > 0:
+			t.Errorf("validateDaemons(%+v) = %v, want no errors", tc.target, errs)
+		case tc.wantErr != "" && (len(errs) != 1 || !strings.Contains(errs[0].Error(), tc.wantErr)):
+			t.Errorf("validateDaemons(%+v) = %v, want one error containing %q", tc.target, errs, tc.wantErr)
+		}
+	}
+}
+
+func TestMetricsControlAgentConfigFailure(t *testing.T) {
+	kea := newAgentServer(t, "kea-2.6")
+	kea.Handle(statusCommand, keatest.JSON(`{"result": 0, "arguments": {"pid": 1, "uptime": 100}}`))
+	kea.Handle(configCommand, keatest.Result(1, "config-get failed"))
+
+	cfg := defaultConfig()
+	cfg.Targets = []TargetConfig{{Name: "dhcp1", URL: kea.URL, Timeout: time.Second, Daemons: []string{"all"}}}
+	currentCfg.Store(cfg)
+	kc := &collectorSet{}
+	kc.update(cfg)
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(kc)
+	mfs, err := reg.Gather()
+	// Without the daemons, dhcp4 is down, and the scrape fails.
+	if err == nil || !strings.Contains(err.Error(), "target 'dhcp1' (scrape_id ") || !strings.Contains(err.Error(), "Kea returned result 1: config-get failed") {
+		t.Errorf("Gather() = %v, want the error of config-get", err)
+	}
+	byName := make(map[string]*dto.MetricFamily)
+	for _, mf := range mfs {
+		byName[mf.GetName()] = mf
+	}
+	if v, ok := sampleValue(byName["kea_up"], map[string]string{"daemon": "dhcp4"}); !ok || v != 0 {
+		t.Errorf(`kea_up{daemon="dhcp4"} = %g, %t, want 0`, v, ok)
+	}
+	if v, ok := sampleValue(byName["kea_control_agent_up"], nil); !ok || v != 1 {
+		t.Errorf("kea_control_agent_up = %g, %t, want 1", v, ok)
+	}
+	if kea.Requests(statsCommand) != 0 {
+		t.Error("dhcp4 was queried without the daemons")
+	}
+}
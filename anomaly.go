@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"slices"
+	"sync"
+	"time"
+)
+
+// anomalyCounters are the packet counters whose rates are compared to their
+// baselines, by the value of the counter label.
+var anomalyCounters = []struct {
+	name  string
+	value func(m *KeaCookedMetrics) float64
+}{
+	{"discover_received", func(m *KeaCookedMetrics) float64 { return m.Pkt4DiscoverReceived }},
+	{"request_received", func(m *KeaCookedMetrics) float64 { return m.Pkt4RequestReceived }},
+	{"ack_sent", func(m *KeaCookedMetrics) float64 { return m.Pkt4AckSent }},
+	{"nak_sent", func(m *KeaCookedMetrics) float64 { return m.Pkt4NakSent }},
+	{"receive_drop", func(m *KeaCookedMetrics) float64 { return m.Pkt4ReceiveDrop }},
+	{"parse_failed", func(m *KeaCookedMetrics) float64 { return m.Pkt4ParseFailed }},
+	{"received", func(m *KeaCookedMetrics) float64 { return m.Pkt4Received }},
+}
+
+// anomalyRatios are the ratios of the increases of two anomalyCounters,
+// given by their name, between two snapshots.
+var anomalyRatios = []struct {
+	name       string
+	num, denom string
+	threshold  func(cfg AnomalyConfig) float64
+}{
+	{"discover_ack", "discover_received", "ack_sent", func(cfg AnomalyConfig) float64 { return cfg.DiscoverAckRatio }},
+	{"nak_request", "nak_sent", "request_received", func(cfg AnomalyConfig) float64 { return cfg.NAKRequestRatio }},
+	{"drop_received", "receive_drop", "received", func(cfg AnomalyConfig) float64 { return cfg.DropReceivedRatio }},
+}
+
+// anomalyCounter returns the index of the anomalyCounters entry called name.
+func anomalyCounter(name string) int {
+	for i, c := range anomalyCounters {
+		if c.name == name {
+			return i
+		}
+	}
+	panic("unknown anomaly counter " + name)
+}
+
+// minStddev is the least standard deviation of a rate, one packet per
+// minute, so counters that hardly ever change do not turn every packet into
+// an anomaly.
+const minStddev = 1.0 / 60
+
+// minRatioDenominator is the least increase the denominator of a ratio
+// counts as, so a few discovers that got no ack yet are neither an infinite
+// ratio nor above the threshold, while a flood of them still is.
+const minRatioDenominator = 10
+
+// AnomalyConfig configures the detection of unusual DHCP traffic. The rate
+// of every anomalyCounters is compared to an exponentially weighted average
+// with a half-life of HalfLife; once it has seen Warmup rates, deviations of
+// Threshold standard deviations and more are anomalies. The ratios are
+// logged when they exceed their thresholds.
+type AnomalyConfig struct {
+	Enabled           bool          `yaml:"enabled"`
+	HalfLife          time.Duration `yaml:"half_life"`
+	Threshold         float64       `yaml:"threshold"`
+	Warmup            int           `yaml:"warmup"`
+	DiscoverAckRatio  float64       `yaml:"discover_ack_ratio"`
+	NAKRequestRatio   float64       `yaml:"nak_request_ratio"`
+	DropReceivedRatio float64       `yaml:"drop_received_ratio"`
+}
+
+func (cfg AnomalyConfig) validate() error {
+	if !cfg.Enabled {
+		return nil
+	}
+	var errs []error
+	if cfg.HalfLife <= 0 {
+		errs = append(errs, fmt.Errorf("anomaly.half_life: must be positive, got %s", cfg.HalfLife))
+	}
+	if cfg.Threshold <= 0 {
+		errs = append(errs, fmt.Errorf("anomaly.threshold: must be positive, got %g", cfg.Threshold))
+	}
+	if cfg.Warmup < 1 {
+		errs = append(errs, fmt.Errorf("anomaly.warmup: must be at least 1, got %d", cfg.Warmup))
+	}
+	if cfg.DiscoverAckRatio <= 0 {
+		errs = append(errs, fmt.Errorf("anomaly.discover_ack_ratio: must be positive, got %g", cfg.DiscoverAckRatio))
+	}
+	if cfg.NAKRequestRatio <= 0 || cfg.NAKRequestRatio > 1 {
+		errs = append(errs, fmt.Errorf("anomaly.nak_request_ratio: must be in (0, 1], got %g", cfg.NAKRequestRatio))
+	}
+	if cfg.DropReceivedRatio <= 0 || cfg.DropReceivedRatio > 1 {
+		errs = append(errs, fmt.Errorf("anomaly.drop_received_ratio: must be in (0, 1], got %g", cfg.DropReceivedRatio))
+	}
+	return errors.Join(errs...)
+}
+
+// ewma is an exponentially weighted moving average and variance.
+type ewma struct {
+	mean, variance float64
+	n              int
+}
+
+// add adds x with weight alpha, or the weight x has in a plain average of
+// the values so far if that is larger, so the first values do not leave the
+// baseline stuck near the very first one.
+func (e *ewma) add(x, alpha float64) {
+	alpha = max(alpha, 1/float64(e.n+1))
+	if e.n == 0 {
+		e.mean = x
+	} else {
+		d := x - e.mean
+		e.mean += alpha * d
+		e.variance = (1 - alpha) * (e.variance + alpha*d*d)
+	}
+	e.n++
+}
+
+// trafficState is what the anomaly detector knows about one target. Scores
+// and ratios are NaN if there are none, as after a counter reset.
+type trafficState struct {
+	time      time.Time
+	counters  []float64
+	baselines []ewma
+	scores    []float64
+	ratios    []float64
+	anomalous []bool // by counter, whether the score is above the threshold
+	high      []bool // by ratio, whether it is above its threshold
+}
+
+// anomalyDetector compares the packet rates of every target to their
+// baselines.
+type anomalyDetector struct {
+	mu      sync.Mutex
+	cfg     AnomalyConfig
+	targets map[string]*trafficState
+}
+
+func newAnomalyDetector() *anomalyDetector {
+	return &anomalyDetector{targets: make(map[string]*trafficState)}
+}
+
+func (d *anomalyDetector) configure(cfg AnomalyConfig) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.cfg = cfg
+}
+
+// observe updates the scores, ratios and baselines of target with the
+// counters in m at t, and logs scores and ratios crossing their thresholds
+// with the scrape ID from ctx.
+func (d *anomalyDetector) observe(ctx context.Context, target string, t time.Time, m *KeaCookedMetrics) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	counters := make([]float64, len(anomalyCounters))
+	for i, c := range anomalyCounters {
+		counters[i] = c.value(m)
+	}
+	st := d.targets[target]
+	if st == nil {
+		st = &trafficState{
+			baselines: make([]ewma, len(anomalyCounters)),
+			scores:    nanSlice(len(anomalyCounters)),
+			ratios:    nanSlice(len(anomalyRatios)),
+			anomalous: make([]bool, len(anomalyCounters)),
+			high:      make([]bool, len(anomalyRatios)),
+		}
+		d.targets[target] = st
+	}
+	if st.counters == nil {
+		st.time, st.counters = t, counters
+		return
+	}
+	dt := t.Sub(st.time).Seconds()
+	if dt <= 0 {
+		// An older snapshot than the last one must not replace it.
+		return
+	}
+	alpha := 1 - math.Exp(-dt*math.Ln2/d.cfg.HalfLife.Seconds())
+	deltas := make([]float64, len(counters))
+	for i, c := range anomalyCounters {
+		deltas[i] = counters[i] - st.counters[i]
+		st.scores[i] = math.NaN()
+		if deltas[i] < 0 {
+			// Kea restarted, the counter starts over.
+			continue
+		}
+		rate, b := deltas[i]/dt, &st.baselines[i]
+		if b.n >= d.cfg.Warmup {
+			st.scores[i] = (rate - b.mean) / max(math.Sqrt(b.variance), minStddev)
+			if anomalous := st.scores[i] >= d.cfg.Threshold; anomalous != st.anomalous[i] {
+				st.anomalous[i] = anomalous
+				level, msg := slog.LevelInfo, "DHCP traffic back to normal"
+				if anomalous {
+					level, msg = slog.LevelWarn, "DHCP traffic anomaly"
+				}
+				logger.Log(ctx, level, msg, "target", target, "counter", c.name, "rate", rate, "baseline", b.mean, "score", st.scores[i])
+			}
+		}
+		b.add(rate, alpha)
+	}
+	for i, r := range anomalyRatios {
+		num, denom := deltas[anomalyCounter(r.num)], deltas[anomalyCounter(r.denom)]
+		if num < 0 || denom < 0 {
+			st.ratios[i] = math.NaN()
+			continue
+		}
+		st.ratios[i] = num / max(denom, minRatioDenominator)
+		threshold := r.threshold(d.cfg)
+		if high := st.ratios[i] > threshold; high != st.high[i] {
+			st.high[i] = high
+			level, msg := slog.LevelInfo, "DHCP packet ratio back below threshold"
+			if high {
+				level, msg = slog.LevelWarn, "DHCP packet ratio above threshold"
+			}
+			logger.Log(ctx, level, msg, "target", target, "ratio", r.name, "value", st.ratios[i], "threshold", threshold)
+		}
+	}
+	st.time, st.counters = t, counters
+}
+
+// state returns the scores, baseline rates and ratios of target, or false if
+// it has not been observed twice yet.
+func (d *anomalyDetector) state(target string) (scores, baselines, ratios []float64, ok bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	st := d.targets[target]
+	if st == nil || !slices.ContainsFunc(st.baselines, func(b ewma) bool { return b.n > 0 }) {
+		return nil, nil, nil, false
+	}
+	baselines = nanSlice(len(st.baselines))
+	for i, b := range st.baselines {
+		if b.n > 0 {
+			baselines[i] = b.mean
+		}
+	}
+	return slices.Clone(st.scores), baselines, slices.Clone(st.ratios), true
+}
+
+func nanSlice(n int) []float64 {
+	s := make([]float64, n)
+	for i := range s {
+		s[i] = math.NaN()
+	}
+	return s
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAnomalyDetector(t *testing.T) {
+	var logs bytes.Buffer
+	defer func(l *slog.Logger) { logger = l }(logger)
+	logger = slog.New(contextHandler{slog.NewTextHandler(&logs, nil)})
+	ctx := context.WithValue(context.Background(), scrapeIDKey{}, "0123456789abcdef")
+
+	cfg := defaultConfig().Anomaly
+	cfg.Enabled = true
+	d := newAnomalyDetector()
+	d.configure(cfg)
+	start := time.Unix(1700000000, 0)
+	m := &KeaCookedMetrics{}
+	// Ten minutes of one discover, request and ack per second, give or
+	// take a few.
+	for i := range 600 / 15 {
+		n := float64(15 + i%3 - 1)
+		m.Pkt4DiscoverReceived += n
+		m.Pkt4RequestReceived += n
+		m.Pkt4AckSent += n
+		m.Pkt4Received += 2 * n
+		d.observe(ctx, "dhcp1", start.Add(time.Duration(i)*15*time.Second), m)
+	}
+	scores, baselines, ratios, ok := d.state("dhcp1")
+	if !ok {
+		t.Fatal("state() has nothing")
+	}
+	if math.Abs(baselines[0]-1) > 0.1 {
+		t.Errorf("discover baseline is %g/s, want about 1/s", baselines[0])
+	}
+	if scores[0] >= cfg.Threshold || ratios[0] != 1 {
+		t.Errorf("steady traffic has discover score %g and discover/ack ratio %g, want below %g and 1", scores[0], ratios[0], cfg.Threshold)
+	}
+	if logs.Len() != 0 {
+		t.Errorf("steady traffic logged:\n%s", logs.String())
+	}
+
+	// A few discovers without acks are not compared to nothing.
+	m.Pkt4DiscoverReceived += 3
+	m.Pkt4Received += 3
+	d.observe(ctx, "dhcp1", start.Add(600*time.Second), m)
+	if _, _, ratios, _ = d.state("dhcp1"); ratios[0] != 0.3 {
+		t.Errorf("discover/ack ratio of 3 discovers without acks is %g, want 0.3", ratios[0])
+	}
+	if logs.Len() != 0 {
+		t.Errorf("a few discovers without acks logged:\n%s", logs.String())
+	}
+
+	// A burst of discovers without acks.
+	m.Pkt4DiscoverReceived += 1500
+	m.Pkt4Received += 1500
+	d.observe(ctx, "dhcp1", start.Add(615*time.Second), m)
+	scores, _, ratios, _ = d.state("dhcp1")
+	if scores[0] < cfg.Threshold {
+		t.Errorf("discover burst has score %g, want at least %g", scores[0], cfg.Threshold)
+	}
+	if ratios[0] != 150 {
+		t.Errorf("discover/ack ratio of 1500 discovers without acks is %g, want 150", ratios[0])
+	}
+	for _, want := range []string{
+		`level=WARN msg="DHCP traffic anomaly" target=dhcp1 counter=discover_received`,
+		`level=WARN msg="DHCP packet ratio above threshold" target=dhcp1 ratio=discover_ack value=150 threshold=4 scrape_id=0123456789abcdef`,
+	} {
+		if !strings.Contains(logs.String(), want) {
+			t.Errorf("logs have no %q:\n%s", want, logs.String())
+		}
+	}
+
+	// Kea restarts.
+	d.observe(ctx, "dhcp1", start.Add(630*time.Second), &KeaCookedMetrics{})
+	scores, _, ratios, _ = d.state("dhcp1")
+	if !math.IsNaN(scores[0]) || !math.IsNaN(ratios[0]) {
+		t.Errorf("after a counter reset, discover score is %g and ratio %g, want NaN", scores[0], ratios[0])
+	}
+}
+
+func TestMetricsAnomaly(t *testing.T) {
+	kea := newFixtureServer(t, "kea-2.6")
+	cfg := defaultConfig()
+	cfg.Targets = []TargetConfig{{Name: "dhcp1", Socket: kea.SocketPath, Timeout: time.Second}}
+	cfg.Anomaly.Enabled = true
+	cfg.Anomaly.Warmup = 1
+	// Every scrape is observed, however close together.
+	cfg.Observe.Interval = 0
+	if err := cfg.validate(); err != nil {
+		t.Fatal(err)
+	}
+	currentCfg.Store(cfg)
+	kc := &collectorSet{}
+	kc.update(cfg)
+	srv := httptest.NewServer(newMux(kc, &reloader{collectors: kc}))
+	t.Cleanup(srv.Close)
+
+	// The API queries Kea, but does not add to the baselines.
+	for range 2 {
+		resp, err := http.Get(srv.URL + "/api/v1/summary")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		// Without a recent snapshot, the next request queries Kea again.
+		for _, c := range *kc.collectors.Load() {
+			c.last.Store(nil)
+		}
+	}
+	if n := kea.Requests(statsCommand); n != 2 {
+		t.Fatalf("Kea got %d %s requests from the API, want 2", n, statsCommand)
+	}
+	if n := len(kc.anomalies.targets); n != 0 {
+		t.Errorf("detector has the state of %d targets after API requests, want none", n)
+	}
+	if got := scrapeKeaMetrics(t, srv.URL); strings.Contains(got, "anomaly") {
+		t.Errorf("anomaly metrics after one query:\n%s", got)
+	}
+	// The statistics do not change, so all rates are 0.
+	scrapeKeaMetrics(t, srv.URL)
+	got := scrapeKeaMetrics(t, srv.URL)
+	for _, want := range []string{
+		`kea_v4_anomaly_baseline_rate{counter="discover_received"} 0`,
+		`kea_v4_anomaly_score{counter="discover_received"} 0`,
+		`kea_v4_discover_ack_ratio 0`,
+		`kea_v4_nak_request_ratio 0`,
+		`kea_v4_drop_received_ratio 0`,
+	} {
+		if !strings.Contains(got, want+"\n") {
+			t.Errorf("/metrics has no line %s", want)
+		}
+	}
+}
+
+func TestAnomalyDetectorOlderSnapshot(t *testing.T) {
+	cfg := defaultConfig().Anomaly
+	cfg.Enabled = true
+	d := newAnomalyDetector()
+	d.configure(cfg)
+	ctx := context.Background()
+	start := time.Unix(1700000000, 0)
+	d.observe(ctx, "dhcp1", start, &KeaCookedMetrics{Pkt4DiscoverReceived: 100})
+	d.observe(ctx, "dhcp1", start.Add(30*time.Second), &KeaCookedMetrics{Pkt4DiscoverReceived: 130})
+	// A snapshot taken before the last one is dropped, so the next rate is
+	// since the last one rather than since the older one.
+	d.observe(ctx, "dhcp1", start.Add(20*time.Second), &KeaCookedMetrics{Pkt4DiscoverReceived: 125})
+	d.observe(ctx, "dhcp1", start.Add(60*time.Second), &KeaCookedMetrics{Pkt4DiscoverReceived: 160})
+	_, baselines, _, _ := d.state("dhcp1")
+	if baselines[0] != 1 {
+		t.Errorf("discover baseline is %g/s, want 1/s", baselines[0])
+	}
+	if n := d.targets["dhcp1"].baselines[0].n; n != 2 {
+		t.Errorf("baseline has seen %d rates, want 2", n)
+	}
+}
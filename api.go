@@ -0,0 +1,291 @@
+package main
+
+import (
+	"cmp"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strconv"
+	"time"
+)
+
+//go:embed assets/openapi.yaml
+var openAPISpec []byte
+
+// apiSnapshotMaxAge is how long a snapshot is reused for API requests, so
+// clients polling the API do not multiply the load on Kea.
+const apiSnapshotMaxAge = 5 * time.Second
+
+// apiSubnet is the utilization of a subnet and its pools.
+type apiSubnet struct {
+	Target        string    `json:"target"`
+	ID            uint64    `json:"id"`
+	Prefix        string    `json:"prefix"`
+	SharedNetwork string    `json:"shared_network,omitempty"`
+	Assigned      float64   `json:"assigned"`
+	Total         float64   `json:"total"`
+	Utilization   float64   `json:"utilization"`
+	Declined      float64   `json:"declined"`
+	Pools         []apiPool `json:"pools"`
+}
+
+type apiPool struct {
+	Index       uint64  `json:"index"`
+	Range       string  `json:"range,omitempty"`
+	Assigned    float64 `json:"assigned"`
+	Total       float64 `json:"total"`
+	Utilization float64 `json:"utilization"`
+	Declined    float64 `json:"declined"`
+}
+
+// apiTargetError reports a target that could not be queried. The data of
+// the other targets is returned regardless.
+type apiTargetError struct {
+	Target string `json:"target"`
+	Error  string `json:"error"`
+}
+
+type apiSubnetList struct {
+	Subnets []apiSubnet      `json:"subnets"`
+	Errors  []apiTargetError `json:"errors,omitempty"`
+}
+
+// apiSummary aggregates the subnets of one target, or of all of them.
+type apiSummary struct {
+	Target      string  `json:"target,omitempty"`
+	Subnets     int     `json:"subnets"`
+	Pools       int     `json:"pools"`
+	Assigned    float64 `json:"assigned"`
+	Total       float64 `json:"total"`
+	Utilization float64 `json:"utilization"`
+	Declined    float64 `json:"declined"`
+	Warning     int     `json:"subnets_over_warning"`
+	Critical    int     `json:"subnets_over_critical"`
+}
+
+type apiSummaryResponse struct {
+	apiSummary
+	Time    time.Time        `json:"time"`
+	Targets []apiSummary     `json:"targets"`
+	Errors  []apiTargetError `json:"errors,omitempty"`
+}
+
+// api serves the JSON REST API under /api/v1/.
+type api struct {
+	kc *collectorSet
+}
+
+func (a *api) register(mux *http.ServeMux) {
+	mux.HandleFunc("GET /api/v1/subnets", a.handleSubnets)
+	mux.HandleFunc("GET /api/v1/subnets/{id}", a.handleSubnet)
+	mux.HandleFunc("GET /api/v1/summary", a.handleSummary)
+	mux.HandleFunc("GET /api/v1/openapi.yaml", func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/yaml")
+		w.Write(openAPISpec)
+	})
+}
+
+// subnets returns the subnets of every target that could be queried, in
+// target and subnet ID order.
+func (a *api) subnets(r *http.Request) ([]apiSubnet, []apiTargetError) {
+	snaps, failed := a.kc.refresh(newScrapeContext(r.Context()), apiSnapshotMaxAge)
+	var subnets []apiSubnet
+	for _, s := range snaps {
+		subnets = append(subnets, s.apiSubnets()...)
+	}
+	var errs []apiTargetError
+	for _, name := range sortedKeys(failed) {
+		errs = append(errs, apiTargetError{name, failed[name].Error()})
+	}
+	return subnets, errs
+}
+
+func (s *keaSnapshot) apiSubnets() []apiSubnet {
+	var subnets []apiSubnet
+	for _, id := range sortedKeys(s.Metrics.SubnetMetrics) {
+		snm := s.Metrics.SubnetMetrics[id]
+		sc := s.Config.Dhcp4.SubnetConfigs[id]
+		prefix, _ := s.Config.subnetFromID(4, id)
+		sn := apiSubnet{
+			Target:        s.Target.Name,
+			ID:            id,
+			Prefix:        prefix,
+			SharedNetwork: sc.SharedNetwork,
+			Assigned:      snm.AssignedAddresses,
+			Total:         snm.TotalAddresses,
+			Utilization:   utilization(snm.AssignedAddresses, snm.TotalAddresses),
+			Declined:      snm.DeclinedAddresses,
+			Pools:         []apiPool{},
+		}
+		for _, pid := range sortedKeys(snm.PoolMetrics) {
+			pm := snm.PoolMetrics[pid]
+			p := apiPool{
+				Index:       pid,
+				Assigned:    pm.AssignedAddresses,
+				Total:       pm.TotalAddresses,
+				Utilization: utilization(pm.AssignedAddresses, pm.TotalAddresses),
+				Declined:    pm.DeclinedAddresses,
+			}
+			if pid < uint64(len(sc.Pools)) {
+				p.Range = sc.Pools[pid].Pool
+			}
+			sn.Pools = append(sn.Pools, p)
+		}
+		subnets = append(subnets, sn)
+	}
+	return subnets
+}
+
+// handleSubnets lists subnets. The query parameters target, within (subnets
+// inside a prefix), contains (subnets containing an address or prefix) and
+// sort (utilization, -utilization or id) select and order them.
+func (a *api) handleSubnets(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	var filters []func(apiSubnet) bool
+	if t := q.Get("target"); t != "" {
+		filters = append(filters, func(sn apiSubnet) bool { return sn.Target == t })
+	}
+	if v := q.Get("within"); v != "" {
+		p, err := parsePrefixOrAddr(v)
+		if err != nil {
+			apiError(w, http.StatusBadRequest, fmt.Errorf("within: %w", err))
+			return
+		}
+		filters = append(filters, func(sn apiSubnet) bool {
+			s, err := netip.ParsePrefix(sn.Prefix)
+			return err == nil && p.Bits() <= s.Bits() && p.Contains(s.Addr())
+		})
+	}
+	if v := q.Get("contains"); v != "" {
+		p, err := parsePrefixOrAddr(v)
+		if err != nil {
+			apiError(w, http.StatusBadRequest, fmt.Errorf("contains: %w", err))
+			return
+		}
+		filters = append(filters, func(sn apiSubnet) bool {
+			s, err := netip.ParsePrefix(sn.Prefix)
+			return err == nil && s.Bits() <= p.Bits() && s.Contains(p.Addr())
+		})
+	}
+	var sortFunc func(a, b apiSubnet) int
+	switch q.Get("sort") {
+	case "", "id":
+	case "utilization":
+		sortFunc = func(a, b apiSubnet) int { return cmp.Compare(a.Utilization, b.Utilization) }
+	case "-utilization":
+		sortFunc = func(a, b apiSubnet) int { return cmp.Compare(b.Utilization, a.Utilization) }
+	default:
+		apiError(w, http.StatusBadRequest, fmt.Errorf("sort: unknown order '%s', want id, utilization or -utilization", q.Get("sort")))
+		return
+	}
+
+	subnets, errs := a.subnets(r)
+	resp := apiSubnetList{Subnets: []apiSubnet{}, Errors: errs}
+	for _, sn := range subnets {
+		if !slices.ContainsFunc(filters, func(f func(apiSubnet) bool) bool { return !f(sn) }) {
+			resp.Subnets = append(resp.Subnets, sn)
+		}
+	}
+	if sortFunc != nil {
+		slices.SortStableFunc(resp.Subnets, sortFunc)
+	}
+	apiJSON(w, apiStatus(subnets, errs), resp)
+}
+
+// handleSubnet returns one subnet. If more than one target has a subnet with
+// the ID, the target query parameter must pick one.
+func (a *api) handleSubnet(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(r.PathValue("id"), 10, 64)
+	if err != nil {
+		apiError(w, http.StatusBadRequest, fmt.Errorf("invalid subnet ID '%s'", r.PathValue("id")))
+		return
+	}
+	target := r.URL.Query().Get("target")
+	subnets, errs := a.subnets(r)
+	var found []apiSubnet
+	for _, sn := range subnets {
+		if sn.ID == id && (target == "" || sn.Target == target) {
+			found = append(found, sn)
+		}
+	}
+	switch {
+	case len(found) == 1:
+		apiJSON(w, http.StatusOK, found[0])
+	case len(found) > 1:
+		apiError(w, http.StatusBadRequest, fmt.Errorf("subnet %d exists on more than one target, select one with the target parameter", id))
+	case len(errs) > 0:
+		apiError(w, http.StatusBadGateway, fmt.Errorf("subnet %d not found, and %d targets could not be queried", id, len(errs)))
+	default:
+		apiError(w, http.StatusNotFound, fmt.Errorf("subnet %d not found", id))
+	}
+}
+
+// handleSummary aggregates the subnets of every target, and of all of them.
+func (a *api) handleSummary(w http.ResponseWriter, r *http.Request) {
+	th := currentConfig().Thresholds
+	subnets, errs := a.subnets(r)
+	resp := apiSummaryResponse{Time: time.Now(), Targets: []apiSummary{}, Errors: errs}
+	add := func(s *apiSummary, sn apiSubnet) {
+		s.Subnets++
+		s.Pools += len(sn.Pools)
+		s.Assigned += sn.Assigned
+		s.Total += sn.Total
+		s.Declined += sn.Declined
+		if sn.Utilization >= th.UtilizationWarning {
+			s.Warning++
+		}
+		if sn.Utilization >= th.UtilizationCritical {
+			s.Critical++
+		}
+		s.Utilization = utilization(s.Assigned, s.Total)
+	}
+	for _, sn := range subnets {
+		if n := len(resp.Targets); n == 0 || resp.Targets[n-1].Target != sn.Target {
+			resp.Targets = append(resp.Targets, apiSummary{Target: sn.Target})
+		}
+		add(&resp.Targets[len(resp.Targets)-1], sn)
+		add(&resp.apiSummary, sn)
+	}
+	apiJSON(w, apiStatus(subnets, errs), resp)
+}
+
+// apiStatus is 502 if no target could be queried, and 200 otherwise.
+func apiStatus(subnets []apiSubnet, errs []apiTargetError) int {
+	if len(subnets) == 0 && len(errs) > 0 {
+		return http.StatusBadGateway
+	}
+	return http.StatusOK
+}
+
+// parsePrefixOrAddr parses a prefix, or an address as a single-address
+// prefix.
+func parsePrefixOrAddr(s string) (netip.Prefix, error) {
+	if p, err := netip.ParsePrefix(s); err == nil {
+		return p.Masked(), nil
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, errors.New("not an address or prefix")
+	}
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+func apiJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		logger.Error("Could not write API response", "error", err)
+	}
+}
+
+func apiError(w http.ResponseWriter, status int, err error) {
+	apiJSON(w, status, struct {
+		Error string `json:"error"`
+	}{err.Error()})
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// getJSON fetches url, checks the status and decodes the body into v.
+func getJSON(t *testing.T, url string, status int, v any) {
+	t.Helper()
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != status {
+		t.Errorf("GET %s: got status %s, want %d", url, resp.Status, status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		t.Fatalf("GET %s: %v", url, err)
+	}
+}
+
+func TestAPISubnets(t *testing.T) {
+	url := newTestExporter(t, fixtureConfig("kea-2.6", "kea-2.4").Targets...)
+
+	var all apiSubnetList
+	getJSON(t, url+"/api/v1/subnets", http.StatusOK, &all)
+	if len(all.Subnets) != 5 || len(all.Errors) != 0 {
+		t.Fatalf("got %d subnets and errors %v, want 5 subnets and no errors", len(all.Subnets), all.Errors)
+	}
+	sn := all.Subnets[2]
+	if sn.Target != "kea-2.6" || sn.ID != 3 || sn.Prefix != "203.0.113.0/25" || sn.SharedNetwork != "lab" {
+		t.Errorf("got subnet %+v, want subnet 3 of kea-2.6 in shared network lab", sn)
+	}
+	if len(sn.Pools) != 1 || sn.Pools[0].Range != "203.0.113.20 - 203.0.113.119" || sn.Pools[0].Utilization != 0.57 {
+		t.Errorf("got pools %+v, want one pool 203.0.113.20 - 203.0.113.119 at 0.57", sn.Pools)
+	}
+
+	for _, tc := range []struct {
+		query string
+		want  []uint64 // subnet IDs
+	}{
+		{"?target=kea-2.6&within=198.51.100.0/23", []uint64{2}},
+		{"?target=kea-2.6&within=192.0.0.0/8", []uint64{1}},
+		{"?target=kea-2.6&contains=203.0.113.17", []uint64{3}},
+		{"?target=kea-2.6&contains=203.0.113.0/24", nil},
+		{"?target=kea-2.6&sort=-utilization", []uint64{3, 2, 1}},
+		{"?target=kea-2.6&sort=utilization", []uint64{1, 2, 3}},
+	} {
+		var l apiSubnetList
+		getJSON(t, url+"/api/v1/subnets"+tc.query, http.StatusOK, &l)
+		var got []uint64
+		for _, sn := range l.Subnets {
+			got = append(got, sn.ID)
+		}
+		if !slices.Equal(got, tc.want) {
+			t.Errorf("%s: got subnets %v, want %v", tc.query, got, tc.want)
+		}
+	}
+
+	var e struct{ Error string }
+	getJSON(t, url+"/api/v1/subnets?within=nonsense", http.StatusBadRequest, &e)
+	getJSON(t, url+"/api/v1/subnets/1", http.StatusBadRequest, &e)
+	if !strings.Contains(e.Error, "more than one target") {
+		t.Errorf("got error %q for an ambiguous subnet ID", e.Error)
+	}
+	getJSON(t, url+"/api/v1/subnets/42", http.StatusNotFound, &e)
+	var one apiSubnet
+	getJSON(t, url+"/api/v1/subnets/1?target=kea-2.4", http.StatusOK, &one)
+	if one.Target != "kea-2.4" || one.Prefix != "192.0.2.0/24" {
+		t.Errorf("got subnet %+v, want 192.0.2.0/24 of kea-2.4", one)
+	}
+}
+
+func TestAPISummary(t *testing.T) {
+	targets := fixtureConfig("kea-2.6", "kea-2.4").Targets
+	targets[1].StatsFile = filepath.Join(t.TempDir(), "missing.json")
+	url := newTestExporter(t, targets...)
+
+	var s apiSummaryResponse
+	getJSON(t, url+"/api/v1/summary", http.StatusOK, &s)
+	if s.Subnets != 3 || s.Pools != 3 || s.Assigned != 31+44+57 || s.Total != 191+100+100 {
+		t.Errorf("got summary %+v, want 3 subnets and pools with 132 of 391 addresses assigned", s.apiSummary)
+	}
+	if len(s.Targets) != 1 || s.Targets[0].Target != "kea-2.6" {
+		t.Errorf("got per-target summaries %+v, want only kea-2.6", s.Targets)
+	}
+	if len(s.Errors) != 1 || s.Errors[0].Target != "kea-2.4" {
+		t.Errorf("got errors %+v, want one for kea-2.4", s.Errors)
+	}
+}
+
+func TestAPIOpenAPISpec(t *testing.T) {
+	url := newTestExporter(t, fixtureConfig("kea-2.6").Targets...)
+	resp, err := http.Get(url + "/api/v1/openapi.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "application/yaml" {
+		t.Errorf("got %s with Content-Type %q", resp.Status, resp.Header.Get("Content-Type"))
+	}
+}
@@ -0,0 +1,451 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/exporter-toolkit/web"
+	"gopkg.in/yaml.v3"
+)
+
+var configFile = flag.String("config.file", "", "Path to YAML configuration file. Explicitly set flags override values from the file")
+
+const defaultTargetName = "default"
+
+// Config is the full exporter configuration. It is assembled from the flag
+// defaults, the YAML file given with -config.file, GKSE_* environment
+// variables and explicitly set flags, in that order of precedence.
+type Config struct {
+	Web         WebConfig         `yaml:"web"`
+	Log         LogConfig         `yaml:"log"`
+	Namespace   string            `yaml:"namespace"`
+	Labels      map[string]string `yaml:"labels"`
+	Targets     []TargetConfig    `yaml:"targets"`
+	Collectors  CollectorsConfig  `yaml:"collectors"`
+	UserContext UserContextConfig `yaml:"user_context"`
+	Identity    IdentityConfig    `yaml:"identity"`
+	Forecast    ForecastConfig    `yaml:"forecast"`
+	Anomaly     AnomalyConfig     `yaml:"anomaly"`
+	Observe     ObserveConfig     `yaml:"observe"`
+	Thresholds  ThresholdsConfig  `yaml:"thresholds"`
+	Health      HealthConfig      `yaml:"health"`
+	Record      RecordConfig      `yaml:"record"`
+	Replay      ReplayConfig      `yaml:"replay"`
+	Textfile    TextfileConfig    `yaml:"textfile"`
+	Push        PushConfig        `yaml:"push"`
+	Dashboard   DashboardConfig   `yaml:"dashboard"`
+	Rules       RulesConfig       `yaml:"rules"`
+}
+
+// WebConfig configures the HTTP server. ConfigFile points to a file in the
+// Prometheus exporter-toolkit web configuration format, which sets up TLS and
+// basic authentication.
+type WebConfig struct {
+	ListenAddresses []string      `yaml:"listen_addresses"`
+	ReadTimeout     time.Duration `yaml:"read_timeout"`
+	ConfigFile      string        `yaml:"config_file"`
+}
+
+type LogConfig struct {
+	Level  string `yaml:"level"`
+	Format string `yaml:"format"`
+	Color  bool   `yaml:"color"`
+}
+
+// TargetConfig describes one Kea server to query. Exactly one of Socket
+// (Kea unix control socket) or URL (Kea Control Agent) must be set, unless
+// both StatsFile and ConfigFile are given.
+type TargetConfig struct {
+	Name       string            `yaml:"name"`
+	Socket     string            `yaml:"socket"`
+	URL        string            `yaml:"url"`
+	Timeout    time.Duration     `yaml:"timeout"`
+	StatsFile  string            `yaml:"stats_file"`
+	ConfigFile string            `yaml:"config_file"`
+	Labels     map[string]string `yaml:"labels"`
+	// Server is the server label of the target's metrics if
+	// identity.server is set.
+	Server string `yaml:"server"`
+	// Daemons lists the daemons behind the Control Agent at URL to query,
+	// or is "all" for every daemon the agent has a control socket for.
+	// Without it, only dhcp4 is queried and there is no daemon label.
+	Daemons []string `yaml:"daemons"`
+
+	service string // the daemon the Control Agent forwards commands to
+}
+
+type CollectorsConfig struct {
+	Global  bool `yaml:"global"`
+	Subnets bool `yaml:"subnets"`
+	Pools   bool `yaml:"pools"`
+	Lint    bool `yaml:"lint"`
+}
+
+// ThresholdsConfig holds utilization ratios (0..1) at which a subnet or pool
+// is considered to be running out of addresses.
+type ThresholdsConfig struct {
+	UtilizationWarning  float64 `yaml:"utilization_warning"`
+	UtilizationCritical float64 `yaml:"utilization_critical"`
+}
+
+// HealthConfig configures the /readyz endpoint. A target is ready if its
+// last query succeeded no longer than ReadyMaxAge ago.
+type HealthConfig struct {
+	ReadyMaxAge time.Duration `yaml:"ready_max_age"`
+}
+
+var currentCfg atomic.Pointer[Config]
+
+// currentConfig returns the active configuration. It must not be modified.
+func currentConfig() *Config {
+	return currentCfg.Load()
+}
+
+func defaultConfig() *Config {
+	return &Config{
+		Web: WebConfig{
+			ListenAddresses: strings.Split(flagDefault("l"), ","),
+			ReadTimeout:     flagDuration("timeout"),
+		},
+		Log: LogConfig{
+			Level:  flagDefault("log.level"),
+			Format: flagDefault("log.format"),
+		},
+		Namespace: flagDefault("namespace"),
+		Targets: []TargetConfig{{
+			Name:    defaultTargetName,
+			Socket:  flagDefault("s"),
+			Timeout: 10 * time.Second,
+		}},
+		Collectors: CollectorsConfig{Global: true, Subnets: true, Pools: true, Lint: true},
+		Forecast:   ForecastConfig{Resolution: time.Hour, Window: 14 * 24 * time.Hour, MinHistory: 48 * time.Hour},
+		Anomaly: AnomalyConfig{HalfLife: time.Hour, Threshold: 4, Warmup: 10,
+			DiscoverAckRatio: 4, NAKRequestRatio: 0.1, DropReceivedRatio: 0.05},
+		Observe:    ObserveConfig{Interval: 30 * time.Second},
+		Thresholds: ThresholdsConfig{UtilizationWarning: 0.8, UtilizationCritical: 0.95},
+		Health:     HealthConfig{ReadyMaxAge: 5 * time.Minute},
+		Replay:     ReplayConfig{Mode: flagDefault("replay.mode")},
+		Textfile:   TextfileConfig{Interval: flagDuration("textfile.interval")},
+		Push:       defaultPushConfig(),
+		Dashboard:  DashboardConfig{Refresh: 30 * time.Second},
+		Rules:      RulesConfig{Job: flagDefault("rules.job"), NAKRatio: 0.1, DropRatio: 0.05},
+	}
+}
+
+func flagDefault(name string) string {
+	return flag.Lookup(name).DefValue
+}
+
+func flagDuration(name string) time.Duration {
+	d, _ := time.ParseDuration(flag.Lookup(name).DefValue)
+	return d
+}
+
+// loadConfig builds a validated Config from defaults, the given YAML file
+// (if path is nonempty), the environment and explicitly set flags.
+func loadConfig(path string) (*Config, error) {
+	return buildConfig(path, os.LookupEnv, flag.CommandLine)
+}
+
+// buildConfig is loadConfig with the environment looked up with lookup and
+// the flags set in fs.
+func buildConfig(path string, lookup func(string) (string, bool), fs *flag.FlagSet) (*Config, error) {
+	cfg := defaultConfig()
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("could not read config file: %w", err)
+		}
+		if err := parseConfig(data, cfg); err != nil {
+			return nil, fmt.Errorf("could not parse config file '%s': %w", path, err)
+		}
+	}
+	if err := applyEnv(cfg, lookup); err != nil {
+		return nil, err
+	}
+	applyFlags(cfg, fs)
+	for i := range cfg.Targets {
+		if cfg.Targets[i].Timeout == 0 {
+			cfg.Targets[i].Timeout = 10 * time.Second
+		}
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, fmt.Errorf("invalid configuration: %w", err)
+	}
+	return cfg, nil
+}
+
+func parseConfig(data []byte, cfg *Config) error {
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	err := dec.Decode(cfg)
+	if errors.Is(err, io.EOF) {
+		// Empty file, keep defaults.
+		return nil
+	}
+	return err
+}
+
+type envOverride struct {
+	name  string
+	apply func(cfg *Config, value string) error
+}
+
+// envOverrides lists the supported environment variables. The Kea target
+// variables apply to the first configured target.
+var envOverrides = []envOverride{
+	{"GKSE_WEB_LISTEN_ADDRESSES", func(cfg *Config, v string) error { cfg.Web.ListenAddresses = strings.Split(v, ","); return nil }},
+	{"GKSE_WEB_READ_TIMEOUT", func(cfg *Config, v string) (err error) { cfg.Web.ReadTimeout, err = time.ParseDuration(v); return }},
+	{"GKSE_WEB_CONFIG_FILE", func(cfg *Config, v string) error { cfg.Web.ConfigFile = v; return nil }},
+	{"GKSE_LOG_LEVEL", func(cfg *Config, v string) error { cfg.Log.Level = v; return nil }},
+	{"GKSE_LOG_FORMAT", func(cfg *Config, v string) error { cfg.Log.Format = v; return nil }},
+	{"GKSE_LOG_COLOR", func(cfg *Config, v string) (err error) { cfg.Log.Color, err = strconv.ParseBool(v); return }},
+	{"GKSE_NAMESPACE", func(cfg *Config, v string) error { cfg.Namespace = v; return nil }},
+	{"GKSE_RECORD_DIR", func(cfg *Config, v string) error { cfg.Record.Dir = v; return nil }},
+	{"GKSE_RECORD_MAX_AGE", func(cfg *Config, v string) (err error) { cfg.Record.MaxAge, err = time.ParseDuration(v); return }},
+	{"GKSE_RECORD_MAX_BYTES", func(cfg *Config, v string) (err error) {
+		cfg.Record.MaxBytes, err = strconv.ParseInt(v, 10, 64)
+		return
+	}},
+	{"GKSE_REPLAY_DIR", func(cfg *Config, v string) error { cfg.Replay.Dir = v; return nil }},
+	{"GKSE_REPLAY_MODE", func(cfg *Config, v string) error { cfg.Replay.Mode = v; return nil }},
+	{"GKSE_TEXTFILE_PATH", func(cfg *Config, v string) error { cfg.Textfile.Path = v; return nil }},
+	{"GKSE_TEXTFILE_INTERVAL", func(cfg *Config, v string) (err error) { cfg.Textfile.Interval, err = time.ParseDuration(v); return }},
+	{"GKSE_DASHBOARD_REFRESH", func(cfg *Config, v string) (err error) { cfg.Dashboard.Refresh, err = time.ParseDuration(v); return }},
+	{"GKSE_RULES_JOB", func(cfg *Config, v string) error { cfg.Rules.Job = v; return nil }},
+	{"GKSE_PUSH_INTERVAL", func(cfg *Config, v string) (err error) { cfg.Push.Interval, err = time.ParseDuration(v); return }},
+	{"GKSE_PUSH_GATEWAY_URL", func(cfg *Config, v string) error { cfg.Push.Pushgateway.URL = v; return nil }},
+	{"GKSE_PUSH_GATEWAY_JOB", func(cfg *Config, v string) error { cfg.Push.Pushgateway.Job = v; return nil }},
+	{"GKSE_PUSH_REMOTE_WRITE_URL", func(cfg *Config, v string) error { cfg.Push.RemoteWrite.URL = v; return nil }},
+	{"GKSE_PUSH_OTLP_ENDPOINT", func(cfg *Config, v string) error { cfg.Push.OTLP.Endpoint = v; return nil }},
+	{"GKSE_PUSH_OTLP_PROTOCOL", func(cfg *Config, v string) error { cfg.Push.OTLP.Protocol = v; return nil }},
+	{"GKSE_PUSH_INFLUXDB_URL", func(cfg *Config, v string) error { cfg.Push.InfluxDB.URL = v; return nil }},
+	{"GKSE_PUSH_INFLUXDB_TOKEN", func(cfg *Config, v string) error { cfg.Push.InfluxDB.Token = v; return nil }},
+	{"GKSE_PUSH_GRAPHITE_ADDRESS", func(cfg *Config, v string) error { cfg.Push.Graphite.Address = v; return nil }},
+	{"GKSE_KEA_SOCKET", func(cfg *Config, v string) error { cfg.Targets[0].Socket = v; cfg.Targets[0].URL = ""; return nil }},
+	{"GKSE_KEA_URL", func(cfg *Config, v string) error { cfg.Targets[0].URL = v; cfg.Targets[0].Socket = ""; return nil }},
+	{"GKSE_KEA_STATS_FILE", func(cfg *Config, v string) error { cfg.Targets[0].StatsFile = v; return nil }},
+	{"GKSE_KEA_CONFIG_FILE", func(cfg *Config, v string) error { cfg.Targets[0].ConfigFile = v; return nil }},
+}
+
+func applyEnv(cfg *Config, lookup func(string) (string, bool)) error {
+	for _, e := range envOverrides {
+		v, ok := lookup(e.name)
+		if !ok {
+			continue
+		}
+		if len(cfg.Targets) == 0 {
+			cfg.Targets = []TargetConfig{{Name: defaultTargetName}}
+		}
+		if err := e.apply(cfg, v); err != nil {
+			return fmt.Errorf("invalid value '%s' for environment variable %s: %w", v, e.name, err)
+		}
+	}
+	return nil
+}
+
+// applyFlags copies the flags explicitly set in fs into cfg. The values are
+// taken from the variables the flags of flag.CommandLine are bound to.
+func applyFlags(cfg *Config, fs *flag.FlagSet) {
+	fs.Visit(func(f *flag.Flag) {
+		if len(cfg.Targets) == 0 {
+			cfg.Targets = []TargetConfig{{Name: defaultTargetName}}
+		}
+		switch f.Name {
+		case "l":
+			cfg.Web.ListenAddresses = listen.values
+		case "web.config.file":
+			cfg.Web.ConfigFile = *webConfigFile
+		case "timeout":
+			cfg.Web.ReadTimeout = *timeout
+		case "cl":
+			cfg.Log.Color = *logColor
+		case "log.level":
+			cfg.Log.Level = *logLevelFlag
+		case "log.format":
+			cfg.Log.Format = *logFormatFlag
+		case "namespace":
+			cfg.Namespace = *namespace
+		case "record.dir":
+			cfg.Record.Dir = *recordDir
+		case "replay.dir":
+			cfg.Replay.Dir = *replayDir
+		case "replay.mode":
+			cfg.Replay.Mode = *replayMode
+		case "textfile.path":
+			cfg.Textfile.Path = *textfilePath
+		case "textfile.interval":
+			cfg.Textfile.Interval = *textfileInterval
+		case "rules.job":
+			cfg.Rules.Job = *rulesJob
+		case "push.interval":
+			cfg.Push.Interval = *pushInterval
+		case "push.gateway.url":
+			cfg.Push.Pushgateway.URL = *pushGatewayURL
+		case "push.gateway.job":
+			cfg.Push.Pushgateway.Job = *pushGatewayJob
+		case "push.remote-write.url":
+			cfg.Push.RemoteWrite.URL = *pushRemoteWriteURL
+		case "push.otlp.endpoint":
+			cfg.Push.OTLP.Endpoint = *otlpEndpoint
+		case "push.otlp.protocol":
+			cfg.Push.OTLP.Protocol = *otlpProtocol
+		case "push.influxdb.url":
+			cfg.Push.InfluxDB.URL = *influxURL
+		case "push.graphite.address":
+			cfg.Push.Graphite.Address = *graphiteAddress
+		case "s":
+			cfg.Targets[0].Socket = *sockPath
+			cfg.Targets[0].URL = ""
+		case "f":
+			cfg.Targets[0].StatsFile = *jsonFromFile
+		case "c":
+			cfg.Targets[0].ConfigFile = *configFromFile
+		}
+	})
+}
+
+var labelNameRE = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+func (cfg *Config) validate() error {
+	var errs []error
+	if len(cfg.Web.ListenAddresses) == 0 {
+		errs = append(errs, errors.New("web.listen_addresses: at least one address is required"))
+	}
+	for i, addr := range cfg.Web.ListenAddresses {
+		if addr == "" || addr == unixListenPrefix {
+			errs = append(errs, fmt.Errorf("web.listen_addresses[%d]: must not be empty", i))
+		}
+	}
+	if cfg.Web.ConfigFile != "" {
+		if err := web.Validate(cfg.Web.ConfigFile); err != nil {
+			errs = append(errs, fmt.Errorf("web.config_file: %w", err))
+		}
+	}
+	if cfg.Web.ReadTimeout <= 0 {
+		errs = append(errs, fmt.Errorf("web.read_timeout: must be positive, got %s", cfg.Web.ReadTimeout))
+	}
+	if _, err := parseLogLevel(cfg.Log.Level); err != nil {
+		errs = append(errs, fmt.Errorf("log.level: %w", err))
+	}
+	if !slices.Contains(logFormats, cfg.Log.Format) {
+		errs = append(errs, fmt.Errorf("log.format: unknown format '%s', want one of %s", cfg.Log.Format, strings.Join(logFormats, ", ")))
+	}
+	if !labelNameRE.MatchString(cfg.Namespace) {
+		errs = append(errs, fmt.Errorf("namespace: '%s' is not a valid Prometheus metric name prefix", cfg.Namespace))
+	}
+	errs = append(errs, validateLabels("labels", cfg.Labels)...)
+	if len(cfg.Targets) == 0 {
+		errs = append(errs, errors.New("targets: at least one target is required"))
+	}
+	names := make(map[string]int)
+	for i, t := range cfg.Targets {
+		field := fmt.Sprintf("targets[%d]", i)
+		if t.Name == "" {
+			errs = append(errs, fmt.Errorf("%s.name: must not be empty", field))
+		} else if prev, ok := names[t.Name]; ok {
+			errs = append(errs, fmt.Errorf("%s.name: '%s' already used by targets[%d]", field, t.Name, prev))
+		} else {
+			names[t.Name] = i
+		}
+		fromFiles := t.StatsFile != "" && t.ConfigFile != ""
+		switch {
+		case t.Socket != "" && t.URL != "":
+			errs = append(errs, fmt.Errorf("%s: socket and url are mutually exclusive", field))
+		case t.Socket == "" && t.URL == "" && !fromFiles && cfg.Replay.Dir == "":
+			errs = append(errs, fmt.Errorf("%s: one of socket or url is required unless both stats_file and config_file are set, or replay.dir is used", field))
+		}
+		if t.Timeout < 0 {
+			errs = append(errs, fmt.Errorf("%s.timeout: must not be negative, got %s", field, t.Timeout))
+		}
+		errs = append(errs, validateLabels(field+".labels", t.Labels)...)
+		if _, ok := t.Labels["target"]; ok {
+			errs = append(errs, fmt.Errorf("%s.labels: 'target' is reserved", field))
+		}
+		errs = append(errs, validateDaemons(field, t)...)
+	}
+	if _, ok := cfg.Labels["target"]; ok && len(cfg.Targets) > 1 {
+		errs = append(errs, errors.New("labels: 'target' is reserved when more than one target is configured"))
+	}
+	if _, ok := cfg.Labels["daemon"]; ok && slices.ContainsFunc(cfg.Targets, func(t TargetConfig) bool { return len(t.Daemons) > 0 }) {
+		errs = append(errs, errors.New("labels: 'daemon' is reserved when a target sets daemons"))
+	}
+	errs = append(errs, cfg.Identity.validate(cfg.Labels, cfg.Targets)...)
+	if err := cfg.UserContext.validate(); err != nil {
+		errs = append(errs, err)
+	}
+	for i, l := range cfg.UserContext.Labels {
+		if _, ok := cfg.Labels[l.name()]; ok {
+			errs = append(errs, fmt.Errorf("user_context.labels[%d].label: '%s' is also set in labels", i, l.name()))
+		}
+		for j, t := range cfg.Targets {
+			if _, ok := t.Labels[l.name()]; ok {
+				errs = append(errs, fmt.Errorf("user_context.labels[%d].label: '%s' is also set in targets[%d].labels", i, l.name(), j))
+			}
+		}
+	}
+	if err := cfg.Forecast.validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := cfg.Anomaly.validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if cfg.Observe.Interval < 0 {
+		errs = append(errs, fmt.Errorf("observe.interval: must not be negative, got %s", cfg.Observe.Interval))
+	}
+	th := cfg.Thresholds
+	if th.UtilizationWarning <= 0 || th.UtilizationWarning > 1 {
+		errs = append(errs, fmt.Errorf("thresholds.utilization_warning: must be in (0, 1], got %g", th.UtilizationWarning))
+	}
+	if th.UtilizationCritical <= 0 || th.UtilizationCritical > 1 {
+		errs = append(errs, fmt.Errorf("thresholds.utilization_critical: must be in (0, 1], got %g", th.UtilizationCritical))
+	}
+	if th.UtilizationWarning > th.UtilizationCritical {
+		errs = append(errs, fmt.Errorf("thresholds: utilization_warning (%g) must not exceed utilization_critical (%g)", th.UtilizationWarning, th.UtilizationCritical))
+	}
+	if err := cfg.Replay.validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := cfg.Record.validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if cfg.Record.Dir != "" && cfg.Record.Dir == cfg.Replay.Dir {
+		errs = append(errs, errors.New("record.dir: must differ from replay.dir"))
+	}
+	if err := cfg.Textfile.validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := cfg.Push.validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := cfg.Dashboard.validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := cfg.Rules.validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if cfg.Health.ReadyMaxAge <= 0 {
+		errs = append(errs, fmt.Errorf("health.ready_max_age: must be positive, got %s", cfg.Health.ReadyMaxAge))
+	}
+	return errors.Join(errs...)
+}
+
+func validateLabels(field string, labels map[string]string) []error {
+	var errs []error
+	for k := range labels {
+		if !labelNameRE.MatchString(k) || strings.HasPrefix(k, "__") {
+			errs = append(errs, fmt.Errorf("%s: '%s' is not a valid label name", field, k))
+		}
+	}
+	return errs
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testFlags returns a flag set with args set, whose flags share their values
+// with those of flag.CommandLine, as applyFlags expects. The values are reset
+// to their defaults when the test ends.
+func testFlags(t *testing.T, args ...string) *flag.FlagSet {
+	t.Helper()
+	fs := flag.NewFlagSet("gkse", flag.ContinueOnError)
+	flag.VisitAll(func(f *flag.Flag) {
+		if strings.HasPrefix(f.Name, "test.") {
+			return
+		}
+		fs.Var(f.Value, f.Name, f.Usage)
+		if l, ok := f.Value.(*stringList); ok {
+			saved := *l
+			t.Cleanup(func() { *l = saved })
+			return
+		}
+		t.Cleanup(func() { f.Value.Set(f.DefValue) })
+	})
+	if err := fs.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	return fs
+}
+
+func TestLoadConfig(t *testing.T) {
+	const file = `
+namespace: fromfile
+targets:
+  - name: dhcp1
+    socket: /run/kea/dhcp1.sock
+  - name: dhcp2
+    url: http://dhcp2:8000/
+    timeout: 2s
+`
+	for _, tc := range []struct {
+		name  string
+		file  string // "" for no file
+		env   map[string]string
+		flags []string
+		check func(t *testing.T, cfg *Config)
+	}{
+		{
+			name: "defaults",
+			check: func(t *testing.T, cfg *Config) {
+				if cfg.Namespace != "kea" || len(cfg.Targets) != 1 || cfg.Targets[0].Socket != flagDefault("s") {
+					t.Errorf("got namespace %q and targets %+v, want the defaults", cfg.Namespace, cfg.Targets)
+				}
+			},
+		},
+		{
+			name: "empty file",
+			file: "\n",
+			check: func(t *testing.T, cfg *Config) {
+				if cfg.Namespace != "kea" || cfg.Targets[0].Name != defaultTargetName {
+					t.Errorf("got namespace %q and targets %+v, want the defaults", cfg.Namespace, cfg.Targets)
+				}
+			},
+		},
+		{
+			name: "file",
+			file: file,
+			check: func(t *testing.T, cfg *Config) {
+				if cfg.Namespace != "fromfile" {
+					t.Errorf("namespace = %q, want fromfile", cfg.Namespace)
+				}
+				if got := cfg.Targets[0].Timeout; got != 10*time.Second {
+					t.Errorf("targets[0].timeout = %s, want the default of 10s", got)
+				}
+				if got := cfg.Targets[1].Timeout; got != 2*time.Second {
+					t.Errorf("targets[1].timeout = %s, want 2s", got)
+				}
+			},
+		},
+		{
+			name: "environment over file",
+			file: file,
+			env:  map[string]string{"GKSE_NAMESPACE": "fromenv", "GKSE_KEA_URL": "http://dhcp1:8000/", "GKSE_WEB_LISTEN_ADDRESSES": ":1,:2"},
+			check: func(t *testing.T, cfg *Config) {
+				if cfg.Namespace != "fromenv" {
+					t.Errorf("namespace = %q, want fromenv", cfg.Namespace)
+				}
+				if tc := cfg.Targets[0]; tc.URL != "http://dhcp1:8000/" || tc.Socket != "" {
+					t.Errorf("targets[0] = %+v, want the URL from GKSE_KEA_URL and no socket", tc)
+				}
+				if got := strings.Join(cfg.Web.ListenAddresses, " "); got != ":1 :2" {
+					t.Errorf("web.listen_addresses = %q, want :1 :2", got)
+				}
+			},
+		},
+		{
+			name:  "flags over environment and file",
+			file:  file,
+			env:   map[string]string{"GKSE_NAMESPACE": "fromenv", "GKSE_KEA_URL": "http://dhcp1:8000/"},
+			flags: []string{"-namespace=fromflag", "-s=/run/kea/flag.sock"},
+			check: func(t *testing.T, cfg *Config) {
+				if cfg.Namespace != "fromflag" {
+					t.Errorf("namespace = %q, want fromflag", cfg.Namespace)
+				}
+				if tc := cfg.Targets[0]; tc.Socket != "/run/kea/flag.sock" || tc.URL != "" {
+					t.Errorf("targets[0] = %+v, want the socket from -s and no URL", tc)
+				}
+				if got := cfg.Targets[1].URL; got != "http://dhcp2:8000/" {
+					t.Errorf("targets[1].url = %q, want it unchanged", got)
+				}
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			path := ""
+			if tc.file != "" {
+				path = filepath.Join(t.TempDir(), "gkse.yml")
+				if err := os.WriteFile(path, []byte(tc.file), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			lookup := func(name string) (string, bool) {
+				v, ok := tc.env[name]
+				return v, ok
+			}
+			cfg, err := buildConfig(path, lookup, testFlags(t, tc.flags...))
+			if err != nil {
+				t.Fatal(err)
+			}
+			tc.check(t, cfg)
+		})
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		file string
+		env  map[string]string
+		want []string
+	}{
+		{
+			name: "unknown field",
+			file: "namespace: kea\nbogus: 1\n",
+			want: []string{"could not parse config file", "field bogus not found in type main.Config"},
+		},
+		{
+			name: "bad environment variable",
+			env:  map[string]string{"GKSE_WEB_READ_TIMEOUT": "soon"},
+			want: []string{"invalid value 'soon' for environment variable GKSE_WEB_READ_TIMEOUT"},
+		},
+		{
+			name: "invalid values",
+			file: `
+namespace: 9lives
+web:
+  read_timeout: -1s
+log:
+  format: xml
+targets:
+  - name: dhcp1
+    socket: /run/kea.sock
+    url: http://dhcp1:8000/
+  - name: dhcp1
+    timeout: -1s
+    labels:
+      target: x
+`,
+			want: []string{
+				"invalid configuration",
+				"web.read_timeout: must be positive, got -1s",
+				"log.format: unknown format 'xml', want one of ",
+				"namespace: '9lives' is not a valid Prometheus metric name prefix",
+				"targets[0]: socket and url are mutually exclusive",
+				"targets[1].name: 'dhcp1' already used by targets[0]",
+				"targets[1]: one of socket or url is required",
+				"targets[1].timeout: must not be negative, got -1s",
+				"targets[1].labels: 'target' is reserved",
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			path := ""
+			if tc.file != "" {
+				path = filepath.Join(t.TempDir(), "gkse.yml")
+				if err := os.WriteFile(path, []byte(tc.file), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			lookup := func(name string) (string, bool) {
+				v, ok := tc.env[name]
+				return v, ok
+			}
+			_, err := buildConfig(path, lookup, testFlags(t))
+			if err == nil {
+				t.Fatal("buildConfig() succeeded, want an error")
+			}
+			for _, want := range tc.want {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("buildConfig() = %v, want an error containing %q", err, want)
+				}
+			}
+		})
+	}
+
+	_, err := buildConfig(filepath.Join(t.TempDir(), "missing.yml"), os.LookupEnv, testFlags(t))
+	if err == nil || !strings.HasPrefix(err.Error(), "could not read config file: ") {
+		t.Errorf("buildConfig() of a missing file = %v, want a read error", err)
+	}
+}
+
+func TestReloadRestartWarning(t *testing.T) {
+	var logs bytes.Buffer
+	defer func(l *slog.Logger) { logger = l }(logger)
+	logger = slog.New(slog.NewTextHandler(&logs, nil))
+
+	path := filepath.Join(t.TempDir(), "gkse.yml")
+	write := func(s string) {
+		if err := os.WriteFile(path, []byte(s), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("targets: [{name: dhcp1, socket: /run/kea/dhcp1.sock}]\n")
+	cfg, err := loadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	currentCfg.Store(cfg)
+	kc := &collectorSet{}
+	kc.update(cfg)
+	r := &reloader{path: path, collectors: kc}
+
+	// Targets are changed immediately.
+	write("targets: [{name: dhcp2, socket: /run/kea/dhcp2.sock}]\n")
+	if err := r.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if got := currentConfig().Targets[0].Name; got != "dhcp2" {
+		t.Errorf("target after reload is %s, want dhcp2", got)
+	}
+	if strings.Contains(logs.String(), "restart") {
+		t.Errorf("changed targets logged a restart warning:\n%s", logs.String())
+	}
+
+	write(`
+targets: [{name: dhcp2, socket: /run/kea/dhcp2.sock}]
+textfile: {path: /var/lib/node_exporter/kea.prom}
+push: {pushgateway: {url: "http://pushgateway:9091"}}
+`)
+	if err := r.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if want := `level=WARN msg="Some changes only take effect after a restart" settings="[textfile push]"`; !strings.Contains(logs.String(), want) {
+		t.Errorf("logs have no %q:\n%s", want, logs.String())
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"embed"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"net/http"
+	"time"
+)
+
+//go:embed assets/dashboard.html
+var dashboardHTML string
+
+//go:embed assets/static
+var staticAssets embed.FS
+
+var dashboardTmpl = template.Must(template.New("dashboard").Funcs(template.FuncMap{
+	"percent": func(v float64) string { return fmt.Sprintf("%.1f", 100*v) },
+	"since":   func(t time.Time) string { return time.Since(t).Truncate(time.Second).String() },
+}).Parse(dashboardHTML))
+
+// DashboardConfig configures the HTML dashboard at /dashboard, which reloads
+// itself every Refresh.
+type DashboardConfig struct {
+	Refresh time.Duration `yaml:"refresh"`
+}
+
+// dashboardTarget is what the dashboard shows for one target.
+type dashboardTarget struct {
+	Name    string
+	Error   string
+	Time    time.Time
+	Rates   []dashboardRate
+	Subnets []dashboardSubnet
+}
+
+// dashboardRate is the per-second rate of a packet counter between the last
+// two polls. Known is false if there was no earlier poll, or the counter was
+// reset in between.
+type dashboardRate struct {
+	Name  string
+	Rate  float64
+	Known bool
+}
+
+type dashboardSubnet struct {
+	apiSubnet
+	Level string // ok, warning or critical
+	Pools []dashboardPool
+}
+
+type dashboardPool struct {
+	apiPool
+	Level string
+}
+
+// dashboardPackets are the global packet counters shown as rates.
+var dashboardPackets = []struct {
+	name  string
+	value func(*KeaCookedMetrics) float64
+}{
+	{"received", func(m *KeaCookedMetrics) float64 { return m.Pkt4Received }},
+	{"sent", func(m *KeaCookedMetrics) float64 { return m.Pkt4Sent }},
+	{"discover", func(m *KeaCookedMetrics) float64 { return m.Pkt4DiscoverReceived }},
+	{"offer", func(m *KeaCookedMetrics) float64 { return m.Pkt4OfferSent }},
+	{"request", func(m *KeaCookedMetrics) float64 { return m.Pkt4RequestReceived }},
+	{"ack", func(m *KeaCookedMetrics) float64 { return m.Pkt4AckSent }},
+	{"nak", func(m *KeaCookedMetrics) float64 { return m.Pkt4NakSent }},
+	{"release", func(m *KeaCookedMetrics) float64 { return m.Pkt4ReleaseReceived }},
+	{"decline", func(m *KeaCookedMetrics) float64 { return m.Pkt4DeclineReceived }},
+	{"dropped", func(m *KeaCookedMetrics) float64 { return m.Pkt4ReceiveDrop }},
+	{"parse failed", func(m *KeaCookedMetrics) float64 { return m.Pkt4ParseFailed }},
+}
+
+// packetRates returns the packet rates between s and the snapshot before it.
+func (s *keaSnapshot) packetRates() []dashboardRate {
+	rates := make([]dashboardRate, 0, len(dashboardPackets))
+	for _, p := range dashboardPackets {
+		r := dashboardRate{Name: p.name}
+		if s.Prev != nil {
+			d := p.value(s.Metrics) - p.value(s.Prev.Metrics)
+			secs := s.Time.Sub(s.Prev.Time).Seconds()
+			if d >= 0 && secs > 0 {
+				r.Rate, r.Known = d/secs, true
+			}
+		}
+		rates = append(rates, r)
+	}
+	return rates
+}
+
+// utilizationLevel classifies u by the thresholds in th.
+func utilizationLevel(u float64, th ThresholdsConfig) string {
+	switch {
+	case u >= th.UtilizationCritical:
+		return "critical"
+	case u >= th.UtilizationWarning:
+		return "warning"
+	}
+	return "ok"
+}
+
+// dashboard serves the HTML dashboard and its static assets.
+type dashboard struct {
+	kc *collectorSet
+}
+
+func (d *dashboard) register(mux *http.ServeMux) {
+	static, _ := fs.Sub(staticAssets, "assets/static")
+	mux.Handle("GET /static/", http.StripPrefix("/static/", http.FileServerFS(static)))
+	mux.HandleFunc("GET /dashboard", d.handle)
+}
+
+func (d *dashboard) handle(w http.ResponseWriter, r *http.Request) {
+	cfg := currentConfig()
+	snaps, failed := d.kc.refresh(newScrapeContext(r.Context()), apiSnapshotMaxAge)
+	byName := make(map[string]*keaSnapshot, len(snaps))
+	for _, s := range snaps {
+		byName[s.Target.Name] = s
+	}
+	data := struct {
+		Version    string
+		Refresh    int
+		Thresholds ThresholdsConfig
+		Targets    []dashboardTarget
+	}{Version: version, Refresh: int(cfg.Dashboard.Refresh.Seconds()), Thresholds: cfg.Thresholds}
+	for _, t := range cfg.Targets {
+		dt := dashboardTarget{Name: t.Name}
+		s, ok := byName[t.Name]
+		if !ok {
+			if err := failed[t.Name]; err != nil {
+				dt.Error = err.Error()
+			}
+			data.Targets = append(data.Targets, dt)
+			continue
+		}
+		dt.Time = s.Time
+		dt.Rates = s.packetRates()
+		for _, sn := range s.apiSubnets() {
+			ds := dashboardSubnet{apiSubnet: sn, Level: utilizationLevel(sn.Utilization, cfg.Thresholds)}
+			for _, p := range sn.Pools {
+				ds.Pools = append(ds.Pools, dashboardPool{p, utilizationLevel(p.Utilization, cfg.Thresholds)})
+			}
+			dt.Subnets = append(dt.Subnets, ds)
+		}
+		data.Targets = append(data.Targets, dt)
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := dashboardTmpl.Execute(w, data); err != nil {
+		logger.Error("Could not render dashboard", "error", err)
+	}
+}
+
+func (cfg DashboardConfig) validate() error {
+	if cfg.Refresh < time.Second {
+		return fmt.Errorf("dashboard.refresh: must be at least 1s, got %s", cfg.Refresh)
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDashboard(t *testing.T) {
+	url := newTestExporter(t, fixtureConfig("kea-2.6").Targets...)
+	cfg := *currentConfig()
+	cfg.Thresholds.UtilizationWarning = 0.5
+	currentCfg.Store(&cfg)
+
+	resp, err := http.Get(url + "/dashboard")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	page := string(b)
+	for _, want := range []string{
+		`<meta http-equiv="refresh" content="30">`,
+		`<td>203.0.113.0/25</td><td>lab</td>`,
+		`<td>0: 192.0.2.10 - 192.0.2.200</td>`,
+		`style="width: 57.0%"`,
+	} {
+		if !strings.Contains(page, want) {
+			t.Errorf("dashboard does not contain %q", want)
+		}
+	}
+	// Subnet 3 is at 57%, over the warning threshold of 50%.
+	if strings.Count(page, `class="subnet warning"`) != 1 || strings.Count(page, `class="subnet ok"`) != 2 {
+		t.Errorf("want exactly one subnet highlighted as warning")
+	}
+	if strings.Contains(page, "https://") || strings.Contains(page, "http://") {
+		t.Errorf("dashboard refers to external resources")
+	}
+
+	resp, err = http.Get(url + "/static/dashboard.css")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/css") {
+		t.Errorf("GET /static/dashboard.css: got %s with Content-Type %q", resp.Status, resp.Header.Get("Content-Type"))
+	}
+}
+
+func TestPacketRates(t *testing.T) {
+	now := time.Now()
+	s := &keaSnapshot{Time: now, Metrics: &KeaCookedMetrics{Pkt4Received: 700, Pkt4AckSent: 5}}
+	if r := s.packetRates()[0]; r.Known {
+		t.Errorf("got rate %+v without an earlier snapshot", r)
+	}
+	s.Prev = &keaSnapshot{Time: now.Add(-10 * time.Second), Metrics: &KeaCookedMetrics{Pkt4Received: 200, Pkt4AckSent: 50}}
+	rates := make(map[string]dashboardRate)
+	for _, r := range s.packetRates() {
+		rates[r.Name] = r
+	}
+	if r := rates["received"]; !r.Known || r.Rate != 50 {
+		t.Errorf("got received rate %+v, want 50/s", r)
+	}
+	// The ack counter went down, so Kea was restarted in between.
+	if r := rates["ack"]; r.Known {
+		t.Errorf("got ack rate %+v across a counter reset", r)
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strconv"
+	"text/tabwriter"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
+)
+
+var dumpFormat = flag.String("dump.format", "table", "Output format of the dump subcommand: table, json or prometheus")
+
+var dumpFormats = []string{"table", "json", "prometheus"}
+
+// dumpRow is the utilization of one subnet, or of one pool if Pool is set.
+type dumpRow struct {
+	Target      string  `json:"target"`
+	SubnetID    uint64  `json:"subnet_id"`
+	Pool        *uint64 `json:"pool,omitempty"`
+	Prefix      string  `json:"prefix"`
+	Assigned    float64 `json:"assigned"`
+	Total       float64 `json:"total"`
+	Utilization float64 `json:"utilization"`
+	Declined    float64 `json:"declined"`
+}
+
+// runDump queries every target once and prints the result to stdout.
+func runDump(cfg *Config) int {
+	if !slices.Contains(dumpFormats, *dumpFormat) {
+		logger.Error("Unknown dump format", "format", *dumpFormat, "want", dumpFormats)
+		return 2
+	}
+	if err := dump(context.Background(), cfg, *dumpFormat, os.Stdout); err != nil {
+		logger.Error("Could not dump Kea statistics", "error", err)
+		return 1
+	}
+	return 0
+}
+
+func dump(ctx context.Context, cfg *Config, format string, w io.Writer) error {
+	if format == "prometheus" {
+		return dumpPrometheus(cfg, w)
+	}
+	ctx = newScrapeContext(ctx)
+	var rows []dumpRow
+	var errs []error
+	for _, t := range cfg.Targets {
+		r, err := dumpTarget(ctx, t)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("target '%s': %w", t.Name, err))
+			continue
+		}
+		rows = append(rows, r...)
+	}
+	var err error
+	if format == "json" {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		if rows == nil {
+			rows = []dumpRow{}
+		}
+		err = enc.Encode(rows)
+	} else {
+		err = writeDumpTable(w, rows, len(cfg.Targets) > 1)
+	}
+	if err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// dumpTarget runs the same query and parse pipeline as a scrape and returns
+// one row per subnet and pool, sorted by subnet ID and pool index.
+func dumpTarget(ctx context.Context, t TargetConfig) ([]dumpRow, error) {
+	snap, err := takeSnapshot(ctx, t)
+	if err != nil {
+		return nil, err
+	}
+	cooked, config := snap.Metrics, snap.Config
+	var rows []dumpRow
+	for _, id := range sortedKeys(cooked.SubnetMetrics) {
+		snm := cooked.SubnetMetrics[id]
+		prefix, _ := config.subnetFromID(4, id)
+		rows = append(rows, dumpRow{
+			Target:      t.Name,
+			SubnetID:    id,
+			Prefix:      prefix,
+			Assigned:    snm.AssignedAddresses,
+			Total:       snm.TotalAddresses,
+			Utilization: utilization(snm.AssignedAddresses, snm.TotalAddresses),
+			Declined:    snm.DeclinedAddresses,
+		})
+		for _, pid := range sortedKeys(snm.PoolMetrics) {
+			pm := snm.PoolMetrics[pid]
+			rows = append(rows, dumpRow{
+				Target:      t.Name,
+				SubnetID:    id,
+				Pool:        &pid,
+				Prefix:      prefix,
+				Assigned:    pm.AssignedAddresses,
+				Total:       pm.TotalAddresses,
+				Utilization: utilization(pm.AssignedAddresses, pm.TotalAddresses),
+				Declined:    pm.DeclinedAddresses,
+			})
+		}
+	}
+	return rows, nil
+}
+
+func sortedKeys[K cmp.Ordered, V any](m map[K]V) []K {
+	keys := make([]K, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+// utilization returns the ratio of assigned to total addresses, or 0 if
+// there are no addresses.
+func utilization(assigned, total float64) float64 {
+	if total == 0 {
+		return 0
+	}
+	return assigned / total
+}
+
+func writeDumpTable(w io.Writer, rows []dumpRow, withTarget bool) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	if withTarget {
+		fmt.Fprint(tw, "TARGET\t")
+	}
+	fmt.Fprintln(tw, "SUBNET\tPOOL\tPREFIX\tASSIGNED\tTOTAL\tUTILIZATION\tDECLINED\t")
+	for _, r := range rows {
+		if withTarget {
+			fmt.Fprintf(tw, "%s\t", r.Target)
+		}
+		pool := "-"
+		if r.Pool != nil {
+			pool = strconv.FormatUint(*r.Pool, 10)
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%g\t%g\t%.1f%%\t%g\t\n",
+			r.SubnetID, pool, r.Prefix, r.Assigned, r.Total, 100*r.Utilization, r.Declined)
+	}
+	return tw.Flush()
+}
+
+// dumpPrometheus writes the metrics a scrape of /metrics would return for
+// the Kea targets, without the exporter's own metrics.
+func dumpPrometheus(cfg *Config, w io.Writer) error {
+	kc := &collectorSet{}
+	kc.update(cfg)
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(kc)
+	mfs, gatherErr := reg.Gather()
+	for _, mf := range mfs {
+		if _, err := expfmt.MetricFamilyToText(w, mf); err != nil {
+			return err
+		}
+	}
+	return gatherErr
+}
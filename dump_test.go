@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func fixtureConfig(versions ...string) *Config {
+	cfg := defaultConfig()
+	cfg.Targets = nil
+	for _, v := range versions {
+		cfg.Targets = append(cfg.Targets, TargetConfig{
+			Name:       v,
+			Timeout:    time.Second,
+			StatsFile:  filepath.Join("testdata", v, "statistic-get-all.json"),
+			ConfigFile: filepath.Join("testdata", v, "config-get.json"),
+		})
+	}
+	return cfg
+}
+
+func TestDumpJSON(t *testing.T) {
+	var b strings.Builder
+	if err := dump(context.Background(), fixtureConfig("kea-2.6"), "json", &b); err != nil {
+		t.Fatal(err)
+	}
+	var rows []dumpRow
+	if err := json.Unmarshal([]byte(b.String()), &rows); err != nil {
+		t.Fatal(err)
+	}
+	// Three subnets with one pool each.
+	if len(rows) != 6 {
+		t.Fatalf("got %d rows, want 6:\n%s", len(rows), b.String())
+	}
+	for i, r := range rows {
+		if want := uint64(i/2 + 1); r.SubnetID != want {
+			t.Errorf("row %d is subnet %d, want %d", i, r.SubnetID, want)
+		}
+		if (r.Pool != nil) != (i%2 == 1) {
+			t.Errorf("row %d: pool %v, want subnet rows followed by their pools", i, r.Pool)
+		}
+	}
+	r := rows[4]
+	if r.Prefix != "203.0.113.0/25" || r.Total != 100 || r.Utilization != r.Assigned/100 {
+		t.Errorf("subnet 3 in shared network: got %+v", r)
+	}
+}
+
+func TestDumpTable(t *testing.T) {
+	var b strings.Builder
+	if err := dump(context.Background(), fixtureConfig("kea-1.8", "kea-2.4"), "table", &b); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+	if fields := strings.Fields(lines[0]); fields[0] != "TARGET" || fields[len(fields)-1] != "DECLINED" {
+		t.Errorf("unexpected header %q", lines[0])
+	}
+	// kea-1.8 has no pool statistics, kea-2.4 has two subnets with a pool each.
+	if len(lines) != 1+2+4 {
+		t.Errorf("got %d lines, want 7:\n%s", len(lines), b.String())
+	}
+}
+
+func TestDumpError(t *testing.T) {
+	cfg := fixtureConfig("kea-2.4")
+	cfg.Targets[0].StatsFile = filepath.Join("testdata", "missing.json")
+	var b strings.Builder
+	err := dump(context.Background(), cfg, "table", &b)
+	if err == nil || !strings.Contains(err.Error(), "target 'kea-2.4'") {
+		t.Errorf("got error %v, want one naming the target", err)
+	}
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"math"
+	"os"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Forecast horizons of the forecast utilization metrics, by label value.
+var forecastHorizons = []struct {
+	label string
+	d     time.Duration
+}{
+	{"24h", 24 * time.Hour},
+	{"7d", 7 * 24 * time.Hour},
+}
+
+// maxExhaustion is how far ahead exhaustion is predicted. Beyond it, the
+// prediction is +Inf.
+const maxExhaustion = 365 * 24 * time.Hour
+
+// ForecastConfig configures forecasting of subnet and pool utilization. The
+// assigned addresses of every subnet and pool are kept as the mean per
+// Resolution for the last Window, and forecasts are made once MinHistory is
+// covered. If StateFile is set, the history survives restarts.
+type ForecastConfig struct {
+	Enabled    bool          `yaml:"enabled"`
+	Resolution time.Duration `yaml:"resolution"`
+	Window     time.Duration `yaml:"window"`
+	MinHistory time.Duration `yaml:"min_history"`
+	StateFile  string        `yaml:"state_file"`
+}
+
+func (cfg ForecastConfig) validate() error {
+	if !cfg.Enabled {
+		return nil
+	}
+	var errs []error
+	if cfg.Resolution <= 0 || (24*time.Hour)%cfg.Resolution != 0 {
+		errs = append(errs, fmt.Errorf("forecast.resolution: must divide 24h evenly, got %s", cfg.Resolution))
+	}
+	if cfg.MinHistory < 24*time.Hour {
+		errs = append(errs, fmt.Errorf("forecast.min_history: must be at least 24h, got %s", cfg.MinHistory))
+	}
+	if cfg.Window < cfg.MinHistory {
+		errs = append(errs, fmt.Errorf("forecast.window: must not be shorter than min_history (%s), got %s", cfg.MinHistory, cfg.Window))
+	}
+	return errors.Join(errs...)
+}
+
+// seriesKey identifies a subnet, or a pool of it, of a target. Pool is -1
+// for the subnet itself.
+type seriesKey struct {
+	Target string `json:"target"`
+	Subnet uint64 `json:"subnet"`
+	Pool   int    `json:"pool"`
+}
+
+// historyBucket holds the samples of one Resolution long interval. Index is
+// the start of the interval in Resolutions since the epoch.
+type historyBucket struct {
+	Index int64   `json:"index"`
+	Sum   float64 `json:"sum"`
+	Count int     `json:"count"`
+}
+
+func (b historyBucket) mean() float64 {
+	return b.Sum / float64(b.Count)
+}
+
+// forecaster keeps the history of the assigned addresses of every subnet
+// and pool, and forecasts them.
+type forecaster struct {
+	mu        sync.Mutex
+	cfg       ForecastConfig
+	series    map[seriesKey][]historyBucket
+	lastSaved int64 // bucket index of the last save of the state file
+
+	saveMu sync.Mutex
+}
+
+func newForecaster() *forecaster {
+	return &forecaster{series: make(map[seriesKey][]historyBucket)}
+}
+
+// configure applies cfg. A changed resolution discards the history, and the
+// state file is only loaded if there is no history yet.
+func (f *forecaster) configure(cfg ForecastConfig) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.cfg.Resolution != cfg.Resolution && len(f.series) > 0 {
+		logger.Warn("Forecast resolution changed, discarding history", "old", f.cfg.Resolution, "new", cfg.Resolution)
+		clear(f.series)
+	}
+	f.cfg = cfg
+	if cfg.StateFile == "" || len(f.series) > 0 {
+		return
+	}
+	if err := f.load(); err != nil {
+		logger.Warn("Could not load forecast history, starting over", "path", cfg.StateFile, "error", err)
+	}
+}
+
+// forecastState is the content of the state file.
+type forecastState struct {
+	Resolution time.Duration `json:"resolution"`
+	Series     []seriesState `json:"series"`
+}
+
+type seriesState struct {
+	seriesKey
+	Buckets []historyBucket `json:"buckets"`
+}
+
+// load reads the history from the state file. A missing file is no error.
+func (f *forecaster) load() error {
+	data, err := os.ReadFile(f.cfg.StateFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var st forecastState
+	if err := json.Unmarshal(data, &st); err != nil {
+		return err
+	}
+	if st.Resolution != f.cfg.Resolution {
+		return fmt.Errorf("history has resolution %s, want %s", st.Resolution, f.cfg.Resolution)
+	}
+	for _, s := range st.Series {
+		f.series[s.seriesKey] = s.Buckets
+	}
+	logger.Info("Loaded forecast history", "path", f.cfg.StateFile, "series", len(st.Series))
+	return nil
+}
+
+// save writes the history to the state file.
+func (f *forecaster) save(data []byte) {
+	f.saveMu.Lock()
+	defer f.saveMu.Unlock()
+	if err := writeFileAtomic(f.cfg.StateFile, data, 0o644); err != nil {
+		logger.Error("Could not save forecast history", "path", f.cfg.StateFile, "error", err)
+	}
+}
+
+// index returns the bucket index of t.
+func (f *forecaster) index(t time.Time) int64 {
+	return t.UnixNano() / int64(f.cfg.Resolution)
+}
+
+// observe adds the assigned addresses of every subnet and pool in m to the
+// history of target. Buckets older than the window are dropped, and the
+// state file is written whenever a new bucket is started.
+func (f *forecaster) observe(target string, t time.Time, m *KeaCookedMetrics) {
+	f.mu.Lock()
+	idx := f.index(t)
+	add := func(k seriesKey, v float64) {
+		h := f.series[k]
+		switch n := len(h); {
+		case n > 0 && h[n-1].Index == idx:
+			h[n-1].Sum += v
+			h[n-1].Count++
+		case n > 0 && h[n-1].Index > idx:
+			// Samples arriving late are dropped.
+			return
+		default:
+			h = append(h, historyBucket{Index: idx, Sum: v, Count: 1})
+		}
+		f.series[k] = h
+	}
+	for id, snm := range m.SubnetMetrics {
+		add(seriesKey{target, id, -1}, snm.AssignedAddresses)
+		for pid, pm := range snm.PoolMetrics {
+			add(seriesKey{target, id, int(pid)}, pm.AssignedAddresses)
+		}
+	}
+	oldest := idx - int64(f.cfg.Window/f.cfg.Resolution)
+	for k, h := range f.series {
+		i, _ := slices.BinarySearchFunc(h, oldest, func(b historyBucket, idx int64) int { return cmp.Compare(b.Index, idx) })
+		if i == len(h) {
+			delete(f.series, k)
+			continue
+		}
+		f.series[k] = h[i:]
+	}
+	var data []byte
+	if f.cfg.StateFile != "" && idx > f.lastSaved {
+		f.lastSaved = idx
+		st := forecastState{Resolution: f.cfg.Resolution}
+		for _, k := range sortedSeriesKeys(f.series) {
+			st.Series = append(st.Series, seriesState{k, f.series[k]})
+		}
+		data, _ = json.Marshal(st)
+	}
+	f.mu.Unlock()
+	if data != nil {
+		f.save(data)
+	}
+}
+
+func sortedSeriesKeys(m map[seriesKey][]historyBucket) []seriesKey {
+	keys := make([]seriesKey, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	slices.SortFunc(keys, func(a, b seriesKey) int {
+		return cmp.Or(cmp.Compare(a.Target, b.Target), cmp.Compare(a.Subnet, b.Subnet), cmp.Compare(a.Pool, b.Pool))
+	})
+	return keys
+}
+
+// forecast is the outcome of forecasting one subnet or pool.
+type forecast struct {
+	// Exhaustion is the time in seconds until the assigned addresses are
+	// expected to reach the total, +Inf if not within maxExhaustion.
+	Exhaustion float64
+	// Utilization is the expected utilization at each forecastHorizons.
+	Utilization []float64
+}
+
+// forecast forecasts k at t, given its current assigned and total
+// addresses. It returns false if the history is too short.
+func (f *forecaster) forecast(k seriesKey, t time.Time, assigned, total float64) (forecast, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	h := f.series[k]
+	if total <= 0 || len(h) == 0 || time.Duration(h[len(h)-1].Index-h[0].Index)*f.cfg.Resolution < f.cfg.MinHistory {
+		return forecast{}, false
+	}
+	perDay := int64(24 * time.Hour / f.cfg.Resolution)
+	m, ok := fitTrend(h, perDay)
+	if !ok {
+		return forecast{}, false
+	}
+	fc := forecast{Exhaustion: math.Inf(1)}
+	for _, hz := range forecastHorizons {
+		fc.Utilization = append(fc.Utilization, max(m.predict(f.index(t.Add(hz.d))), 0)/total)
+	}
+	if assigned >= total {
+		fc.Exhaustion = 0
+		return fc, true
+	}
+	if idx, ok := m.exhaustion(f.index(t)+1, total, int64(maxExhaustion/f.cfg.Resolution)); ok {
+		fc.Exhaustion = max(time.Unix(0, idx*int64(f.cfg.Resolution)).Sub(t).Seconds(), 0)
+	}
+	return fc, true
+}
+
+// trendModel is a linear trend with daily seasonality: the value of bucket
+// index x is level + slope*(x-origin) + seasonal[x mod len(seasonal)].
+type trendModel struct {
+	origin   int64
+	level    float64
+	slope    float64
+	seasonal []float64
+}
+
+// fitTrend fits a trendModel to the bucket means, with perDay buckets per
+// day. The slope is the median of the daily changes, which leaves out the
+// seasonality, and level and seasonality are medians of what remains, so
+// outliers have little effect. It returns false if no two buckets are a day
+// apart.
+func fitTrend(h []historyBucket, perDay int64) (trendModel, bool) {
+	means := make(map[int64]float64, len(h))
+	for _, b := range h {
+		means[b.Index] = b.mean()
+	}
+	var slopes []float64
+	for _, b := range h {
+		if later, ok := means[b.Index+perDay]; ok {
+			slopes = append(slopes, (later-b.mean())/float64(perDay))
+		}
+	}
+	if len(slopes) == 0 {
+		return trendModel{}, false
+	}
+	m := trendModel{origin: h[len(h)-1].Index, slope: median(slopes), seasonal: make([]float64, perDay)}
+	residuals := make([]float64, len(h))
+	for i, b := range h {
+		residuals[i] = b.mean() - m.slope*float64(b.Index-m.origin)
+	}
+	bySlot := make([][]float64, perDay)
+	for i, b := range h {
+		s := m.slot(b.Index)
+		bySlot[s] = append(bySlot[s], residuals[i])
+	}
+	m.level = median(residuals)
+	for s, r := range bySlot {
+		if len(r) > 0 {
+			m.seasonal[s] = median(r) - m.level
+		}
+	}
+	return m, true
+}
+
+func (m trendModel) slot(x int64) int64 {
+	n := int64(len(m.seasonal))
+	return (x%n + n) % n
+}
+
+func (m trendModel) predict(x int64) float64 {
+	return m.level + m.slope*float64(x-m.origin) + m.seasonal[m.slot(x)]
+}
+
+// exhaustion returns the first bucket index from x on, and less than limit
+// buckets after it, whose prediction reaches total.
+func (m trendModel) exhaustion(x int64, total float64, limit int64) (int64, bool) {
+	n := int64(len(m.seasonal))
+	best, found := x+limit, false
+	for s := range n {
+		// The first bucket of slot s from x on, and the one where the
+		// trend has risen enough for it.
+		first := x + (s-m.slot(x)+n)%n
+		if m.predict(first) < total {
+			if m.slope <= 0 {
+				continue
+			}
+			need := (total-m.level-m.seasonal[s])/m.slope + float64(m.origin)
+			if need >= float64(best) {
+				continue
+			}
+			first += (int64(math.Ceil(need)) - first + n - 1) / n * n
+		}
+		if first < best {
+			best, found = first, true
+		}
+	}
+	return best, found
+}
+
+// median returns the median of v, which it sorts.
+func median(v []float64) float64 {
+	slices.Sort(v)
+	if len(v)%2 == 1 {
+		return v[len(v)/2]
+	}
+	return (v[len(v)/2-1] + v[len(v)/2]) / 2
+}
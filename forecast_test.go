@@ -0,0 +1,223 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// dailyHistory returns hourly buckets of days days up to the bucket of end,
+// growing by slope addresses per hour with a daily swing of amplitude.
+// Every 17th bucket is an outlier.
+func dailyHistory(end int64, days int, base, slope, amplitude float64) []historyBucket {
+	var h []historyBucket
+	for i := end - int64(days*24); i <= end; i++ {
+		v := base + slope*float64(i-end) + amplitude*math.Sin(2*math.Pi*float64(i%24)/24)
+		if i%17 == 0 {
+			v *= 3
+		}
+		h = append(h, historyBucket{Index: i, Sum: 2 * v, Count: 2})
+	}
+	return h
+}
+
+func TestFitTrend(t *testing.T) {
+	end := int64(480000)
+	m, ok := fitTrend(dailyHistory(end, 7, 1000, 2, 50), 24)
+	if !ok {
+		t.Fatal("fitTrend() failed")
+	}
+	if math.Abs(m.slope-2) > 0.01 {
+		t.Errorf("slope = %g, want 2", m.slope)
+	}
+	for _, x := range []int64{end + 1, end + 6, end + 24, end + 24*7} {
+		want := 1000 + 2*float64(x-end) + 50*math.Sin(2*math.Pi*float64(x%24)/24)
+		if got := m.predict(x); math.Abs(got-want) > 5 {
+			t.Errorf("predict(end+%d) = %g, want %g", x-end, got, want)
+		}
+	}
+
+	if _, ok := fitTrend(dailyHistory(end, 0, 1000, 2, 50), 24); ok {
+		t.Error("fitTrend() of less than a day succeeded")
+	}
+}
+
+func TestForecast(t *testing.T) {
+	f := newForecaster()
+	f.configure(ForecastConfig{Enabled: true, Resolution: time.Hour, Window: 14 * 24 * time.Hour, MinHistory: 48 * time.Hour})
+	now := time.Unix(480000*3600, 0)
+	end := f.index(now)
+	k := seriesKey{"dhcp1", 1, -1}
+	// 1000 addresses in use, growing by 2 an hour: 500 hours to 2000, but
+	// the daily swing reaches it at 3 o'clock after 483 hours.
+	f.series[k] = dailyHistory(end, 7, 1000, 2, 50)
+	fc, ok := f.forecast(k, now, 1000, 2000)
+	if !ok {
+		t.Fatal("forecast() failed")
+	}
+	if h := fc.Exhaustion / 3600; h < 482 || h > 484 {
+		t.Errorf("exhaustion in %g hours, want about 483", h)
+	}
+	if u := fc.Utilization[0]; math.Abs(u-1048.0/2000) > 0.01 {
+		t.Errorf("utilization in 24h = %g, want about 0.524", u)
+	}
+	if u := fc.Utilization[1]; math.Abs(u-1336.0/2000) > 0.01 {
+		t.Errorf("utilization in 7d = %g, want about 0.668", u)
+	}
+
+	if fc, _ := f.forecast(k, now, 2000, 2000); fc.Exhaustion != 0 {
+		t.Errorf("exhaustion of a full subnet in %gs, want 0", fc.Exhaustion)
+	}
+	f.series[k] = dailyHistory(end, 7, 1000, -1, 50)
+	if fc, _ := f.forecast(k, now, 1000, 2000); !math.IsInf(fc.Exhaustion, 1) {
+		t.Errorf("exhaustion of a shrinking subnet in %gs, want +Inf", fc.Exhaustion)
+	}
+	f.series[k] = dailyHistory(end, 1, 1000, 2, 50)
+	if _, ok := f.forecast(k, now, 1000, 2000); ok {
+		t.Error("forecast() with less than min_history succeeded")
+	}
+}
+
+func TestForecasterState(t *testing.T) {
+	cfg := ForecastConfig{Enabled: true, Resolution: time.Hour, Window: 48 * time.Hour, MinHistory: 24 * time.Hour, StateFile: filepath.Join(t.TempDir(), "forecast.json")}
+	f := newForecaster()
+	f.configure(cfg)
+	start := time.Unix(480000*3600, 0)
+	for i := range 72 {
+		m := &KeaCookedMetrics{SubnetMetrics: map[uint64]KeaSubnetMetrics{
+			1: {AssignedAddresses: float64(i), PoolMetrics: map[uint64]KeaPoolMetrics{0: {AssignedAddresses: float64(i)}}},
+		}}
+		f.observe("dhcp1", start.Add(time.Duration(i)*time.Hour), m)
+	}
+	// Only the window is kept.
+	if got := len(f.series[seriesKey{"dhcp1", 1, 0}]); got != 49 {
+		t.Errorf("pool has %d buckets, want 49", got)
+	}
+
+	g := newForecaster()
+	g.configure(cfg)
+	for k, h := range f.series {
+		if got := g.series[k]; len(got) != len(h) || got[len(got)-1] != h[len(h)-1] {
+			t.Errorf("loaded history of %v has %d buckets ending in %v, want %d ending in %v", k, len(got), got[len(got)-1], len(h), h[len(h)-1])
+		}
+	}
+
+	cfg.Resolution = 30 * time.Minute
+	g = newForecaster()
+	g.configure(cfg)
+	if len(g.series) != 0 {
+		t.Errorf("history of another resolution was loaded")
+	}
+}
+
+func TestMetricsForecast(t *testing.T) {
+	kea := newFixtureServer(t, "kea-2.6")
+	cfg := defaultConfig()
+	cfg.Targets = []TargetConfig{{Name: "dhcp1", Socket: kea.SocketPath, Timeout: time.Second}}
+	cfg.Forecast.Enabled = true
+	if err := cfg.validate(); err != nil {
+		t.Fatal(err)
+	}
+	currentCfg.Store(cfg)
+	kc := &collectorSet{}
+	kc.update(cfg)
+	srv := httptest.NewServer(newMux(kc, &reloader{collectors: kc}))
+	t.Cleanup(srv.Close)
+
+	if got := scrapeKeaMetrics(t, srv.URL); strings.Contains(got, "forecast") {
+		t.Errorf("forecasts without history:\n%s", got)
+	}
+	// Three days of subnet 1 at 10 addresses.
+	end := kc.forecaster.index(time.Now())
+	k := seriesKey{"dhcp1", 1, -1}
+	kc.forecaster.series[k] = dailyHistory(end, 3, 10, 0, 0)
+	got := scrapeKeaMetrics(t, srv.URL)
+	for _, want := range []string{
+		`kea_subnet_forecast_utilization{horizon="24h",subnet="192.0.2.0/24",subnetidx="1"} `,
+		`kea_subnet_forecast_utilization{horizon="7d",subnet="192.0.2.0/24",subnetidx="1"} `,
+		`kea_subnet_predicted_exhaustion_seconds{subnet="192.0.2.0/24",subnetidx="1"} +Inf`,
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("/metrics has no line starting with %s", want)
+		}
+	}
+	if strings.Contains(got, `subnetidx="2"} +Inf`) {
+		t.Error("/metrics has a forecast of subnet 2, which has no history")
+	}
+}
+
+func TestForecastObservesCollections(t *testing.T) {
+	kea := newFixtureServer(t, "kea-2.6")
+	cfg := defaultConfig()
+	cfg.Targets = []TargetConfig{{Name: "dhcp1", Socket: kea.SocketPath, Timeout: time.Second}}
+	cfg.Forecast.Enabled = true
+	if err := cfg.validate(); err != nil {
+		t.Fatal(err)
+	}
+	currentCfg.Store(cfg)
+	kc := &collectorSet{}
+	kc.update(cfg)
+	srv := httptest.NewServer(newMux(kc, &reloader{collectors: kc}))
+	t.Cleanup(srv.Close)
+
+	// The API queries Kea, but does not add to the history.
+	resp, err := http.Get(srv.URL + "/api/v1/summary")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if n := kea.Requests(statsCommand); n != 1 {
+		t.Fatalf("Kea got %d %s requests from the API, want 1", n, statsCommand)
+	}
+	if n := len(kc.forecaster.series); n != 0 {
+		t.Errorf("history has %d series after an API request, want none", n)
+	}
+	scrapeKeaMetrics(t, srv.URL)
+	if h := kc.forecaster.series[seriesKey{"dhcp1", 1, -1}]; len(h) != 1 || h[0].Count != 1 {
+		t.Errorf("history of subnet 1 after a scrape is %+v, want one sample", h)
+	}
+}
+
+func TestForecastConcurrentGatherers(t *testing.T) {
+	kea := newFixtureServer(t, "kea-2.6")
+	cfg := defaultConfig()
+	cfg.Targets = []TargetConfig{{Name: "dhcp1", Socket: kea.SocketPath, Timeout: time.Second}}
+	cfg.Forecast.Enabled = true
+	if err := cfg.validate(); err != nil {
+		t.Fatal(err)
+	}
+	currentCfg.Store(cfg)
+	kc := &collectorSet{}
+	kc.update(cfg)
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(kc)
+
+	// Serving and pushing at once, or two Prometheus servers, within one
+	// observe interval count once.
+	var wg sync.WaitGroup
+	for range 2 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 5 {
+				if _, err := reg.Gather(); err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if n := kea.Requests(statsCommand); n != 10 {
+		t.Fatalf("Kea got %d %s requests, want 10", n, statsCommand)
+	}
+	if h := kc.forecaster.series[seriesKey{"dhcp1", 1, -1}]; len(h) != 1 || h[0].Count != 1 {
+		t.Errorf("history of subnet 1 after ten gathers is %+v, want one sample", h)
+	}
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+)
+
+// grafanaDashboard and the types below hold the parts of the Grafana
+// dashboard JSON model that the generated dashboard uses.
+type grafanaDashboard struct {
+	UID           string            `json:"uid"`
+	Title         string            `json:"title"`
+	Tags          []string          `json:"tags"`
+	Timezone      string            `json:"timezone"`
+	SchemaVersion int               `json:"schemaVersion"`
+	Refresh       string            `json:"refresh"`
+	Time          grafanaTimeRange  `json:"time"`
+	Templating    grafanaTemplating `json:"templating"`
+	Panels        []grafanaPanel    `json:"panels"`
+}
+
+type grafanaTimeRange struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+type grafanaTemplating struct {
+	List []grafanaVariable `json:"list"`
+}
+
+type grafanaVariable struct {
+	Name       string             `json:"name"`
+	Label      string             `json:"label"`
+	Type       string             `json:"type"`
+	Query      any                `json:"query"`
+	Datasource *grafanaDatasource `json:"datasource,omitempty"`
+	Refresh    int                `json:"refresh,omitempty"`
+	Multi      bool               `json:"multi,omitempty"`
+	IncludeAll bool               `json:"includeAll,omitempty"`
+	AllValue   string             `json:"allValue,omitempty"`
+	Sort       int                `json:"sort,omitempty"`
+}
+
+type grafanaDatasource struct {
+	Type string `json:"type"`
+	UID  string `json:"uid"`
+}
+
+type grafanaPanel struct {
+	ID          int                `json:"id"`
+	Type        string             `json:"type"`
+	Title       string             `json:"title"`
+	Description string             `json:"description,omitempty"`
+	GridPos     grafanaGridPos     `json:"gridPos"`
+	Datasource  *grafanaDatasource `json:"datasource,omitempty"`
+	FieldConfig *grafanaFieldCfg   `json:"fieldConfig,omitempty"`
+	Targets     []grafanaTarget    `json:"targets,omitempty"`
+	Collapsed   bool               `json:"collapsed,omitempty"`
+}
+
+type grafanaGridPos struct {
+	H int `json:"h"`
+	W int `json:"w"`
+	X int `json:"x"`
+	Y int `json:"y"`
+}
+
+type grafanaFieldCfg struct {
+	Defaults grafanaFieldDefaults `json:"defaults"`
+}
+
+type grafanaFieldDefaults struct {
+	Unit       string             `json:"unit,omitempty"`
+	Min        *float64           `json:"min,omitempty"`
+	Max        *float64           `json:"max,omitempty"`
+	Thresholds *grafanaThresholds `json:"thresholds,omitempty"`
+}
+
+type grafanaThresholds struct {
+	Mode  string                  `json:"mode"`
+	Steps []grafanaThresholdsStep `json:"steps"`
+}
+
+type grafanaThresholdsStep struct {
+	Color string   `json:"color"`
+	Value *float64 `json:"value"`
+}
+
+type grafanaTarget struct {
+	RefID        string `json:"refId"`
+	Expr         string `json:"expr"`
+	LegendFormat string `json:"legendFormat,omitempty"`
+	Instant      bool   `json:"instant,omitempty"`
+}
+
+// runGrafanaDashboard prints a Grafana dashboard for the metrics to stdout.
+func runGrafanaDashboard(cfg *Config) int {
+	if err := writeGrafanaDashboard(cfg, os.Stdout); err != nil {
+		logger.Error("Could not write dashboard", "error", err)
+		return 1
+	}
+	return 0
+}
+
+func writeGrafanaDashboard(cfg *Config, w io.Writer) error {
+	b, err := json.MarshalIndent(grafanaDashboardFor(cfg), "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "%s\n", b)
+	return err
+}
+
+// grafanaDashboardFor returns a dashboard for the metrics of the Kea
+// collectors in cfg's namespace. The $instance, $target, $daemon and $subnet
+// variables select what is shown; the utilization thresholds color the
+// utilization panels.
+func grafanaDashboardFor(cfg *Config) grafanaDashboard {
+	ns := cfg.Namespace
+	ds := &grafanaDatasource{Type: "prometheus", UID: "${datasource}"}
+	// The target and daemon labels only exist with several targets and
+	// behind a Control Agent; "All" also matches their absence.
+	sel := `instance=~"$instance",target=~"$target",daemon=~"$daemon"`
+	subnetSel := sel + `,subnet=~"$subnet"`
+	zero, one := 0.0, 1.0
+	warning, critical := cfg.Thresholds.UtilizationWarning, cfg.Thresholds.UtilizationCritical
+	utilizationCfg := &grafanaFieldCfg{Defaults: grafanaFieldDefaults{
+		Unit: "percentunit",
+		Min:  &zero,
+		Max:  &one,
+		Thresholds: &grafanaThresholds{Mode: "absolute", Steps: []grafanaThresholdsStep{
+			{Color: "green"}, {Color: "orange", Value: &warning}, {Color: "red", Value: &critical},
+		}},
+	}}
+	rateCfg := &grafanaFieldCfg{Defaults: grafanaFieldDefaults{Unit: "pps"}}
+	countCfg := &grafanaFieldCfg{Defaults: grafanaFieldDefaults{Unit: "short"}}
+
+	var panels []grafanaPanel
+	y := 0
+	row := func(title string) {
+		panels = append(panels, grafanaPanel{Type: "row", Title: title, GridPos: grafanaGridPos{H: 1, W: 24, Y: y}})
+		y++
+	}
+	// panel adds a panel of half the width, starting a new line on the left.
+	x := 0
+	panel := func(typ, title string, fc *grafanaFieldCfg, targets ...grafanaTarget) {
+		for i := range targets {
+			targets[i].RefID = string(rune('A' + i))
+		}
+		panels = append(panels, grafanaPanel{
+			Type: typ, Title: title, Datasource: ds, FieldConfig: fc, Targets: targets,
+			GridPos: grafanaGridPos{H: 8, W: 12, X: x, Y: y},
+		})
+		if x == 0 {
+			x = 12
+		} else {
+			x, y = 0, y+8
+		}
+	}
+	endRow := func() {
+		if x != 0 {
+			x, y = 0, y+8
+		}
+	}
+	rate := func(metric, selector string) string {
+		return fmt.Sprintf("rate(%s_%s{%s}[$__rate_interval])", ns, metric, selector)
+	}
+
+	row("Packets")
+	panel("timeseries", "Packets received by type", rateCfg,
+		grafanaTarget{Expr: "sum by (pkttype) (" + rate("v4_packet_types_received_total", sel) + ")", LegendFormat: "{{pkttype}}"})
+	panel("timeseries", "Packets sent by type", rateCfg,
+		grafanaTarget{Expr: "sum by (pkttype) (" + rate("v4_packet_types_sent_total", sel) + ")", LegendFormat: "{{pkttype}}"})
+	panel("timeseries", "Packets received, sent and dropped", rateCfg,
+		grafanaTarget{Expr: "sum(" + rate("v4_packets_received_total", sel) + ")", LegendFormat: "received"},
+		grafanaTarget{Expr: "sum(" + rate("v4_packets_sent_total", sel) + ")", LegendFormat: "sent"},
+		grafanaTarget{Expr: "sum(" + rate("v4_packets_dropped_on_receive_total", sel) + ")", LegendFormat: "dropped"},
+		grafanaTarget{Expr: "sum(" + rate("v4_packets_parse_failed_total", sel) + ")", LegendFormat: "parse failed"})
+	panel("timeseries", "Allocation failures", rateCfg,
+		grafanaTarget{Expr: "sum(" + rate("v4_allocation_failures_total", sel) + ")", LegendFormat: "all"},
+		grafanaTarget{Expr: "sum(" + rate("v4_allocation_failures_classes_total", sel) + ")", LegendFormat: "classes"},
+		grafanaTarget{Expr: "sum(" + rate("v4_allocation_failures_no_pools_total", sel) + ")", LegendFormat: "no pools"},
+		grafanaTarget{Expr: "sum(" + rate("v4_allocation_failures_shared_network_total", sel) + ")", LegendFormat: "shared network"},
+		grafanaTarget{Expr: "sum(" + rate("v4_allocation_failures_subnet_total", sel) + ")", LegendFormat: "subnet"})
+	endRow()
+
+	row("Utilization")
+	subnetUtilization := fmt.Sprintf("%[1]s_subnet_assigned_addresses{%[2]s} / (%[1]s_subnet_addresses{%[2]s} > 0)", ns, subnetSel)
+	panel("bargauge", "Subnet utilization", utilizationCfg,
+		grafanaTarget{Expr: subnetUtilization, LegendFormat: "{{subnet}}", Instant: true})
+	panel("timeseries", "Subnet utilization over time", utilizationCfg,
+		grafanaTarget{Expr: subnetUtilization, LegendFormat: "{{subnet}}"})
+	panel("timeseries", "Pool utilization", utilizationCfg,
+		grafanaTarget{Expr: fmt.Sprintf("%[1]s_subnet_pool_assigned_addresses{%[2]s} / (%[1]s_subnet_pool_addresses{%[2]s} > 0)", ns, subnetSel), LegendFormat: "{{subnet}} pool {{poolidx}}"})
+	panel("timeseries", "Assigned addresses", countCfg,
+		grafanaTarget{Expr: fmt.Sprintf("%s_subnet_assigned_addresses{%s}", ns, subnetSel), LegendFormat: "{{subnet}} assigned"},
+		grafanaTarget{Expr: fmt.Sprintf("%s_subnet_addresses{%s}", ns, subnetSel), LegendFormat: "{{subnet}} total"})
+	endRow()
+
+	row("Declined and reclaimed")
+	panel("timeseries", "Declined addresses", rateCfg,
+		grafanaTarget{Expr: rate("subnet_declined_addresses_total", subnetSel), LegendFormat: "{{subnet}}"},
+		grafanaTarget{Expr: rate("subnet_pool_addresses_declined_total", subnetSel), LegendFormat: "{{subnet}} pool {{poolidx}}"})
+	panel("timeseries", "Reclaimed leases", rateCfg,
+		grafanaTarget{Expr: rate("subnet_reclaimed_leases_total", subnetSel), LegendFormat: "{{subnet}} leases"},
+		grafanaTarget{Expr: rate("reclaimed_declined_addresses_total", sel), LegendFormat: "declined addresses"})
+	panel("timeseries", "Kea up", countCfg,
+		grafanaTarget{Expr: fmt.Sprintf("%s_up{%s}", ns, sel), LegendFormat: "{{instance}} {{target}} {{daemon}}"})
+	endRow()
+
+	for i := range panels {
+		panels[i].ID = i + 1
+	}
+
+	return grafanaDashboard{
+		UID:           "gkse-" + ns,
+		Title:         "Kea DHCPv4",
+		Tags:          []string{"kea", "dhcp", "gkse"},
+		Timezone:      "browser",
+		SchemaVersion: 39,
+		Refresh:       "1m",
+		Time:          grafanaTimeRange{From: "now-24h", To: "now"},
+		Templating: grafanaTemplating{List: []grafanaVariable{
+			{Name: "datasource", Label: "Data source", Type: "datasource", Query: "prometheus"},
+			{
+				Name: "instance", Label: "Instance", Type: "query", Datasource: ds, Refresh: 2, Multi: true, IncludeAll: true, Sort: 1,
+				Query: fmt.Sprintf("label_values(%s_up, instance)", ns),
+			},
+			{
+				Name: "target", Label: "Target", Type: "query", Datasource: ds, Refresh: 2, Multi: true, IncludeAll: true, AllValue: ".*", Sort: 1,
+				Query: fmt.Sprintf(`label_values(%s_up{instance=~"$instance"}, target)`, ns),
+			},
+			{
+				Name: "daemon", Label: "Daemon", Type: "query", Datasource: ds, Refresh: 2, Multi: true, IncludeAll: true, AllValue: ".*", Sort: 1,
+				Query: fmt.Sprintf(`label_values(%s_up{instance=~"$instance",target=~"$target"}, daemon)`, ns),
+			},
+			{
+				Name: "subnet", Label: "Subnet", Type: "query", Datasource: ds, Refresh: 2, Multi: true, IncludeAll: true, Sort: 1,
+				Query: fmt.Sprintf(`label_values(%s_subnet_addresses{%s}, subnet)`, ns, sel),
+			},
+		}},
+		Panels: panels,
+	}
+}
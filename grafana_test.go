@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+// TestGrafanaDashboardMetrics checks that every metric the dashboard refers
+// to is exported by the collector.
+func TestGrafanaDashboardMetrics(t *testing.T) {
+	cfg := fixtureConfig("kea-2.6")
+	cfg.Namespace = "dhcp"
+	var b strings.Builder
+	if err := writeGrafanaDashboard(cfg, &b); err != nil {
+		t.Fatal(err)
+	}
+	var d grafanaDashboard
+	if err := json.Unmarshal([]byte(b.String()), &d); err != nil {
+		t.Fatalf("dashboard is not valid JSON: %v", err)
+	}
+	names := keaMetricNames(t, cfg)
+	var exprs []string
+	for _, p := range d.Panels {
+		for _, tg := range p.Targets {
+			exprs = append(exprs, tg.Expr)
+		}
+	}
+	for _, v := range d.Templating.List {
+		if q, ok := v.Query.(string); ok {
+			exprs = append(exprs, q)
+		}
+	}
+	referenced := 0
+	for _, expr := range exprs {
+		if strings.Contains(expr, "kea_") {
+			t.Errorf("%q does not use the namespace", expr)
+		}
+		for _, m := range referencedMetrics("dhcp", expr) {
+			referenced++
+			if !names[m] {
+				t.Errorf("dashboard refers to %s, which the collector does not export", m)
+			}
+		}
+	}
+	if referenced < 20 {
+		t.Errorf("dashboard refers to only %d metrics", referenced)
+	}
+	for _, p := range d.Panels {
+		for _, tg := range p.Targets {
+			if !strings.Contains(tg.Expr, `target=~"$target",daemon=~"$daemon"`) {
+				t.Errorf("panel %q query %s does not select the target and daemon", p.Title, tg.Expr)
+			}
+			if strings.Contains(tg.Expr, "_total{") && !strings.Contains(tg.Expr, "rate(") {
+				t.Errorf("panel %q shows the counter in %s instead of its rate", p.Title, tg.Expr)
+			}
+		}
+	}
+	ids := make(map[int]bool)
+	for _, p := range d.Panels {
+		if ids[p.ID] {
+			t.Errorf("panel ID %d is used more than once", p.ID)
+		}
+		ids[p.ID] = true
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+var graphiteAddress = flag.String("push.graphite.address", "", "if nonempty, send metrics in the Graphite plaintext protocol to this host:port, e.g. localhost:2003")
+
+// GraphiteConfig configures sending to a Graphite (carbon) plaintext
+// listener over TCP. Each point is sent as one metric per statistic; Paths
+// name them.
+type GraphiteConfig struct {
+	Address string        `yaml:"address"`
+	Timeout time.Duration `yaml:"timeout"`
+	Paths   NameTemplates `yaml:"paths"`
+}
+
+// graphiteUnsafe matches what may not appear in a path component; the
+// subnet prefix 192.0.2.0/24, for instance, becomes 192_0_2_0_24.
+var graphiteUnsafe = regexp.MustCompile(`[^A-Za-z0-9_-]`)
+
+// graphiteWriter writes snapshots as Graphite plaintext metrics.
+type graphiteWriter struct {
+	cfg     GraphiteConfig
+	enabled CollectorsConfig
+	paths   nameTemplates
+}
+
+func newGraphiteWriter(cfg GraphiteConfig, enabled CollectorsConfig) (*graphiteWriter, error) {
+	p, err := parseNameTemplates("push.graphite.paths", cfg.Paths)
+	if err != nil {
+		return nil, err
+	}
+	return &graphiteWriter{cfg: cfg, enabled: enabled, paths: p}, nil
+}
+
+// lines returns one "path value timestamp" line per statistic. The values
+// the templates can refer to are made safe for use in a path first.
+func (gw *graphiteWriter) lines(snaps []*keaSnapshot) ([]string, error) {
+	var lines []string
+	for _, s := range snaps {
+		ts := strconv.FormatInt(s.Time.Unix(), 10)
+		for _, p := range s.points(gw.enabled) {
+			name := p.Name
+			name.Target = graphiteUnsafe.ReplaceAllString(name.Target, "_")
+			name.Prefix = graphiteUnsafe.ReplaceAllString(name.Prefix, "_")
+			name.Labels = make(map[string]string, len(p.Name.Labels))
+			for k, v := range p.Name.Labels {
+				name.Labels[k] = graphiteUnsafe.ReplaceAllString(v, "_")
+			}
+			for _, f := range p.Fields {
+				name.Metric = f.Name
+				path, err := gw.paths.execute(p.Kind, name)
+				if err != nil {
+					return nil, fmt.Errorf("could not execute %s path template: %w", p.Kind, err)
+				}
+				lines = append(lines, path+" "+strconv.FormatFloat(f.Value, 'g', -1, 64)+" "+ts+"\n")
+			}
+		}
+	}
+	return lines, nil
+}
+
+func (gw *graphiteWriter) write(ctx context.Context, snaps []*keaSnapshot) error {
+	lines, err := gw.lines(snaps)
+	if err != nil || len(lines) == 0 {
+		return err
+	}
+	d := net.Dialer{Timeout: gw.cfg.Timeout}
+	conn, err := d.DialContext(ctx, "tcp", gw.cfg.Address)
+	if err != nil {
+		return fmt.Errorf("could not connect: %w", err)
+	}
+	defer conn.Close()
+	if err := conn.SetWriteDeadline(time.Now().Add(gw.cfg.Timeout)); err != nil {
+		return err
+	}
+	w := bufio.NewWriter(conn)
+	for _, l := range lines {
+		if _, err := w.WriteString(l); err != nil {
+			return err
+		}
+	}
+	return w.Flush()
+}
+
+func (cfg GraphiteConfig) validate() error {
+	if cfg.Address == "" {
+		return nil
+	}
+	var errs []error
+	if _, _, err := net.SplitHostPort(cfg.Address); err != nil {
+		errs = append(errs, fmt.Errorf("push.graphite.address: %w", err))
+	}
+	if cfg.Timeout <= 0 {
+		errs = append(errs, fmt.Errorf("push.graphite.timeout: must be positive, got %s", cfg.Timeout))
+	}
+	if _, err := parseNameTemplates("push.graphite.paths", cfg.Paths); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
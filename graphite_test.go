@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestGraphite(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	received := make(chan string)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			b, _ := io.ReadAll(conn)
+			conn.Close()
+			received <- string(b)
+		}
+	}()
+
+	cfg := fixtureConfig("kea-2.6", "kea-2.4")
+	cfg.Targets[1].StatsFile = filepath.Join(t.TempDir(), "missing.json")
+	cfg.Push.Graphite.Address = ln.Addr().String()
+	kc := &collectorSet{}
+	kc.update(cfg)
+	gw, err := newGraphiteWriter(cfg.Push.Graphite, cfg.Collectors)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := &pushDestinations{graphite: gw, kc: kc}
+	reg := newPushRegistry(kc)
+	pushOnce(context.Background(), reg, d)
+
+	got := <-received
+	for _, want := range []string{
+		"kea.kea-2_6.pkt4_ack_received ",
+		"kea.kea-2_6.subnet.192_0_2_0_24.total_addresses 191 ",
+		"kea.kea-2_6.subnet.192_0_2_0_24.pool.0.assigned_addresses 31 ",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("sent metrics do not contain %q", want)
+		}
+	}
+	if strings.Contains(got, "kea-2_4") {
+		t.Errorf("sent metrics of the failing target")
+	}
+
+	// Once the other target fails too, its old snapshot is not sent again.
+	for _, c := range *kc.collectors.Load() {
+		c.target.StatsFile = cfg.Targets[1].StatsFile
+	}
+	pushOnce(context.Background(), reg, d)
+	select {
+	case got := <-received:
+		t.Errorf("sent %q without a fresh snapshot", got)
+	default:
+	}
+}
+
+func TestGraphiteValidate(t *testing.T) {
+	cfg := defaultPushConfig().Graphite
+	cfg.Address = "graphite"
+	cfg.Paths.Pool = "kea.{{.Pool"
+	err := cfg.validate()
+	if err == nil {
+		t.Fatal("validate accepted an invalid configuration")
+	}
+	for _, want := range []string{"push.graphite.address", "push.graphite.paths.pool"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q does not mention %s", err, want)
+		}
+	}
+
+	// Template errors come in the order of the settings.
+	cfg.Paths.Global = ""
+	want := "push.graphite.paths.global: must not be empty\npush.graphite.paths.pool: "
+	for range 10 {
+		if _, err := parseNameTemplates("push.graphite.paths", cfg.Paths); err == nil || !strings.HasPrefix(err.Error(), want) {
+			t.Fatalf("parseNameTemplates() = %v, want an error starting with %q", err, want)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	_ "embed"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strings"
+	"time"
+)
+
+//go:embed assets/landing.html
+var landingHTML string
+
+var landingTmpl = template.Must(template.New("landing").Funcs(template.FuncMap{
+	"since": func(t time.Time) string { return time.Since(t).Truncate(time.Second).String() },
+}).Parse(landingHTML))
+
+// handleHealthz reports whether the process is alive. It never talks to Kea.
+func handleHealthz(w http.ResponseWriter, _ *http.Request) {
+	fmt.Fprintln(w, "OK")
+}
+
+// handleReadyz reports ready if the most recent query of every target
+// succeeded, and did so within health.ready_max_age.
+func handleReadyz(w http.ResponseWriter, _ *http.Request) {
+	cfg := currentConfig()
+	var b strings.Builder
+	ready := true
+	for _, t := range cfg.Targets {
+		ok, reason := targetReady(t.Name, cfg.Health.ReadyMaxAge)
+		if !ok {
+			ready = false
+			fmt.Fprintf(&b, "target %s: not ready: %s\n", t.Name, reason)
+		} else {
+			fmt.Fprintf(&b, "target %s: ok: %s\n", t.Name, reason)
+		}
+	}
+	if !ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	fmt.Fprint(w, b.String())
+}
+
+func targetReady(name string, maxAge time.Duration) (bool, string) {
+	ts, ok := scrapeStatus.get(name)
+	switch {
+	case !ok:
+		return false, "Kea has not been queried yet"
+	case ts.LastAttempt.Err != nil:
+		return false, fmt.Sprintf("last query %s ago failed: %s", time.Since(ts.LastAttempt.Time).Truncate(time.Second), ts.LastAttempt.Err)
+	case time.Since(ts.LastSuccess) > maxAge:
+		return false, fmt.Sprintf("last successful query was %s ago, more than %s", time.Since(ts.LastSuccess).Truncate(time.Second), maxAge)
+	}
+	return true, fmt.Sprintf("last query %s ago succeeded", time.Since(ts.LastSuccess).Truncate(time.Second))
+}
+
+type landingTarget struct {
+	TargetConfig
+	Status  targetStatus
+	Queried bool
+}
+
+func handleLanding(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	cfg := currentConfig()
+	data := struct {
+		Version string
+		Targets []landingTarget
+	}{Version: version}
+	for _, t := range cfg.Targets {
+		ts, ok := scrapeStatus.get(t.Name)
+		data.Targets = append(data.Targets, landingTarget{t, ts, ok})
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := landingTmpl.Execute(w, data); err != nil {
+		logger.Error("Could not render landing page", "error", err)
+	}
+}
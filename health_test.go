@@ -0,0 +1,133 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// healthConfig makes targets the configured targets, with readiness
+// requiring a successful query within maxAge.
+func healthConfig(maxAge time.Duration, targets ...string) {
+	cfg := defaultConfig()
+	cfg.Targets = nil
+	for _, name := range targets {
+		cfg.Targets = append(cfg.Targets, TargetConfig{Name: name, Socket: "/run/kea/" + name + ".sock"})
+	}
+	cfg.Health.ReadyMaxAge = maxAge
+	currentCfg.Store(cfg)
+}
+
+func serveRequest(h http.HandlerFunc, path string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	h(rec, httptest.NewRequest(http.MethodGet, path, nil))
+	return rec
+}
+
+func TestHealthz(t *testing.T) {
+	// Liveness does not depend on Kea.
+	healthConfig(time.Minute, "health-never")
+	rec := serveRequest(handleHealthz, "/healthz")
+	if rec.Code != http.StatusOK || rec.Body.String() != "OK\n" {
+		t.Errorf("/healthz = %d %q, want 200 OK", rec.Code, rec.Body.String())
+	}
+}
+
+func TestReadyz(t *testing.T) {
+	now := time.Now()
+	scrapeStatus.record("ready-ok", now, nil)
+	scrapeStatus.record("ready-failed", now, nil)
+	scrapeStatus.record("ready-failed", now, errors.New("connection refused"))
+	scrapeStatus.record("ready-old", now.Add(-10*time.Minute), nil)
+
+	for _, tc := range []struct {
+		name    string
+		targets []string
+		maxAge  time.Duration
+		code    int
+		want    []string
+	}{
+		{
+			name:    "ok",
+			targets: []string{"ready-ok"},
+			maxAge:  time.Minute,
+			code:    http.StatusOK,
+			want:    []string{"target ready-ok: ok: last query 0s ago succeeded\n"},
+		},
+		{
+			name:    "never queried",
+			targets: []string{"ready-ok", "ready-never"},
+			maxAge:  time.Minute,
+			code:    http.StatusServiceUnavailable,
+			want:    []string{"target ready-ok: ok: ", "target ready-never: not ready: Kea has not been queried yet\n"},
+		},
+		{
+			name:    "failed",
+			targets: []string{"ready-failed"},
+			maxAge:  time.Minute,
+			code:    http.StatusServiceUnavailable,
+			want:    []string{"target ready-failed: not ready: last query 0s ago failed: connection refused\n"},
+		},
+		{
+			name:    "older than ready_max_age",
+			targets: []string{"ready-old"},
+			maxAge:  5 * time.Minute,
+			code:    http.StatusServiceUnavailable,
+			want:    []string{"target ready-old: not ready: last successful query was 10m0s ago, more than 5m0s\n"},
+		},
+		{
+			name:    "within ready_max_age",
+			targets: []string{"ready-old"},
+			maxAge:  time.Hour,
+			code:    http.StatusOK,
+			want:    []string{"target ready-old: ok: last query 10m0s ago succeeded\n"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			healthConfig(tc.maxAge, tc.targets...)
+			rec := serveRequest(handleReadyz, "/readyz")
+			if rec.Code != tc.code {
+				t.Errorf("/readyz status %d, want %d", rec.Code, tc.code)
+			}
+			for _, want := range tc.want {
+				if !strings.Contains(rec.Body.String(), want) {
+					t.Errorf("/readyz body %q does not contain %q", rec.Body.String(), want)
+				}
+			}
+		})
+	}
+}
+
+func TestLanding(t *testing.T) {
+	scrapeStatus.record("landing-ok", time.Now(), nil)
+	scrapeStatus.record("landing-failed", time.Now(), errors.New("connection <refused>"))
+	healthConfig(time.Minute, "landing-ok", "landing-failed", "landing-never")
+
+	rec := serveRequest(handleLanding, "/")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("/ status %d, want 200", rec.Code)
+	}
+	if got := rec.Header().Get("Content-Type"); got != "text/html; charset=utf-8" {
+		t.Errorf("Content-Type = %q, want text/html", got)
+	}
+	body := rec.Body.String()
+	for _, want := range []string{
+		"<p>Version " + version + "</p>",
+		"<td>landing-ok</td>\n<td>unix:/run/kea/landing-ok.sock</td>",
+		`<td class="ok">ok</td>`,
+		// Errors are escaped.
+		`<td class="fail">failed: connection &lt;refused&gt;</td>`,
+		"<td>landing-never</td>\n<td>unix:/run/kea/landing-never.sock</td>\n\n<td>never</td>",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("landing page does not contain %q:\n%s", want, body)
+		}
+	}
+
+	if rec := serveRequest(handleLanding, "/nonexistent"); rec.Code != http.StatusNotFound {
+		t.Errorf("/nonexistent status %d, want 404", rec.Code)
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// IdentityConfig adds labels identifying the Kea server behind a target to
+// all of its metrics. The server label is the target's server setting, the
+// HA this-server-name, the server-tag or the target name, whichever is set
+// first, so HA partners and fleets get a consistent identity.
+type IdentityConfig struct {
+	Server       bool `yaml:"server"`
+	ServerTag    bool `yaml:"server_tag"`
+	HAServerName bool `yaml:"ha_server_name"`
+}
+
+// identityLabels are the labels IdentityConfig can add, in this order.
+var identityLabels = []string{"server", "server_tag", "ha_server_name"}
+
+// names returns the enabled identity labels.
+func (cfg IdentityConfig) names() []string {
+	var names []string
+	for i, on := range []bool{cfg.Server, cfg.ServerTag, cfg.HAServerName} {
+		if on {
+			names = append(names, identityLabels[i])
+		}
+	}
+	return names
+}
+
+// values returns the values of the enabled identity labels of t, whose
+// configuration is c. If c is nil, as when Kea has never been reached, only
+// the server label can have a value.
+func (cfg IdentityConfig) values(t TargetConfig, c *KeaConfig) []string {
+	var tag, ha string
+	if c != nil {
+		tag, ha = c.Dhcp4.ServerTag, c.Dhcp4.haServerName()
+	}
+	var values []string
+	if cfg.Server {
+		values = append(values, cmp.Or(t.Server, ha, tag, t.Name))
+	}
+	if cfg.ServerTag {
+		values = append(values, tag)
+	}
+	if cfg.HAServerName {
+		values = append(values, ha)
+	}
+	return values
+}
+
+// known reports whether the identity of t is known without its
+// configuration c, which is nil when Kea has never been reached. Only the
+// server label of a target with a server setting is.
+func (cfg IdentityConfig) known(t TargetConfig, c *KeaConfig) bool {
+	if c != nil {
+		return true
+	}
+	return !cfg.ServerTag && !cfg.HAServerName && (!cfg.Server || t.Server != "")
+}
+
+// HooksLibrary is a hook library loaded by Kea, with its parameters.
+type HooksLibrary struct {
+	Library    string          `json:"library"`
+	Parameters json.RawMessage `json:"parameters"`
+}
+
+// haServerName returns the this-server-name of the first relationship of the
+// high availability hook library, or "" if it is not loaded.
+func (d *Dhcp4) haServerName() string {
+	for _, lib := range d.HooksLibraries {
+		if !strings.Contains(lib.Library, "libdhcp_ha") {
+			continue
+		}
+		var params struct {
+			HA []struct {
+				ThisServerName string `json:"this-server-name"`
+			} `json:"high-availability"`
+		}
+		if json.Unmarshal(lib.Parameters, &params) == nil && len(params.HA) > 0 {
+			return params.HA[0].ThisServerName
+		}
+	}
+	return ""
+}
+
+// validate checks that the identity labels do not clash with static labels.
+func (cfg IdentityConfig) validate(labels map[string]string, targets []TargetConfig) []error {
+	var errs []error
+	for _, name := range cfg.names() {
+		if _, ok := labels[name]; ok {
+			errs = append(errs, fmt.Errorf("labels: '%s' is reserved when identity.%s is set", name, name))
+		}
+		for i, t := range targets {
+			if _, ok := t.Labels[name]; ok {
+				errs = append(errs, fmt.Errorf("targets[%d].labels: '%s' is reserved when identity.%s is set", i, name, name))
+			}
+		}
+	}
+	return errs
+}
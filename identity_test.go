@@ -0,0 +1,143 @@
+package main
+
+import (
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"pkg.i-no.de/pkg/gkse/keatest"
+)
+
+// identityTestConfig has a server-tag and the HA hook library.
+const identityTestConfig = `{"result": 0, "arguments": {"Dhcp4": {
+	"server-tag": "ams",
+	"hooks-libraries": [
+		{"library": "/usr/lib/kea/hooks/libdhcp_lease_cmds.so"},
+		{"library": "/usr/lib/kea/hooks/libdhcp_ha.so", "parameters": {"high-availability": [
+			{"this-server-name": "ams-1", "mode": "hot-standby"}]}}],
+	"subnet4": [{"id": 1, "subnet": "192.0.2.0/24", "pools": [{"pool": "192.0.2.10 - 192.0.2.100"}]}]}}}`
+
+func TestIdentityValues(t *testing.T) {
+	c, err := fromJSON([]byte(identityTestConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := c.Dhcp4.haServerName(); got != "ams-1" {
+		t.Errorf("haServerName() = %q, want ams-1", got)
+	}
+	all := IdentityConfig{Server: true, ServerTag: true, HAServerName: true}
+	for _, tc := range []struct {
+		target TargetConfig
+		config *KeaConfig
+		want   []string
+	}{
+		{TargetConfig{Name: "dhcp1"}, c, []string{"ams-1", "ams", "ams-1"}},
+		{TargetConfig{Name: "dhcp1", Server: "static"}, c, []string{"static", "ams", "ams-1"}},
+		{TargetConfig{Name: "dhcp1"}, &KeaConfig{Dhcp4: &Dhcp4{ServerTag: "ams"}}, []string{"ams", "ams", ""}},
+		{TargetConfig{Name: "dhcp1"}, nil, []string{"dhcp1", "", ""}},
+	} {
+		if got := all.values(tc.target, tc.config); !slices.Equal(got, tc.want) {
+			t.Errorf("values(%+v) = %q, want %q", tc.target, got, tc.want)
+		}
+	}
+	if got := (IdentityConfig{ServerTag: true}).values(TargetConfig{Name: "dhcp1"}, c); !slices.Equal(got, []string{"ams"}) {
+		t.Errorf("values() with only server_tag = %q, want [ams]", got)
+	}
+}
+
+func TestIdentityValidate(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Identity = IdentityConfig{Server: true}
+	cfg.Labels = map[string]string{"server": "x", "server_tag": "y"}
+	cfg.Targets = []TargetConfig{{Name: "dhcp1", Socket: "/run/kea.sock", Labels: map[string]string{"server": "z"}}}
+	err := cfg.validate()
+	if err == nil {
+		t.Fatal("validate() succeeded, want errors")
+	}
+	for _, want := range []string{
+		"labels: 'server' is reserved when identity.server is set",
+		"targets[0].labels: 'server' is reserved when identity.server is set",
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("validate() = %v, want an error containing %q", err, want)
+		}
+	}
+	if strings.Contains(err.Error(), "server_tag") {
+		t.Errorf("validate() = %v, but identity.server_tag is not set", err)
+	}
+}
+
+func TestMetricsIdentityLabels(t *testing.T) {
+	kea := keatest.NewServer(t)
+	kea.Handle(statsCommand, keatest.File(t, "testdata/kea-2.6/statistic-get-all.json"))
+	kea.Handle(configCommand, keatest.JSON(identityTestConfig))
+	cfg := defaultConfig()
+	cfg.Targets = []TargetConfig{{Name: "dhcp1", Socket: kea.SocketPath, Timeout: time.Second}}
+	cfg.Identity = IdentityConfig{Server: true, ServerTag: true}
+	if err := cfg.validate(); err != nil {
+		t.Fatal(err)
+	}
+	currentCfg.Store(cfg)
+	kc := &collectorSet{}
+	kc.update(cfg)
+	srv := httptest.NewServer(newMux(kc, &reloader{collectors: kc}))
+	t.Cleanup(srv.Close)
+
+	got := scrapeKeaMetrics(t, srv.URL)
+	for _, want := range []string{
+		`kea_up{server="ams-1",server_tag="ams"} 1`,
+		`kea_v4_packets_received_total{server="ams-1",server_tag="ams"} `,
+		`kea_subnet_addresses{server="ams-1",server_tag="ams",subnet="192.0.2.0/24",subnetidx="1"} `,
+		`kea_subnet_pool_addresses{poolidx="0",server="ams-1",server_tag="ams",subnet="192.0.2.0/24",subnetidx="1"} `,
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("/metrics has no line starting with %s", want)
+		}
+	}
+}
+
+func TestMetricsIdentityDownThenUp(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		identity IdentityConfig
+		server   string
+		down, up string
+	}{
+		{"from kea", IdentityConfig{Server: true, HAServerName: true}, "",
+			"", `kea_up{ha_server_name="ams-1",server="ams-1"} 1`},
+		{"from target", IdentityConfig{Server: true}, "dhcp-ams",
+			`kea_up{server="dhcp-ams"} 0`, `kea_up{server="dhcp-ams"} 1`},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			kea := keatest.NewServer(t)
+			kea.Handle(statsCommand, keatest.Response{Fault: keatest.Reset},
+				keatest.File(t, "testdata/kea-2.6/statistic-get-all.json"))
+			kea.Handle(configCommand, keatest.JSON(identityTestConfig))
+			cfg := defaultConfig()
+			cfg.Targets = []TargetConfig{{Name: "dhcp1", Server: tc.server, Socket: kea.SocketPath, Timeout: time.Second}}
+			cfg.Identity = tc.identity
+			if err := cfg.validate(); err != nil {
+				t.Fatal(err)
+			}
+			currentCfg.Store(cfg)
+			kc := &collectorSet{}
+			kc.update(cfg)
+			srv := httptest.NewServer(newMux(kc, &reloader{collectors: kc}))
+			t.Cleanup(srv.Close)
+
+			for i, want := range []string{tc.down, tc.up} {
+				var up []string
+				for _, line := range strings.Split(scrapeKeaMetrics(t, srv.URL), "\n") {
+					if strings.HasPrefix(line, "kea_up") {
+						up = append(up, line)
+					}
+				}
+				if want == "" && len(up) > 0 || want != "" && !slices.Equal(up, []string{want}) {
+					t.Errorf("scrape %d: kea_up = %q, want %q", i+1, up, want)
+				}
+			}
+		})
+	}
+}
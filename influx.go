@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var influxURL = flag.String("push.influxdb.url", "", "if nonempty, write metrics in InfluxDB line protocol to this URL, e.g. http://localhost:8086/write?db=kea or udp://localhost:8089")
+
+// influxUDPPayload is the maximum size of a UDP datagram; lines are never
+// split across datagrams.
+const influxUDPPayload = 1400
+
+// InfluxDBConfig configures writing to InfluxDB. URL is either the full URL
+// of the HTTP write API, including the database or org and bucket in the
+// query string, or udp://host:port for a UDP listener. Token is sent as
+// "Authorization: Token <token>", as InfluxDB 2 expects.
+type InfluxDBConfig struct {
+	URL          string        `yaml:"url"`
+	Token        string        `yaml:"token"`
+	Timeout      time.Duration `yaml:"timeout"`
+	Measurements NameTemplates `yaml:"measurements"`
+}
+
+// influxWriter writes snapshots as InfluxDB line protocol. The target,
+// subnet ID, prefix and pool index and the labels of the target become
+// tags, the statistics become fields.
+type influxWriter struct {
+	cfg          InfluxDBConfig
+	enabled      CollectorsConfig
+	measurements nameTemplates
+	client       *http.Client
+}
+
+func newInfluxWriter(cfg InfluxDBConfig, enabled CollectorsConfig) (*influxWriter, error) {
+	m, err := parseNameTemplates("push.influxdb.measurements", cfg.Measurements)
+	if err != nil {
+		return nil, err
+	}
+	return &influxWriter{
+		cfg:          cfg,
+		enabled:      enabled,
+		measurements: m,
+		client:       &http.Client{Timeout: cfg.Timeout},
+	}, nil
+}
+
+// lines returns one line per point of every snapshot.
+func (iw *influxWriter) lines(snaps []*keaSnapshot) ([][]byte, error) {
+	var lines [][]byte
+	for _, s := range snaps {
+		ts := strconv.FormatInt(s.Time.UnixNano(), 10)
+		for _, p := range s.points(iw.enabled) {
+			m, err := iw.measurements.execute(p.Kind, p.Name)
+			if err != nil {
+				return nil, fmt.Errorf("could not execute %s measurement template: %w", p.Kind, err)
+			}
+			var b bytes.Buffer
+			b.WriteString(influxEscape(m, ", "))
+			tags := map[string]string{"target": p.Name.Target}
+			for k, v := range p.Name.Labels {
+				tags[k] = v
+			}
+			if p.Kind != "global" {
+				tags["subnet_id"] = strconv.FormatUint(p.Name.SubnetID, 10)
+				tags["subnet"] = p.Name.Prefix
+			}
+			if p.Kind == "pool" {
+				tags["pool"] = strconv.FormatUint(p.Name.Pool, 10)
+			}
+			// InfluxDB performs best with tags sorted by key.
+			for _, k := range sortedKeys(tags) {
+				if tags[k] == "" {
+					continue
+				}
+				fmt.Fprintf(&b, ",%s=%s", influxEscape(k, ",= "), influxEscape(tags[k], ",= "))
+			}
+			for i, f := range p.Fields {
+				sep := ","
+				if i == 0 {
+					sep = " "
+				}
+				fmt.Fprintf(&b, "%s%s=%s", sep, influxEscape(f.Name, ",= "), strconv.FormatFloat(f.Value, 'g', -1, 64))
+			}
+			b.WriteString(" " + ts + "\n")
+			lines = append(lines, b.Bytes())
+		}
+	}
+	return lines, nil
+}
+
+// influxEscape backslash-escapes the characters in special.
+func influxEscape(s, special string) string {
+	if !strings.ContainsAny(s, special) {
+		return s
+	}
+	var b strings.Builder
+	for _, r := range s {
+		if strings.ContainsRune(special, r) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+func (iw *influxWriter) write(ctx context.Context, snaps []*keaSnapshot) error {
+	lines, err := iw.lines(snaps)
+	if err != nil || len(lines) == 0 {
+		return err
+	}
+	if strings.HasPrefix(iw.cfg.URL, "udp://") {
+		return iw.writeUDP(lines)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, iw.cfg.URL, bytes.NewReader(bytes.Join(lines, nil)))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	req.Header.Set("User-Agent", "gkse/"+version)
+	if iw.cfg.Token != "" {
+		req.Header.Set("Authorization", "Token "+iw.cfg.Token)
+	}
+	resp, err := iw.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("server returned %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+// writeUDP sends lines in as few datagrams as fit influxUDPPayload.
+func (iw *influxWriter) writeUDP(lines [][]byte) error {
+	conn, err := net.DialTimeout("udp", strings.TrimPrefix(iw.cfg.URL, "udp://"), iw.cfg.Timeout)
+	if err != nil {
+		return fmt.Errorf("could not connect: %w", err)
+	}
+	defer conn.Close()
+	var buf []byte
+	flush := func() error {
+		if len(buf) == 0 {
+			return nil
+		}
+		_, err := conn.Write(buf)
+		buf = buf[:0]
+		return err
+	}
+	for _, l := range lines {
+		if len(buf)+len(l) > influxUDPPayload {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+		buf = append(buf, l...)
+	}
+	return flush()
+}
+
+func (cfg InfluxDBConfig) validate() error {
+	if cfg.URL == "" {
+		return nil
+	}
+	var errs []error
+	u, err := url.Parse(cfg.URL)
+	switch {
+	case err != nil:
+		errs = append(errs, fmt.Errorf("push.influxdb.url: %w", err))
+	case u.Scheme == "udp":
+		if _, _, err := net.SplitHostPort(u.Host); err != nil {
+			errs = append(errs, fmt.Errorf("push.influxdb.url: %w", err))
+		}
+	case u.Scheme != "http" && u.Scheme != "https":
+		errs = append(errs, fmt.Errorf("push.influxdb.url: want an http://, https:// or udp:// URL, got '%s'", cfg.URL))
+	}
+	if cfg.Timeout <= 0 {
+		errs = append(errs, fmt.Errorf("push.influxdb.timeout: must be positive, got %s", cfg.Timeout))
+	}
+	if _, err := parseNameTemplates("push.influxdb.measurements", cfg.Measurements); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
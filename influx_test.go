@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestInfluxWriter(t *testing.T, url string) *influxWriter {
+	t.Helper()
+	cfg := defaultPushConfig().InfluxDB
+	cfg.URL = url
+	cfg.Token = "secret"
+	iw, err := newInfluxWriter(cfg, defaultConfig().Collectors)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return iw
+}
+
+func TestInfluxDBHTTP(t *testing.T) {
+	type write struct {
+		auth, query string
+		body        []byte
+	}
+	writes := make(chan write, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		writes <- write{r.Header.Get("Authorization"), r.URL.RawQuery, body}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	cfg := fixtureConfig("kea-2.6")
+	kc := &collectorSet{}
+	kc.update(cfg)
+	d := &pushDestinations{influx: newTestInfluxWriter(t, srv.URL+"/write?db=kea"), kc: kc}
+	pushOnce(context.Background(), newPushRegistry(kc), d)
+
+	w := <-writes
+	if w.auth != "Token secret" || w.query != "db=kea" {
+		t.Errorf("got Authorization %q and query %q, want Token secret and db=kea", w.auth, w.query)
+	}
+	for _, want := range []string{
+		"kea,target=kea-2.6 cumulative_assigned_addresses=0,declined_addresses=37,",
+		"kea_subnet,subnet=192.0.2.0/24,subnet_id=1,target=kea-2.6 assigned_addresses=31,",
+		"kea_pool,pool=0,subnet=192.0.2.0/24,subnet_id=1,target=kea-2.6 assigned_addresses=31,",
+	} {
+		if !strings.Contains(string(w.body), want) {
+			t.Errorf("written lines do not contain %q:\n%s", want, w.body)
+		}
+	}
+}
+
+func TestInfluxDBUDP(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	cfg := fixtureConfig("kea-2.6")
+	snap, err := takeSnapshot(context.Background(), cfg.Targets[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	iw := newTestInfluxWriter(t, "udp://"+conn.LocalAddr().String())
+	want, _ := iw.lines([]*keaSnapshot{snap})
+	if err := iw.write(context.Background(), []*keaSnapshot{snap}); err != nil {
+		t.Fatal(err)
+	}
+	// Every datagram holds whole lines and no more than influxUDPPayload.
+	var got int
+	buf := make([]byte, 65536)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for got < len(want) {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("got %d of %d lines: %v", got, len(want), err)
+		}
+		if n > influxUDPPayload || buf[n-1] != '\n' {
+			t.Errorf("datagram of %d bytes does not end with a complete line", n)
+		}
+		got += strings.Count(string(buf[:n]), "\n")
+	}
+}
+
+func TestInfluxEscape(t *testing.T) {
+	for _, tc := range []struct{ in, want string }{
+		{"kea", "kea"},
+		{"branch 17,lab", `branch\ 17\,lab`},
+		{"a=b", `a\=b`},
+	} {
+		if got := influxEscape(tc.in, ",= "); got != tc.want {
+			t.Errorf("influxEscape(%q) = %q, want %q", tc.in, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"pkg.i-no.de/pkg/gkse/keatest"
+)
+
+var updateGolden = flag.Bool("update", false, "update golden files in testdata/golden")
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+	logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	os.Exit(m.Run())
+}
+
+// newTestExporter serves the exporter's endpoints for the given targets and
+// returns the URL of the server.
+func newTestExporter(t *testing.T, targets ...TargetConfig) string {
+	t.Helper()
+	cfg := defaultConfig()
+	cfg.Targets = targets
+	if err := cfg.validate(); err != nil {
+		t.Fatalf("invalid test configuration: %v", err)
+	}
+	currentCfg.Store(cfg)
+	kc := &collectorSet{}
+	kc.update(cfg)
+	srv := httptest.NewServer(newMux(kc, &reloader{collectors: kc}))
+	t.Cleanup(srv.Close)
+	return srv.URL
+}
+
+// scrapeKeaMetrics fetches /metrics and returns the Kea metrics in it. The
+// exporter's own metrics and Go runtime metrics are dropped, as they vary
+// between runs.
+func scrapeKeaMetrics(t *testing.T, url string) string {
+	t.Helper()
+	resp, err := http.Get(url + "/metrics")
+	if err != nil {
+		t.Fatalf("GET /metrics: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET /metrics: status %s", resp.Status)
+	}
+	var b strings.Builder
+	sc := bufio.NewScanner(resp.Body)
+	sc.Buffer(nil, 1<<20)
+	for sc.Scan() {
+		line := sc.Text()
+		name := strings.TrimPrefix(strings.TrimPrefix(line, "# HELP "), "# TYPE ")
+		if strings.HasPrefix(name, "kea_") {
+			b.WriteString(line + "\n")
+		}
+	}
+	if err := sc.Err(); err != nil {
+		t.Fatalf("reading /metrics: %v", err)
+	}
+	return b.String()
+}
+
+// keaDown is what scrapeKeaMetrics returns if Kea could not be queried.
+const keaDown = `# HELP kea_up Whether querying the Kea server succeeded (1) or not (0)
+# TYPE kea_up gauge
+kea_up 0
+`
+
+func checkGolden(t *testing.T, name, got string) {
+	t.Helper()
+	path := filepath.Join("testdata", "golden", name)
+	if *updateGolden {
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(got), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("could not read golden file (run with -update to create it): %v", err)
+	}
+	if got != string(want) {
+		t.Errorf("/metrics output differs from %s (run with -update to accept):\n%s", path, lineDiff(string(want), got))
+	}
+}
+
+// lineDiff lists lines only in want (-) or only in got (+).
+func lineDiff(want, got string) string {
+	inWant := make(map[string]bool)
+	for _, l := range strings.Split(want, "\n") {
+		inWant[l] = true
+	}
+	inGot := make(map[string]bool)
+	var b strings.Builder
+	for _, l := range strings.Split(got, "\n") {
+		inGot[l] = true
+		if !inWant[l] {
+			b.WriteString("+ " + l + "\n")
+		}
+	}
+	for _, l := range strings.Split(want, "\n") {
+		if !inGot[l] {
+			b.WriteString("- " + l + "\n")
+		}
+	}
+	return b.String()
+}
+
+func newFixtureServer(t *testing.T, version string) *keatest.Server {
+	t.Helper()
+	kea := keatest.NewServer(t)
+	kea.Handle(statsCommand, keatest.File(t, filepath.Join("testdata", version, "statistic-get-all.json")))
+	kea.Handle(configCommand, keatest.File(t, filepath.Join("testdata", version, "config-get.json")))
+	return kea
+}
+
+// TestMetricsKeaVersions checks the metrics for the responses of every Kea
+// version in testdata.
+func TestMetricsKeaVersions(t *testing.T) {
+	dirs, err := filepath.Glob(filepath.Join("testdata", "kea-*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, dir := range dirs {
+		version := filepath.Base(dir)
+		t.Run(version, func(t *testing.T) {
+			kea := newFixtureServer(t, version)
+			url := newTestExporter(t, TargetConfig{Name: "dhcp1", Socket: kea.SocketPath, Timeout: time.Second})
+			checkGolden(t, version+".prom", scrapeKeaMetrics(t, url))
+		})
+	}
+}
+
+func TestMetricsControlAgent(t *testing.T) {
+	kea := newFixtureServer(t, "kea-2.4")
+	url := newTestExporter(t, TargetConfig{Name: "dhcp1", URL: kea.URL, Timeout: time.Second})
+	checkGolden(t, "kea-2.4.prom", scrapeKeaMetrics(t, url))
+	service, _ := kea.LastRequest(statsCommand)["service"].([]any)
+	if len(service) != 1 || service[0] != "dhcp4" {
+		t.Errorf("command to control agent has service %v, want [dhcp4]", service)
+	}
+}
+
+func TestMetricsMultipleTargets(t *testing.T) {
+	good := newFixtureServer(t, "kea-2.4")
+	bad := keatest.NewServer(t)
+	bad.Handle(statsCommand, keatest.Response{Fault: keatest.Reset})
+	url := newTestExporter(t,
+		TargetConfig{Name: "good", Socket: good.SocketPath, Timeout: time.Second},
+		TargetConfig{Name: "bad", Socket: bad.SocketPath, Timeout: time.Second},
+	)
+	checkGolden(t, "multi-target.prom", scrapeKeaMetrics(t, url))
+}
+
+func TestMetricsFailures(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		stats  keatest.Response
+		reason string
+	}{
+		{"result code", keatest.Result(1, "unable to forward command to the dhcp4 service"), "result 1: unable to forward command"},
+		{"malformed JSON", keatest.Malformed(), "unexpected (EOF|end of JSON input)"},
+		{"partial write", keatest.Response{Body: []byte(`{"arguments": {}, "result": 0}`), Fault: keatest.PartialWrite}, "unexpected (EOF|end of JSON input)"},
+		{"connection reset", keatest.Response{Fault: keatest.Reset}, "EOF|connection reset"},
+		{"stall", keatest.Response{Fault: keatest.Stall}, "timeout|deadline exceeded"},
+	} {
+		for _, transport := range []string{"socket", "url"} {
+			t.Run(tc.name+"/"+transport, func(t *testing.T) {
+				kea := newFixtureServer(t, "kea-2.4")
+				kea.Handle(statsCommand, tc.stats)
+				target := TargetConfig{Name: "dhcp1", Timeout: 200 * time.Millisecond}
+				if transport == "socket" {
+					target.Socket = kea.SocketPath
+				} else {
+					target.URL = kea.URL
+				}
+				url := newTestExporter(t, target)
+				start := time.Now()
+				if got := scrapeKeaMetrics(t, url); got != keaDown {
+					t.Errorf("got Kea metrics despite failure:\n%s", got)
+				}
+				if d := time.Since(start); d > 2*time.Second {
+					t.Errorf("scrape took %s, want the target timeout to apply", d)
+				}
+				resp, err := http.Get(url + "/readyz")
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer resp.Body.Close()
+				body, _ := io.ReadAll(resp.Body)
+				if resp.StatusCode != http.StatusServiceUnavailable {
+					t.Errorf("/readyz status %d, want %d", resp.StatusCode, http.StatusServiceUnavailable)
+				}
+				if !regexp.MustCompile(tc.reason).Match(body) {
+					t.Errorf("/readyz body %q does not match %q", body, tc.reason)
+				}
+			})
+		}
+	}
+}
+
+func TestMetricsRecovery(t *testing.T) {
+	kea := newFixtureServer(t, "kea-2.4")
+	kea.Handle(statsCommand,
+		keatest.Malformed(),
+		keatest.File(t, filepath.Join("testdata", "kea-2.4", "statistic-get-all.json")),
+	)
+	url := newTestExporter(t, TargetConfig{Name: "dhcp1", Socket: kea.SocketPath, Timeout: time.Second})
+	if got := scrapeKeaMetrics(t, url); got != keaDown {
+		t.Errorf("first scrape: got Kea metrics from malformed response:\n%s", got)
+	}
+	checkGolden(t, "kea-2.4.prom", scrapeKeaMetrics(t, url))
+	if n := kea.Requests(statsCommand); n != 2 {
+		t.Errorf("Kea got %d %s requests, want 2", n, statsCommand)
+	}
+}
@@ -1,49 +1,169 @@
 package main
 
 import (
+	"bytes"
+	"cmp"
+	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
+	"slices"
+	"time"
 )
 
 var configFromFile = flag.String("c", "", "if nonempty, load kea JSON config from file instead of querying unix domain socket")
 
-const configQuery = `{"command": "config-get"}`
+const configCommand = "config-get"
 
 type ParsedKeaConfig struct {
+	Result    int       `json:"result"`
+	Text      string    `json:"text"`
 	KeaConfig KeaConfig `json:"arguments"`
 }
 
 type KeaConfig struct {
-	Dhcp4 Dhcp4 `json:"Dhcp4"`
+	Dhcp4 *Dhcp4 `json:"Dhcp4"`
 }
 
 type Dhcp4 struct {
-	Subnets     []Subnet `json:"subnet4"`
-	SubnetsByID map[uint64]string
+	SubnetParams
+	ServerTag      string          `json:"server-tag"`
+	HooksLibraries []HooksLibrary  `json:"hooks-libraries"`
+	Subnets        []Subnet        `json:"subnet4"`
+	SharedNetworks []SharedNetwork `json:"shared-networks"`
+	SubnetsByID    map[uint64]string
+	SubnetConfigs  map[uint64]Subnet // including those of shared networks
+}
+
+type SharedNetwork struct {
+	SubnetParams
+	Name        string         `json:"name"`
+	Subnets     []Subnet       `json:"subnet4"`
+	UserContext map[string]any `json:"user-context"`
 }
 
 type Subnet struct {
-	ID      uint64 `json:"id"`
-	Netname string `json:"subnet"`
+	SubnetParams
+	ID            uint64         `json:"id"`
+	Netname       string         `json:"subnet"`
+	Pools         []Pool         `json:"pools"`
+	Reservations  []Reservation  `json:"reservations"`
+	UserContext   map[string]any `json:"user-context"`
+	SharedNetwork string         `json:"-"` // name of the shared network, if any
+	// SharedNetworkContext is the user context of the shared network.
+	SharedNetworkContext map[string]any `json:"-"`
+	// Effective holds the parameters of the subnet including those it
+	// inherits from its shared network and the global configuration.
+	Effective SubnetParams `json:"-"`
+}
+
+// Reservation is a host reservation of a subnet. Only reservations with an
+// address are of interest here.
+type Reservation struct {
+	IPAddress string `json:"ip-address"`
+	HWAddress string `json:"hw-address"`
+	ClientID  string `json:"client-id"`
+	Hostname  string `json:"hostname"`
+}
+
+// SubnetParams are the parameters a subnet inherits from its shared network,
+// and those from the global configuration, unless it sets them itself.
+type SubnetParams struct {
+	Interface        string       `json:"interface"`
+	Relay            *Relay       `json:"relay"`
+	ValidLifetime    *uint64      `json:"valid-lifetime"`
+	MinValidLifetime *uint64      `json:"min-valid-lifetime"`
+	MaxValidLifetime *uint64      `json:"max-valid-lifetime"`
+	RenewTimer       *uint64      `json:"renew-timer"`
+	RebindTimer      *uint64      `json:"rebind-timer"`
+	ClientClass      string       `json:"client-class"`
+	OptionData       []OptionData `json:"option-data"`
+}
+
+// Relay holds the relay addresses of a subnet. Kea before 1.4 only knew a
+// single ip-address.
+type Relay struct {
+	IPAddresses []string `json:"ip-addresses"`
+	IPAddress   string   `json:"ip-address"`
+}
+
+type OptionData struct {
+	Name string `json:"name"`
+	Code int    `json:"code"`
+	Data string `json:"data"`
+}
+
+// inherit returns p with the parameters it does not set taken from parent.
+// Options are looked up in order, so those of p come first.
+func (p SubnetParams) inherit(parent SubnetParams) SubnetParams {
+	p.Interface = cmp.Or(p.Interface, parent.Interface)
+	if p.Relay == nil {
+		p.Relay = parent.Relay
+	}
+	for _, f := range []struct{ v, parent **uint64 }{
+		{&p.ValidLifetime, &parent.ValidLifetime},
+		{&p.MinValidLifetime, &parent.MinValidLifetime},
+		{&p.MaxValidLifetime, &parent.MaxValidLifetime},
+		{&p.RenewTimer, &parent.RenewTimer},
+		{&p.RebindTimer, &parent.RebindTimer},
+	} {
+		if *f.v == nil {
+			*f.v = *f.parent
+		}
+	}
+	p.ClientClass = cmp.Or(p.ClientClass, parent.ClientClass)
+	p.OptionData = append(slices.Clip(p.OptionData), parent.OptionData...)
+	return p
+}
+
+// relayAddresses returns the relay addresses, if any.
+func (p SubnetParams) relayAddresses() []string {
+	if p.Relay == nil {
+		return nil
+	}
+	if p.Relay.IPAddress != "" && len(p.Relay.IPAddresses) == 0 {
+		return []string{p.Relay.IPAddress}
+	}
+	return p.Relay.IPAddresses
 }
 
-func queryConfig() (*KeaConfig, error) {
+// routers returns the data of the routers option (code 3), or "" if the
+// option is not set.
+func (p SubnetParams) routers() string {
+	for _, o := range p.OptionData {
+		if o.Name == "routers" || o.Code == 3 {
+			return o.Data
+		}
+	}
+	return ""
+}
+
+// Pool is an address pool of a subnet. Kea numbers pools by their position
+// in the subnet's pools list, which is the pool index of the statistics.
+type Pool struct {
+	Pool        string         `json:"pool"` // a range "first - last" or a prefix
+	UserContext map[string]any `json:"user-context"`
+}
+
+func queryConfig(ctx context.Context, t TargetConfig) (*KeaConfig, error) {
 	var c *KeaConfig
 	var err error
 	var rawJSON []byte
-	if *jsonFromFile == "" {
-		logger.Debug("Reading Kea config from socket", "path", *sockPath)
-		rawJSON, err = queryKeaOnce(configQuery)
+	if t.ConfigFile == "" {
+		logger.DebugContext(ctx, "Reading Kea config from target", "target", t.Name, "socket", t.Socket, "url", t.URL)
+		rawJSON, err = queryKea(ctx, t, configCommand)
 	} else {
-		logger.Debug("Reading Kea config from file", "path", *configFromFile)
-		rawJSON, err = getRawJSONFromFile(*configFromFile)
+		logger.DebugContext(ctx, "Reading Kea config from file", "path", t.ConfigFile)
+		rawJSON, err = getRawJSONFromFile(t.ConfigFile)
 	}
 	if err != nil {
 		return nil, fmt.Errorf("could not query Kea for config: %w", err)
 	}
-	logger.Debug("Parsing JSON", "size", len(rawJSON))
+	keaBytesRead.WithLabelValues(t.Name, configCommand).Add(float64(len(rawJSON)))
+	logger.DebugContext(ctx, "Parsing JSON", "size", len(rawJSON))
+	parseStart := time.Now()
 	c, err = fromJSON(rawJSON)
+	parseDuration.WithLabelValues(t.Name, configCommand).Observe(time.Since(parseStart).Seconds())
 	if err != nil {
 		return nil, fmt.Errorf("could not parse Kea config: %w", err)
 	}
@@ -53,17 +173,84 @@ func queryConfig() (*KeaConfig, error) {
 func fromJSON(data []byte) (*KeaConfig, error) {
 	var pkc ParsedKeaConfig
 	err := json.Unmarshal(data, &pkc)
+	if err != nil || pkc.Result == 0 && pkc.KeaConfig.Dhcp4 == nil {
+		// Perhaps a Kea configuration file, which has Dhcp4 at the top and
+		// may contain comments.
+		var file KeaConfig
+		if json.Unmarshal(stripJSONComments(data), &file) == nil && file.Dhcp4 != nil {
+			pkc, err = ParsedKeaConfig{KeaConfig: file}, nil
+		}
+	}
 	if err != nil {
 		return nil, err
 	}
+	if pkc.Result != 0 {
+		return nil, fmt.Errorf("Kea returned result %d: %s", pkc.Result, pkc.Text)
+	}
 	c := pkc.KeaConfig
+	if c.Dhcp4 == nil {
+		return nil, fmt.Errorf("response contains no Dhcp4 configuration")
+	}
 	c.Dhcp4.SubnetsByID = make(map[uint64]string)
-	for _, sn := range c.Dhcp4.Subnets {
+	c.Dhcp4.SubnetConfigs = make(map[uint64]Subnet)
+	subnets := slices.Clone(c.Dhcp4.Subnets)
+	for _, shn := range c.Dhcp4.SharedNetworks {
+		for _, sn := range shn.Subnets {
+			sn.SharedNetwork = shn.Name
+			sn.SharedNetworkContext = shn.UserContext
+			sn.Effective = sn.SubnetParams.inherit(shn.SubnetParams)
+			subnets = append(subnets, sn)
+		}
+	}
+	for _, sn := range subnets {
+		if sn.SharedNetwork == "" {
+			sn.Effective = sn.SubnetParams
+		}
+		sn.Effective = sn.Effective.inherit(c.Dhcp4.SubnetParams)
+		if prev, ok := c.Dhcp4.SubnetsByID[sn.ID]; ok {
+			return nil, fmt.Errorf("subnet ID %d is used by both '%s' and '%s'", sn.ID, prev, sn.Netname)
+		}
 		c.Dhcp4.SubnetsByID[sn.ID] = sn.Netname
+		c.Dhcp4.SubnetConfigs[sn.ID] = sn
 	}
 	return &c, nil
 }
 
+// stripJSONComments returns data with the #, // and /* */ comments that Kea
+// allows in its configuration files replaced by spaces.
+func stripJSONComments(data []byte) []byte {
+	out := slices.Clone(data)
+	inString := false
+	for i := 0; i < len(out); i++ {
+		switch {
+		case inString:
+			if out[i] == '\\' {
+				i++
+			} else if out[i] == '"' {
+				inString = false
+			}
+		case out[i] == '"':
+			inString = true
+		case out[i] == '#' || out[i] == '/' && i+1 < len(out) && out[i+1] == '/':
+			for ; i < len(out) && out[i] != '\n'; i++ {
+				out[i] = ' '
+			}
+		case out[i] == '/' && i+1 < len(out) && out[i+1] == '*':
+			end := bytes.Index(out[i+2:], []byte("*/"))
+			if end < 0 {
+				end = len(out) - i - 4
+			}
+			for j := i; j < i+end+4; j++ {
+				if out[j] != '\n' {
+					out[j] = ' '
+				}
+			}
+			i += end + 3
+		}
+	}
+	return out
+}
+
 func (c KeaConfig) subnetFromID(nettype int, id uint64) (string, error) {
 	var subnet string
 	var err error
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFromJSON(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		raw     string
+		want    map[uint64]string
+		wantErr string
+	}{
+		{
+			name: "subnets and shared networks",
+			raw: `{"result": 0, "arguments": {"Dhcp4": {
+				"subnet4": [{"id": 1, "subnet": "192.0.2.0/24"}],
+				"shared-networks": [{"name": "lab", "subnet4": [{"id": 3, "subnet": "203.0.113.0/25"}]}]}}}`,
+			want: map[uint64]string{1: "192.0.2.0/24", 3: "203.0.113.0/25"},
+		},
+		{
+			name: "configuration file with comments",
+			raw: `{
+				# Kea allows comments in its configuration files
+				"Dhcp4": {
+					// like this
+					"subnet4": [{"id": 1, "subnet": "192.0.2.0/24", /* and this */ "user-context": {"url": "http://example.com/#x"}}]
+				}
+			}`,
+			want: map[uint64]string{1: "192.0.2.0/24"},
+		},
+		{
+			name: "no subnets",
+			raw:  `{"result": 0, "arguments": {"Dhcp4": {}}}`,
+			want: map[uint64]string{},
+		},
+		{
+			name:    "error result",
+			raw:     `{"result": 1, "text": "unable to forward command to the dhcp4 service"}`,
+			wantErr: "unable to forward command",
+		},
+		{
+			name:    "no Dhcp4",
+			raw:     `{"result": 0, "arguments": {"Dhcp6": {}}}`,
+			wantErr: "no Dhcp4",
+		},
+		{
+			name:    "duplicate subnet ID",
+			raw:     `{"arguments": {"Dhcp4": {"subnet4": [{"id": 1, "subnet": "192.0.2.0/24"}], "shared-networks": [{"subnet4": [{"id": 1, "subnet": "203.0.113.0/25"}]}]}}}`,
+			wantErr: "subnet ID 1",
+		},
+		{
+			name:    "subnets not a list",
+			raw:     `{"arguments": {"Dhcp4": {"subnet4": {}}}}`,
+			wantErr: "cannot unmarshal",
+		},
+	} {
+		c, err := fromJSON([]byte(tc.raw))
+		if tc.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("%s: got error %v, want one containing %q", tc.name, err, tc.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		if len(c.Dhcp4.SubnetsByID) != len(tc.want) {
+			t.Errorf("%s: got subnets %v, want %v", tc.name, c.Dhcp4.SubnetsByID, tc.want)
+		}
+		for id, net := range tc.want {
+			if got := c.Dhcp4.SubnetsByID[id]; got != net {
+				t.Errorf("%s: subnet %d is %q, want %q", tc.name, id, got, net)
+			}
+		}
+	}
+}
+
+func TestStripJSONComments(t *testing.T) {
+	for in, want := range map[string]string{
+		`{"a": 1} # shell`:                    `{"a": 1}        `,
+		`{"a": 1} // C++` + "\n" + `{}`:       `{"a": 1}       ` + "\n" + `{}`,
+		`{"a": /* C */ 1}`:                    `{"a":         1}`,
+		"{/* two\nlines */}":                  "{      \n        }",
+		`{"a": 1} /* unterminated`:            `{"a": 1}                `,
+		`{"url": "http://h/#x", "p": "/*//"}`: `{"url": "http://h/#x", "p": "/*//"}`,
+		`{"q": "\"#", "r": 1} # after escape`: `{"q": "\"#", "r": 1}               `,
+	} {
+		if got := string(stripJSONComments([]byte(in))); got != want {
+			t.Errorf("stripJSONComments(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestSubnetParamsInheritance(t *testing.T) {
+	c, err := fromJSON([]byte(`{"arguments": {"Dhcp4": {
+		"valid-lifetime": 4000, "renew-timer": 1000,
+		"option-data": [{"name": "routers", "data": "192.0.2.254"}, {"name": "domain-name", "data": "example.com"}],
+		"subnet4": [
+			{"id": 1, "subnet": "192.0.2.0/24", "relay": {"ip-address": "192.0.2.2"}},
+			{"id": 2, "subnet": "198.51.100.0/24", "valid-lifetime": 604800, "option-data": [{"code": 3, "data": "198.51.100.1"}]}],
+		"shared-networks": [{"name": "lab", "interface": "eth1", "renew-timer": 500, "client-class": "lab",
+			"relay": {"ip-addresses": ["203.0.113.2", "203.0.113.3"]},
+			"subnet4": [{"id": 3, "subnet": "203.0.113.0/25", "client-class": "printers"}]}]}}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		id                            uint64
+		iface, relays, class, routers string
+		valid, renew                  uint64
+	}{
+		{1, "", "192.0.2.2", "", "192.0.2.254", 4000, 1000},
+		{2, "", "", "", "198.51.100.1", 604800, 1000},
+		{3, "eth1", "203.0.113.2,203.0.113.3", "printers", "192.0.2.254", 4000, 500},
+	} {
+		p := c.Dhcp4.SubnetConfigs[tc.id].Effective
+		if p.Interface != tc.iface || strings.Join(p.relayAddresses(), ",") != tc.relays || p.ClientClass != tc.class || p.routers() != tc.routers {
+			t.Errorf("subnet %d: got interface %q, relays %q, client class %q, routers %q, want %q, %q, %q, %q",
+				tc.id, p.Interface, p.relayAddresses(), p.ClientClass, p.routers(), tc.iface, tc.relays, tc.class, tc.routers)
+		}
+		if p.ValidLifetime == nil || *p.ValidLifetime != tc.valid || p.RenewTimer == nil || *p.RenewTimer != tc.renew {
+			t.Errorf("subnet %d: got valid lifetime %v, renew timer %v, want %d, %d", tc.id, p.ValidLifetime, p.RenewTimer, tc.valid, tc.renew)
+		}
+		if p.RebindTimer != nil {
+			t.Errorf("subnet %d: rebind timer is %d, want it unset", tc.id, *p.RebindTimer)
+		}
+	}
+}
+
+func TestMetricsSubnetInfo(t *testing.T) {
+	url := newTestExporter(t, TargetConfig{Name: "dhcp1", Timeout: time.Second,
+		StatsFile:  "testdata/kea-2.6/statistic-get-all.json",
+		ConfigFile: "testdata/config-get-subnet-info.json"})
+	got := scrapeKeaMetrics(t, url)
+	for _, want := range []string{
+		`kea_subnet_info{client_class="voip",interface="",max_valid_lifetime="1209600",min_valid_lifetime="",rebind_timer="2000",relay_addresses="198.51.100.2,198.51.100.3",renew_timer="1000",routers="198.51.100.1",shared_network="",subnet="198.51.100.0/24",subnetidx="2",valid_lifetime="604800"} 1`,
+		`kea_subnet_valid_lifetime_seconds{subnet="198.51.100.0/24",subnetidx="2"} 604800`,
+		// Subnet 1 inherits the global lifetime.
+		`kea_subnet_valid_lifetime_seconds{subnet="192.0.2.0/24",subnetidx="1"} 4000`,
+	} {
+		if !strings.Contains(got, want+"\n") {
+			t.Errorf("/metrics has no line %s", want)
+		}
+	}
+}
+
+func FuzzFromJSON(f *testing.F) {
+	addFixtureSeeds(f, configCommand)
+	for _, s := range []string{
+		`{"result": 1, "text": "unable to forward command"}`,
+		`{"arguments": {"Dhcp4": null}}`,
+		`{"arguments": {"Dhcp4": {"subnet4": null, "shared-networks": [{"subnet4": null}]}}}`,
+		`{"arguments": {"Dhcp4": {"subnet4": [{"id": -1}]}}}`,
+		`[]`,
+	} {
+		f.Add([]byte(s))
+	}
+	f.Fuzz(func(t *testing.T, raw []byte) {
+		c, err := fromJSON(raw)
+		if err != nil {
+			return
+		}
+		n := len(c.Dhcp4.Subnets)
+		for _, sn := range c.Dhcp4.SharedNetworks {
+			n += len(sn.Subnets)
+		}
+		if len(c.Dhcp4.SubnetsByID) != n {
+			t.Errorf("%d subnets in the configuration, but %d in SubnetsByID", n, len(c.Dhcp4.SubnetsByID))
+		}
+		for id := range c.Dhcp4.SubnetsByID {
+			if _, err := c.subnetFromID(4, id); err != nil {
+				t.Errorf("subnetFromID(4, %d): %v", id, err)
+			}
+		}
+	})
+}
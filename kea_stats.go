@@ -1,74 +1,142 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
-	"sort"
+	"io"
+	"os"
 	"strconv"
 	"strings"
 	"time"
 )
 
-const statsQuery = `{
-  "command":"statistic-get-all",
-  "arguments":{}
-}`
+const statsCommand = "statistic-get-all"
 
 var (
 	sockPath     = flag.String("s", "/run/kea/kea4-ctrl-socket", "Path to Kea control socket")
 	jsonFromFile = flag.String("f", "", "if nonempty, load stats JSON from file instead of querying unix domain socket")
 )
 
-func getStatsJSON() ([]byte, error) {
+func getStatsJSON(ctx context.Context, t TargetConfig) ([]byte, error) {
 	var rawJSON []byte
 	var err error
-	if *jsonFromFile == "" {
-		logger.Debug("Reading Kea stats from socket", "path", *sockPath)
-		rawJSON, err = queryKeaOnce(statsQuery)
+	if t.StatsFile == "" {
+		logger.DebugContext(ctx, "Reading Kea stats from target", "target", t.Name, "socket", t.Socket, "url", t.URL)
+		rawJSON, err = queryKea(ctx, t, statsCommand)
 	} else {
-		logger.Debug("Reading Kea stats from file", "path", *jsonFromFile)
-		rawJSON, err = getRawJSONFromFile(*jsonFromFile)
+		logger.DebugContext(ctx, "Reading Kea stats from file", "path", t.StatsFile)
+		rawJSON, err = getRawJSONFromFile(t.StatsFile)
 	}
 	if err != nil {
 		return nil, fmt.Errorf("could not get raw JSON stats: %w", err)
 	}
+	keaBytesRead.WithLabelValues(t.Name, statsCommand).Add(float64(len(rawJSON)))
 	return rawJSON, nil
 }
 
-func parseStats(rawJSON []byte) (*KeaCookedMetrics, error) {
-	var stats KeaRawMetrics
+// openStats returns the statistic-get-all response of t as a stream, from
+// Kea or from its stats_file. The caller must close it.
+func openStats(ctx context.Context, t TargetConfig) (io.ReadCloser, error) {
+	var r io.ReadCloser
 	var err error
-	err = json.Unmarshal(rawJSON, &stats)
+	if t.StatsFile == "" {
+		logger.DebugContext(ctx, "Reading Kea stats from target", "target", t.Name, "socket", t.Socket, "url", t.URL)
+		r, err = openKea(ctx, t, statsCommand)
+	} else {
+		logger.DebugContext(ctx, "Reading Kea stats from file", "path", t.StatsFile)
+		r, err = os.Open(t.StatsFile)
+	}
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("could not get raw JSON stats: %w", err)
 	}
+	return r, nil
+}
+
+// parseStats parses a statistic-get-all response as it is read from r. It
+// goes through the response one statistic at a time and keeps only the
+// newest sample of each, so the memory needed grows with neither the size
+// of the response nor the number of samples Kea keeps.
+func parseStats(r io.Reader) (*KeaCookedMetrics, error) {
+	dec := json.NewDecoder(r)
 	var cooked KeaCookedMetrics
 	cooked.SubnetMetrics = make(map[uint64]KeaSubnetMetrics)
-	for name, stat := range stats.Arguments {
-		ml, ok := stat.([]interface{})
-		if !ok {
-			return nil, fmt.Errorf("stat is not an []interface{}: %#v", stat)
+	var result int
+	var text string
+	if err := expectDelim(dec, '{'); err != nil {
+		return nil, err
+	}
+	for dec.More() {
+		key, err := readKey(dec)
+		if err != nil {
+			return nil, err
+		}
+		switch key {
+		case "arguments":
+			err = parseStatsArguments(dec, &cooked)
+		case "result":
+			err = dec.Decode(&result)
+		case "text":
+			err = dec.Decode(&text)
+		default:
+			err = dec.Decode(&json.RawMessage{})
 		}
+		if err != nil {
+			return nil, fmt.Errorf("could not parse '%s': %w", key, err)
+		}
+	}
+	if err := expectDelim(dec, '}'); err != nil {
+		return nil, err
+	}
+	if result != 0 {
+		return nil, fmt.Errorf("Kea returned result %d: %s", result, text)
+	}
+	return &cooked, nil
+}
+
+func parseStatsArguments(dec *json.Decoder, cooked *KeaCookedMetrics) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if tok == nil {
+		return nil
+	}
+	if tok != json.Delim('{') {
+		return fmt.Errorf("expected an object, got %v", tok)
+	}
+	// Reused for every statistic, json.RawMessage unmarshals into its
+	// existing buffer.
+	var samples json.RawMessage
+	for dec.More() {
+		name, err := readKey(dec)
+		if err != nil {
+			return err
+		}
+		if err := dec.Decode(&samples); err != nil {
+			return fmt.Errorf("statistic '%s': %w", name, err)
+		}
+		val, err := latestSampleValue(samples)
+		if err != nil {
+			return fmt.Errorf("statistic '%s': %w", name, err)
+		}
+		var known bool
 		if strings.HasPrefix(name, "subnet[") {
-			err = extractSubnetMetric(name, &cooked, ml)
+			known, err = extractSubnetMetric(name, cooked, val)
 			if err != nil {
-				return nil, err
+				return err
 			}
 		} else {
-			val, err := getLatestMetricValue(ml)
-			if err != nil {
-				return nil, err
-			}
-			extractCookedMetrics(name, &cooked, val)
+			known = extractCookedMetrics(name, cooked, val)
+		}
+		cooked.StatsSeen++
+		if known {
+			cooked.StatsExported++
 		}
 	}
-	return &cooked, nil
-}
-
-type KeaRawMetrics struct {
-	Arguments map[string]interface{} `mapstructure:",remain"`
-	Result    int                    `json:"result"`
+	return expectDelim(dec, '}')
 }
 
 type KeaCookedMetrics struct {
@@ -104,6 +172,8 @@ type KeaCookedMetrics struct {
 	V4AllocationFailSubnet               float64
 	V4ReservationConflicts               float64
 	SubnetMetrics                        map[uint64]KeaSubnetMetrics
+	StatsSeen                            int // statistics in the Kea response
+	StatsExported                        int // statistics that map to an exported metric
 }
 
 type KeaSubnetMetrics struct {
@@ -135,7 +205,9 @@ type KeaPoolMetrics struct {
 	ReclaimedDeclinedAddresses  float64
 }
 
-func extractCookedMetrics(name string, cooked *KeaCookedMetrics, value float64) {
+// extractCookedMetrics stores value in the field of cooked that corresponds to
+// the statistic name. It returns false if the statistic is not known.
+func extractCookedMetrics(name string, cooked *KeaCookedMetrics, value float64) bool {
 	switch name {
 	case "cumulative-assigned-addresses":
 		cooked.CumulativeAssignedAddresses = value
@@ -189,13 +261,16 @@ func extractCookedMetrics(name string, cooked *KeaCookedMetrics, value float64)
 		cooked.V4AllocationFailSubnet = value
 	case "v4-reservation-conflicts":
 		cooked.V4ReservationConflicts = value
+	default:
+		return false
 	}
+	return true
 }
 
-func extractSubnetMetric(name string, cooked *KeaCookedMetrics, ml []interface{}) error {
+func extractSubnetMetric(name string, cooked *KeaCookedMetrics, val float64) (bool, error) {
 	index, submetric, err := parseMetricNameID(name)
 	if err != nil {
-		return err
+		return false, err
 	}
 	var snm KeaSubnetMetrics
 	if ret, ok := cooked.SubnetMetrics[index]; ok {
@@ -204,14 +279,11 @@ func extractSubnetMetric(name string, cooked *KeaCookedMetrics, ml []interface{}
 		snm = KeaSubnetMetrics{}
 	}
 	snm.SubnetIndex = index
-	val, err := getLatestMetricValue(ml)
-	if err != nil {
-		return err
-	}
+	known := true
 	if strings.HasPrefix(submetric, "pool[") {
-		err = extractPoolMetric(submetric, &snm, ml)
+		known, err = extractPoolMetric(submetric, &snm, val)
 		if err != nil {
-			return err
+			return false, err
 		}
 	} else {
 		switch submetric {
@@ -229,10 +301,12 @@ func extractSubnetMetric(name string, cooked *KeaCookedMetrics, ml []interface{}
 			snm.TotalAddresses = val
 		case "v4-reservation-conflicts":
 			snm.V4ReservationConflicts = val
+		default:
+			known = false
 		}
 	}
 	cooked.SubnetMetrics[index] = snm
-	return nil
+	return known, nil
 }
 
 func parseMetricNameID(name string) (uint64, string, error) {
@@ -244,22 +318,25 @@ func parseMetricNameID(name string) (uint64, string, error) {
 		return index, shortname, fmt.Errorf("could not find opening bracket in submetric name '%s'", name)
 	}
 	closeBrkt := strings.Index(name, "]")
-	if closeBrkt == -1 {
+	if closeBrkt == -1 || closeBrkt < openBrkt {
 		return index, shortname, fmt.Errorf("could not find closing bracket in submetric name '%s'", name)
 	}
 	index, err := strconv.ParseUint(name[openBrkt+1:closeBrkt], 10, 64)
 	if err != nil {
 		return index, shortname, fmt.Errorf("could not parse subnet index from '%s'", name[openBrkt+1:closeBrkt])
 	}
+	if len(name) < closeBrkt+3 || name[closeBrkt+1] != '.' {
+		return index, shortname, fmt.Errorf("expected '.' and a submetric name after the index in '%s'", name)
+	}
 	shortname = name[closeBrkt+2:]
 	return index, shortname, nil
 }
 
-func extractPoolMetric(name string, snm *KeaSubnetMetrics, ml []interface{}) error {
+func extractPoolMetric(name string, snm *KeaSubnetMetrics, val float64) (bool, error) {
 	var pm KeaPoolMetrics
 	index, submetric, err := parseMetricNameID(name)
 	if err != nil {
-		return err
+		return false, err
 	}
 	if ret, ok := snm.PoolMetrics[index]; ok {
 		pm = ret
@@ -267,10 +344,10 @@ func extractPoolMetric(name string, snm *KeaSubnetMetrics, ml []interface{}) err
 		pm = KeaPoolMetrics{}
 		pm.PoolIndex = index
 	}
-	val, err := getLatestMetricValue(ml)
-	if err != nil {
-		return err
+	if snm.PoolMetrics == nil {
+		snm.PoolMetrics = make(map[uint64]KeaPoolMetrics)
 	}
+	known := true
 	switch submetric {
 	case "total-addresses":
 		pm.TotalAddresses = val
@@ -284,39 +361,175 @@ func extractPoolMetric(name string, snm *KeaSubnetMetrics, ml []interface{}) err
 		pm.DeclinedAddresses = val
 	case "reclaimed-declined-addresses":
 		pm.ReclaimedDeclinedAddresses = val
+	default:
+		known = false
 	}
 	snm.PoolMetrics[pm.PoolIndex] = pm
 
-	return nil
+	return known, nil
 }
 
-func getLatestMetricValue(metricsList []interface{}) (float64, error) {
-	ml := make([]metric, 0, len(metricsList))
-	for _, metricEntry := range metricsList {
-		statPair, ok := metricEntry.([]interface{})
-		if !ok {
-			return 0, fmt.Errorf("metric entry is not an []interface{}, '%#v'", metricEntry)
+// keaTimeFormat is the format of sample timestamps, e.g.
+// "2023-09-14 00:08:10.270215".
+const keaTimeFormat = "2006-01-02 15:04:05.999999"
+
+// latestSampleValue returns the value of the newest sample in a list of
+// [value, timestamp] samples. It does not allocate unless timestamps differ
+// in length, which Kea does not produce.
+func latestSampleValue(samples []byte) (float64, error) {
+	sc := sampleScanner{b: samples}
+	if !sc.consume('[') {
+		return 0, sc.errorf("expected a list of samples")
+	}
+	var latest float64
+	var latestTime []byte
+	n := 0
+	for !sc.consume(']') {
+		if n > 0 && !sc.consume(',') {
+			return 0, sc.errorf("expected ',' or ']' after sample %d", n-1)
 		}
-		statValue, ok := statPair[0].(float64)
-		if !ok {
-			return 0, fmt.Errorf("statPair[0] is not a float, '%#v'", statPair[0])
+		if !sc.consume('[') {
+			return 0, sc.errorf("sample %d: expected '['", n)
 		}
-		statTimestamp, ok := statPair[1].(string)
-		if !ok {
-			return 0, fmt.Errorf("statPair[1] is not a string, '%#v'", statPair[1])
+		v, err := sc.number()
+		if err != nil {
+			return 0, fmt.Errorf("sample %d: %w", n, err)
+		}
+		if !sc.consume(',') {
+			return 0, sc.errorf("sample %d: expected ','", n)
+		}
+		ts, err := sc.str()
+		if err != nil {
+			return 0, fmt.Errorf("sample %d: %w", n, err)
+		}
+		if !sc.consume(']') {
+			return 0, sc.errorf("sample %d: expected ']'", n)
 		}
-		// "2023-09-14 00:08:10.270215"
-		statTime, err := time.Parse("2006-01-02 15:04:05.999999", statTimestamp)
+		newer, err := timestampAfter(ts, latestTime)
 		if err != nil {
-			return 0, fmt.Errorf("could not parse time '%s': %w", statTimestamp, err)
+			return 0, fmt.Errorf("sample %d: %w", n, err)
+		}
+		if n == 0 || newer {
+			latest, latestTime = v, ts
+		}
+		n++
+	}
+	if n == 0 {
+		return 0, fmt.Errorf("no samples")
+	}
+	if _, err := time.Parse(keaTimeFormat, string(latestTime)); err != nil {
+		return 0, fmt.Errorf("could not parse time '%s': %w", latestTime, err)
+	}
+	return latest, nil
+}
+
+// timestampAfter reports whether Kea timestamp a is after b. Timestamps of
+// the same length compare correctly as strings; otherwise both are parsed.
+func timestampAfter(a, b []byte) (bool, error) {
+	if len(a) == len(b) || len(b) == 0 {
+		return bytes.Compare(a, b) > 0, nil
+	}
+	ta, err := time.Parse(keaTimeFormat, string(a))
+	if err != nil {
+		return false, fmt.Errorf("could not parse time '%s': %w", a, err)
+	}
+	tb, err := time.Parse(keaTimeFormat, string(b))
+	if err != nil {
+		return false, fmt.Errorf("could not parse time '%s': %w", b, err)
+	}
+	return ta.After(tb), nil
+}
+
+// sampleScanner is a minimal scanner for the JSON of Kea sample lists.
+type sampleScanner struct {
+	b   []byte
+	pos int
+}
+
+func (sc *sampleScanner) skipSpace() {
+	for sc.pos < len(sc.b) {
+		switch sc.b[sc.pos] {
+		case ' ', '\t', '\n', '\r':
+			sc.pos++
+		default:
+			return
+		}
+	}
+}
+
+// consume skips whitespace and then c, if it is next.
+func (sc *sampleScanner) consume(c byte) bool {
+	sc.skipSpace()
+	if sc.pos < len(sc.b) && sc.b[sc.pos] == c {
+		sc.pos++
+		return true
+	}
+	return false
+}
+
+func (sc *sampleScanner) number() (float64, error) {
+	sc.skipSpace()
+	start := sc.pos
+	for sc.pos < len(sc.b) {
+		c := sc.b[sc.pos]
+		if (c < '0' || c > '9') && c != '-' && c != '+' && c != '.' && c != 'e' && c != 'E' {
+			break
+		}
+		sc.pos++
+	}
+	if start == sc.pos {
+		return 0, sc.errorf("value is not a number")
+	}
+	v, err := strconv.ParseFloat(string(sc.b[start:sc.pos]), 64)
+	if err != nil {
+		return 0, sc.errorf("value is not a number")
+	}
+	return v, nil
+}
+
+// str returns the contents of a JSON string. Escape sequences are not
+// supported, as Kea timestamps never contain them.
+func (sc *sampleScanner) str() ([]byte, error) {
+	if !sc.consume('"') {
+		return nil, sc.errorf("timestamp is not a string")
+	}
+	start := sc.pos
+	for sc.pos < len(sc.b) {
+		switch sc.b[sc.pos] {
+		case '"':
+			sc.pos++
+			return sc.b[start : sc.pos-1], nil
+		case '\\':
+			return nil, sc.errorf("unexpected escape sequence in timestamp")
 		}
-		ml = append(ml, metric{statValue, statTime})
+		sc.pos++
 	}
-	sort.Slice(ml, func(i, j int) bool { return ml[i].t.After(ml[j].t) })
-	return ml[0].v, nil
+	return nil, sc.errorf("unterminated string")
 }
 
-type metric struct {
-	v float64
-	t time.Time
+func (sc *sampleScanner) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("%s at offset %d", fmt.Sprintf(format, args...), sc.pos)
+}
+
+func expectDelim(dec *json.Decoder, want json.Delim) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if tok != want {
+		return fmt.Errorf("expected '%v', got '%v'", want, tok)
+	}
+	return nil
+}
+
+func readKey(dec *json.Decoder) (string, error) {
+	tok, err := dec.Token()
+	if err != nil {
+		return "", err
+	}
+	key, ok := tok.(string)
+	if !ok {
+		return "", fmt.Errorf("expected an object key, got '%v'", tok)
+	}
+	return key, nil
 }
@@ -0,0 +1,422 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+var (
+	benchSubnetStats = []string{
+		"assigned-addresses",
+		"cumulative-assigned-addresses",
+		"declined-addresses",
+		"reclaimed-declined-addresses",
+		"reclaimed-leases",
+		"total-addresses",
+		"v4-reservation-conflicts",
+	}
+	benchPoolStats = []string{
+		"assigned-addresses",
+		"cumulative-assigned-addresses",
+		"declined-addresses",
+		"reclaimed-declined-addresses",
+		"reclaimed-leases",
+		"total-addresses",
+	}
+)
+
+// generateStats returns a statistic-get-all response for the given number of
+// subnets, with one pool each and samples samples per statistic, newest
+// first like Kea sends them.
+func generateStats(subnets, samples int) []byte {
+	var b strings.Builder
+	start := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	writeStat := func(name string, seed int) {
+		fmt.Fprintf(&b, "%q:[", name)
+		for s := 0; s < samples; s++ {
+			if s > 0 {
+				b.WriteByte(',')
+			}
+			ts := start.Add(-time.Duration(s) * 10 * time.Second).Format(keaTimeFormat)
+			fmt.Fprintf(&b, "[%d,%q]", seed+samples-s, ts)
+		}
+		b.WriteString("],")
+	}
+	b.WriteString(`{"arguments":{`)
+	writeStat("pkt4-received", 1000)
+	writeStat("pkt4-ack-sent", 500)
+	for sn := 1; sn <= subnets; sn++ {
+		for i, st := range benchSubnetStats {
+			writeStat(fmt.Sprintf("subnet[%d].%s", sn, st), sn*10+i)
+		}
+		for i, st := range benchPoolStats {
+			writeStat(fmt.Sprintf("subnet[%d].pool[0].%s", sn, st), sn*10+i)
+		}
+	}
+	s := strings.TrimSuffix(b.String(), ",")
+	return []byte(s + `},"result":0}`)
+}
+
+// parseStatsLegacy is the parser parseStats replaced: it unmarshals the whole
+// response and sorts all samples of every statistic. It is kept here to
+// compare results and performance.
+func parseStatsLegacy(rawJSON []byte) (*KeaCookedMetrics, error) {
+	var stats struct {
+		Arguments map[string]interface{} `json:"arguments"`
+	}
+	if err := json.Unmarshal(rawJSON, &stats); err != nil {
+		return nil, err
+	}
+	var cooked KeaCookedMetrics
+	cooked.SubnetMetrics = make(map[uint64]KeaSubnetMetrics)
+	for name, stat := range stats.Arguments {
+		ml, ok := stat.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("stat is not an []interface{}: %#v", stat)
+		}
+		val, err := legacyLatestMetricValue(ml)
+		if err != nil {
+			return nil, err
+		}
+		var known bool
+		if strings.HasPrefix(name, "subnet[") {
+			known, err = extractSubnetMetric(name, &cooked, val)
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			known = extractCookedMetrics(name, &cooked, val)
+		}
+		cooked.StatsSeen++
+		if known {
+			cooked.StatsExported++
+		}
+	}
+	return &cooked, nil
+}
+
+func legacyLatestMetricValue(metricsList []interface{}) (float64, error) {
+	type metric struct {
+		v float64
+		t time.Time
+	}
+	ml := make([]metric, 0, len(metricsList))
+	for _, metricEntry := range metricsList {
+		statPair := metricEntry.([]interface{})
+		statTime, err := time.Parse(keaTimeFormat, statPair[1].(string))
+		if err != nil {
+			return 0, err
+		}
+		ml = append(ml, metric{statPair[0].(float64), statTime})
+	}
+	sort.Slice(ml, func(i, j int) bool { return ml[i].t.After(ml[j].t) })
+	return ml[0].v, nil
+}
+
+func TestParseStatsMatchesLegacy(t *testing.T) {
+	raw := generateStats(50, 20)
+	got, err := parseStats(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatalf("parseStats: %v", err)
+	}
+	want, err := parseStatsLegacy(raw)
+	if err != nil {
+		t.Fatalf("parseStatsLegacy: %v", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseStats and parseStatsLegacy differ:\ngot  %+v\nwant %+v", got.SubnetMetrics[1], want.SubnetMetrics[1])
+	}
+	if got.Pkt4Received != 1020 {
+		t.Errorf("Pkt4Received = %v, want newest sample 1020", got.Pkt4Received)
+	}
+	if got.StatsSeen != 2+50*13 {
+		t.Errorf("StatsSeen = %d, want %d", got.StatsSeen, 2+50*13)
+	}
+}
+
+func TestParseStatsResult(t *testing.T) {
+	_, err := parseStats(strings.NewReader(`{"result": 1, "text": "unable to forward command"}`))
+	if err == nil || !strings.Contains(err.Error(), "unable to forward command") {
+		t.Errorf("parseStats of failed command: got error %v, want Kea's text", err)
+	}
+}
+
+var benchSink *KeaCookedMetrics
+
+// benchmarkParse parses a response of subnets subnets as it arrives through
+// a pipe in socket-sized chunks, so the memory reported is that of reading
+// and parsing it.
+func benchmarkParse(b *testing.B, parse func(io.Reader) (*KeaCookedMetrics, error), subnets int) {
+	raw := generateStats(subnets, 20)
+	b.SetBytes(int64(len(raw)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		pr, pw := io.Pipe()
+		go func() {
+			for rest := raw; len(rest) > 0; {
+				n := min(len(rest), 64<<10)
+				if _, err := pw.Write(rest[:n]); err != nil {
+					return
+				}
+				rest = rest[n:]
+			}
+			pw.Close()
+		}()
+		c, err := parse(pr)
+		pr.Close()
+		if err != nil {
+			b.Fatal(err)
+		}
+		benchSink = c
+	}
+}
+
+// readAndParseLegacy is how responses were handled before parseStats: read
+// in full, then parsed.
+func readAndParseLegacy(r io.Reader) (*KeaCookedMetrics, error) {
+	raw, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	return parseStatsLegacy(raw)
+}
+
+// Typical results (10k subnets, 20 samples each, 83 MB of JSON), reading
+// included:
+//
+//	BenchmarkParseStats10k        1.3s/op   16 MB/op    290k allocs/op
+//	BenchmarkParseStatsLegacy10k  6.3s/op  833 MB/op   22.5M allocs/op
+//
+// Most of what the streaming parser allocates is the result itself.
+func BenchmarkParseStats10k(b *testing.B) {
+	benchmarkParse(b, parseStats, 10000)
+}
+
+func BenchmarkParseStatsLegacy10k(b *testing.B) {
+	benchmarkParse(b, readAndParseLegacy, 10000)
+}
+
+func TestLatestSampleValue(t *testing.T) {
+	for _, tc := range []struct {
+		samples string
+		want    float64
+	}{
+		{`[[3, "2023-09-14 00:08:10.270215"], [2, "2023-09-14 00:07:10.270215"]]`, 3},
+		{`[[2, "2023-09-14 00:07:10.270215"], [3, "2023-09-14 00:08:10.270215"]]`, 3},
+		{`[ [ 1.5 , "2023-09-14 00:08:10.2" ] , [7, "2023-09-14 00:08:10.100001"] ]`, 1.5},
+	} {
+		got, err := latestSampleValue([]byte(tc.samples))
+		if err != nil {
+			t.Errorf("latestSampleValue(%s): %v", tc.samples, err)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("latestSampleValue(%s) = %v, want %v", tc.samples, got, tc.want)
+		}
+	}
+}
+
+// addFixtureSeeds adds the Kea responses for command from every
+// testdata/kea-<version> directory to the fuzz corpus.
+func addFixtureSeeds(f *testing.F, command string) {
+	paths, err := filepath.Glob(filepath.Join("testdata", "kea-*", command+".json"))
+	if err != nil {
+		f.Fatal(err)
+	}
+	features, err := filepath.Glob(filepath.Join("testdata", command+"-*.json"))
+	if err != nil {
+		f.Fatal(err)
+	}
+	paths = append(paths, features...)
+	if len(paths) == 0 {
+		f.Fatalf("no %s fixtures in testdata", command)
+	}
+	for _, p := range paths {
+		b, err := os.ReadFile(p)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(b)
+	}
+}
+
+func FuzzParseStats(f *testing.F) {
+	addFixtureSeeds(f, statsCommand)
+	for _, s := range []string{
+		`{"arguments": {}, "result": 0}`,
+		`{"arguments": null, "result": 0}`,
+		`{"result": 1, "text": "unable to forward command"}`,
+		`{"arguments": {"pkt4-received": []}, "result": 0}`,
+		`{"arguments": {"pkt4-received": [[]]}, "result": 0}`,
+		`{"arguments": {"pkt4-received": [[1]]}, "result": 0}`,
+		`{"arguments": {"pkt4-received": [["1", 2]]}, "result": 0}`,
+		`{"arguments": {"pkt4-received": [[1, "yesterday"]]}, "result": 0}`,
+		`{"arguments": {"subnet[1]": [[1, "2024-06-01 12:00:00.1"]]}, "result": 0}`,
+		`{"arguments": {"subnet[1].": [[1, "2024-06-01 12:00:00.1"]]}, "result": 0}`,
+		`{"arguments": {"subnet]1[.x": [[1, "2024-06-01 12:00:00.1"]]}, "result": 0}`,
+		`{"arguments": {"subnet[1].pool[": [[1, "2024-06-01 12:00:00.1"]]}, "result": 0}`,
+	} {
+		f.Add([]byte(s))
+	}
+	f.Fuzz(func(t *testing.T, raw []byte) {
+		cooked, err := parseStats(bytes.NewReader(raw))
+		if err != nil {
+			return
+		}
+		if cooked.StatsExported > cooked.StatsSeen {
+			t.Errorf("StatsExported %d > StatsSeen %d", cooked.StatsExported, cooked.StatsSeen)
+		}
+		for id, snm := range cooked.SubnetMetrics {
+			if snm.SubnetIndex != id {
+				t.Errorf("subnet %d stored under ID %d", snm.SubnetIndex, id)
+			}
+			for pid, pm := range snm.PoolMetrics {
+				if pm.PoolIndex != pid {
+					t.Errorf("pool %d of subnet %d stored under index %d", pm.PoolIndex, id, pid)
+				}
+			}
+		}
+	})
+}
+
+func FuzzParseMetricNameID(f *testing.F) {
+	for _, s := range []string{
+		"subnet[1].assigned-addresses",
+		"subnet[4294967295].pool[0].total-addresses",
+		"pool[3].declined-addresses",
+		"subnet[1]",
+		"subnet[1].",
+		"subnet[1]x",
+		"subnet]1[.x",
+		"subnet[].x",
+		"subnet[-1].x",
+		"[",
+		"",
+	} {
+		f.Add(s)
+	}
+	f.Fuzz(func(t *testing.T, name string) {
+		_, short, err := parseMetricNameID(name)
+		if err != nil {
+			return
+		}
+		if short == "" {
+			t.Errorf("parseMetricNameID(%q) returned an empty submetric name", name)
+		}
+		if !strings.HasSuffix(name, "]."+short) {
+			t.Errorf("parseMetricNameID(%q) = %q, which is not the rest of the name", name, short)
+		}
+	})
+}
+
+func TestParseMetricNameID(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		index     uint64
+		submetric string
+		wantErr   bool
+	}{
+		{name: "subnet[1].assigned-addresses", index: 1, submetric: "assigned-addresses"},
+		{name: "subnet[12].pool[0].total-addresses", index: 12, submetric: "pool[0].total-addresses"},
+		{name: "pool[3].declined-addresses", index: 3, submetric: "declined-addresses"},
+		{name: "subnet[1]", wantErr: true},
+		{name: "subnet[1].", wantErr: true},
+		{name: "subnet[1]x", wantErr: true},
+		{name: "subnet]1[.x", wantErr: true},
+		{name: "subnet[x].y", wantErr: true},
+		{name: "subnet", wantErr: true},
+	} {
+		index, submetric, err := parseMetricNameID(tc.name)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("parseMetricNameID(%q) = %d, %q, want an error", tc.name, index, submetric)
+			}
+			continue
+		}
+		if err != nil || index != tc.index || submetric != tc.submetric {
+			t.Errorf("parseMetricNameID(%q) = %d, %q, %v, want %d, %q", tc.name, index, submetric, err, tc.index, tc.submetric)
+		}
+	}
+}
+
+// TestParseStatsSampleOrder checks that the newest sample is found no matter
+// in which order Kea lists the samples.
+func TestParseStatsSampleOrder(t *testing.T) {
+	raw := generateStats(5, 10)
+	want, err := parseStats(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stats struct {
+		Arguments map[string][][2]any `json:"arguments"`
+	}
+	if err := json.Unmarshal(raw, &stats); err != nil {
+		t.Fatal(err)
+	}
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 20; i++ {
+		for _, samples := range stats.Arguments {
+			rnd.Shuffle(len(samples), func(i, j int) { samples[i], samples[j] = samples[j], samples[i] })
+		}
+		shuffled, err := json.Marshal(stats)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := parseStats(bytes.NewReader(shuffled))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("parseStats result depends on sample order")
+		}
+	}
+}
+
+func TestOpenKeaHTTP(t *testing.T) {
+	for _, tc := range []struct {
+		status  int
+		body    string
+		want    string
+		wantErr string
+	}{
+		{http.StatusOK, " \n[{\"result\": 0}, {\"result\": 1}]", `{"result": 0}`, ""},
+		{http.StatusOK, `{"result": 1}`, "", "want a list, got '{'"},
+		{http.StatusOK, "", "", "EOF"},
+		{http.StatusInternalServerError, "[]", "", "HTTP status 500"},
+	} {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			w.WriteHeader(tc.status)
+			io.WriteString(w, tc.body)
+		}))
+		r, err := openKeaHTTP(context.Background(), srv.URL, time.Second, keaCommand(statsCommand, "dhcp4"))
+		if tc.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("openKeaHTTP() of %q = %v, want an error containing %q", tc.body, err, tc.wantErr)
+			}
+		} else if err != nil {
+			t.Errorf("openKeaHTTP() of %q: %v", tc.body, err)
+		} else {
+			// A decoder reads the first response only.
+			var got json.RawMessage
+			if err := json.NewDecoder(r).Decode(&got); err != nil || string(got) != tc.want {
+				t.Errorf("first response of %q is %s, %v, want %s", tc.body, got, err, tc.want)
+			}
+			r.Close()
+		}
+		srv.Close()
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+const statusCommand = "status-get"
+
+type ParsedKeaStatus struct {
+	Result    int       `json:"result"`
+	Text      string    `json:"text"`
+	KeaStatus KeaStatus `json:"arguments"`
+}
+
+// KeaStatus is the part of the status-get response GKSE uses. Uptime is the
+// number of seconds since the server started.
+type KeaStatus struct {
+	PID    int     `json:"pid"`
+	Uptime float64 `json:"uptime"`
+}
+
+// startTime returns when the server started, as of now.
+func (s KeaStatus) startTime(now time.Time) time.Time {
+	return now.Add(-time.Duration(s.Uptime * float64(time.Second)))
+}
+
+// queryStatus runs status-get on the target. Kea supports it since 1.7.3.
+func queryStatus(ctx context.Context, t TargetConfig) (*KeaStatus, error) {
+	rawJSON, err := queryKea(ctx, t, statusCommand)
+	if err != nil {
+		return nil, fmt.Errorf("could not query Kea for status: %w", err)
+	}
+	keaBytesRead.WithLabelValues(t.Name, statusCommand).Add(float64(len(rawJSON)))
+	var pks ParsedKeaStatus
+	if err := json.Unmarshal(rawJSON, &pks); err != nil {
+		return nil, fmt.Errorf("could not parse Kea status: %w", err)
+	}
+	if pks.Result != 0 {
+		return nil, fmt.Errorf("Kea returned result %d: %s", pks.Result, pks.Text)
+	}
+	return &pks.KeaStatus, nil
+}
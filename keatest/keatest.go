@@ -0,0 +1,292 @@
+// Package keatest provides a fake Kea server for tests. It answers Kea
+// commands on a unix control socket and, like the Kea Control Agent, over
+// HTTP, from scripted responses that can inject failures.
+package keatest
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Fault is a failure to inject instead of, or while, sending a response.
+type Fault int
+
+const (
+	// NoFault sends the response as is.
+	NoFault Fault = iota
+	// PartialWrite sends the first half of the response, then closes the
+	// connection.
+	PartialWrite
+	// Stall sends nothing and keeps the connection open until the client
+	// gives up or the server is closed.
+	Stall
+	// Reset closes the connection without sending anything. On TCP
+	// connections, this sends a RST.
+	Reset
+)
+
+// Response is one scripted answer to a command.
+type Response struct {
+	Body  []byte
+	Fault Fault
+	// Delay is waited before the response is sent.
+	Delay time.Duration
+}
+
+// JSON returns a response with the given body.
+func JSON(body string) Response {
+	return Response{Body: []byte(body)}
+}
+
+// File returns a response with the contents of path as body. It fails the
+// test if the file can not be read.
+func File(t testing.TB, path string) Response {
+	t.Helper()
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("keatest: %v", err)
+	}
+	return Response{Body: b}
+}
+
+// Result returns a response with the given result code and text, as Kea
+// sends for failed commands.
+func Result(code int, text string) Response {
+	b, _ := json.Marshal(struct {
+		Result int    `json:"result"`
+		Text   string `json:"text"`
+	}{code, text})
+	return Response{Body: b}
+}
+
+// Malformed returns a response that is not valid JSON.
+func Malformed() Response {
+	return JSON(`{"arguments": {"pkt4-received": [[1, "2024-06-01 12:00:00.000000"]`)
+}
+
+// Server is a fake Kea server. Create it with NewServer.
+type Server struct {
+	// SocketPath is the path of the unix control socket.
+	SocketPath string
+	// URL is the URL of the fake Control Agent.
+	URL string
+
+	t    testing.TB
+	ln   net.Listener
+	http *httptest.Server
+	done chan struct{}
+	wg   sync.WaitGroup
+
+	mu        sync.Mutex
+	scripts   map[string][]Response
+	requests  map[string]int
+	lastQuery map[string]any
+}
+
+// NewServer starts a fake Kea server. It is shut down when the test ends.
+func NewServer(t testing.TB) *Server {
+	t.Helper()
+	// Unix socket paths are limited in length, so t.TempDir can be too
+	// long.
+	dir, err := os.MkdirTemp("", "keatest")
+	if err != nil {
+		t.Fatalf("keatest: %v", err)
+	}
+	s := &Server{
+		SocketPath: filepath.Join(dir, "kea4-ctrl-socket"),
+		t:          t,
+		done:       make(chan struct{}),
+		scripts:    make(map[string][]Response),
+		requests:   make(map[string]int),
+		lastQuery:  make(map[string]any),
+	}
+	s.ln, err = net.Listen("unix", s.SocketPath)
+	if err != nil {
+		t.Fatalf("keatest: %v", err)
+	}
+	s.http = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	s.URL = s.http.URL
+	s.wg.Add(1)
+	go s.acceptLoop()
+	t.Cleanup(func() {
+		close(s.done)
+		s.ln.Close()
+		s.http.CloseClientConnections()
+		s.http.Close()
+		s.wg.Wait()
+		os.RemoveAll(dir)
+	})
+	return s
+}
+
+// Handle scripts the responses to command. Each request gets the next
+// response; once all are used up, the last one is repeated.
+func (s *Server) Handle(command string, responses ...Response) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.scripts[command] = responses
+}
+
+// HandleService scripts the responses to command when sent to service
+// through the Control Agent. They take precedence over those set with Handle.
+func (s *Server) HandleService(service, command string, responses ...Response) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.scripts[service+"/"+command] = responses
+}
+
+// Requests returns how often command has been received.
+func (s *Server) Requests(command string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests[command]
+}
+
+// LastRequest returns the last request received for command, decoded from
+// JSON.
+func (s *Server) LastRequest(command string) map[string]any {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	q, _ := s.lastQuery[command].(map[string]any)
+	return q
+}
+
+func (s *Server) next(req map[string]any) Response {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	command, _ := req["command"].(string)
+	n := s.requests[command]
+	s.requests[command]++
+	s.lastQuery[command] = req
+	script, ok := s.scripts[command]
+	if service, _ := req["service"].([]any); len(service) > 0 {
+		name, _ := service[0].(string)
+		if ss, found := s.scripts[name+"/"+command]; found {
+			script, ok = ss, true
+		}
+	}
+	if !ok || len(script) == 0 {
+		return Result(2, "'"+command+"' command not supported.")
+	}
+	if n >= len(script) {
+		n = len(script) - 1
+	}
+	return script[n]
+}
+
+func (s *Server) acceptLoop() {
+	defer s.wg.Done()
+	for {
+		c, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			defer c.Close()
+			s.serveConn(c)
+		}()
+	}
+}
+
+func (s *Server) serveConn(c net.Conn) {
+	var req map[string]any
+	if err := json.NewDecoder(c).Decode(&req); err != nil {
+		s.t.Logf("keatest: could not decode request: %v", err)
+		return
+	}
+	resp := s.next(req)
+	if !s.wait(resp.Delay) {
+		return
+	}
+	switch resp.Fault {
+	case PartialWrite:
+		c.Write(resp.Body[:len(resp.Body)/2])
+	case Stall:
+		s.stall(c, nil)
+	case Reset:
+		// Nothing to do, the deferred Close is all a unix socket
+		// client sees.
+	default:
+		c.Write(resp.Body)
+	}
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	var req map[string]any
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	resp := s.next(req)
+	if !s.wait(resp.Delay) {
+		return
+	}
+	// The Control Agent answers with one response per service.
+	body := append(append([]byte("["), resp.Body...), ']')
+	switch resp.Fault {
+	case PartialWrite:
+		w.Header().Set("Content-Length", "1000000")
+		w.Write(body[:len(body)/2])
+		// Returning early makes the server close the connection as
+		// the announced length has not been written.
+	case Stall:
+		s.stall(nil, r.Context().Done())
+	case Reset:
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			s.t.Errorf("keatest: %v", err)
+			return
+		}
+		if tc, ok := conn.(*net.TCPConn); ok {
+			tc.SetLinger(0)
+		}
+		conn.Close()
+	default:
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(body)
+	}
+}
+
+// wait waits for d, returning false if the server is shut down first.
+func (s *Server) wait(d time.Duration) bool {
+	if d <= 0 {
+		return true
+	}
+	select {
+	case <-time.After(d):
+		return true
+	case <-s.done:
+		return false
+	}
+}
+
+// stall blocks until the client closes c (if c is not nil), gone is closed or
+// the server is shut down.
+func (s *Server) stall(c net.Conn, gone <-chan struct{}) {
+	closed := make(chan struct{})
+	if c != nil {
+		go func() {
+			buf := make([]byte, 1)
+			for {
+				if _, err := c.Read(buf); err != nil {
+					close(closed)
+					return
+				}
+			}
+		}()
+	}
+	select {
+	case <-closed:
+	case <-gone:
+	case <-s.done:
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"slices"
+	"strings"
+	"text/tabwriter"
+)
+
+// Checks done by lintConfig. The last two need statistics.
+const (
+	checkInvalidPool        = "invalid_pool"
+	checkPoolOutsideSubnet  = "pool_outside_subnet"
+	checkPoolOverlap        = "pool_overlap"
+	checkReservationInPool  = "reservation_in_pool"
+	checkSubnetWithoutPools = "subnet_without_pools"
+	checkSubnetWithoutStats = "subnet_without_stats"
+	checkStatsWithoutSubnet = "stats_without_subnet"
+)
+
+// lintIssue is a problem found in the Kea configuration. Subnet is the prefix
+// of the subnet it concerns, or "unknown" for statistics of a subnet missing
+// from the configuration.
+type lintIssue struct {
+	Check   string
+	Subnet  string
+	Message string
+}
+
+// addrRange is an inclusive range of addresses.
+type addrRange struct {
+	first, last netip.Addr
+}
+
+func (r addrRange) contains(a netip.Addr) bool {
+	return r.first.Compare(a) <= 0 && a.Compare(r.last) <= 0
+}
+
+// parsePool parses a Kea pool, which is either a range "first - last" or a
+// prefix.
+func parsePool(s string) (addrRange, error) {
+	if first, last, ok := strings.Cut(s, "-"); ok {
+		f, err := netip.ParseAddr(strings.TrimSpace(first))
+		if err != nil {
+			return addrRange{}, err
+		}
+		l, err := netip.ParseAddr(strings.TrimSpace(last))
+		if err != nil {
+			return addrRange{}, err
+		}
+		if f.BitLen() != l.BitLen() || l.Less(f) {
+			return addrRange{}, fmt.Errorf("'%s' is not a range of addresses", s)
+		}
+		return addrRange{f, l}, nil
+	}
+	p, err := netip.ParsePrefix(strings.TrimSpace(s))
+	if err != nil {
+		return addrRange{}, err
+	}
+	return prefixRange(p), nil
+}
+
+// prefixRange returns the addresses of p.
+func prefixRange(p netip.Prefix) addrRange {
+	p = p.Masked()
+	last := p.Addr().AsSlice()
+	for i := p.Bits(); i < len(last)*8; i++ {
+		last[i/8] |= 0x80 >> (i % 8)
+	}
+	l, _ := netip.AddrFromSlice(last)
+	return addrRange{p.Addr(), l}
+}
+
+// lintConfig checks the subnets in c. If m is not nil, the subnets are also
+// compared to those that have statistics. Issues are ordered by subnet ID,
+// followed by overlapping pools and statistics of unconfigured subnets.
+func lintConfig(c *KeaConfig, m *KeaCookedMetrics) []lintIssue {
+	type pool struct {
+		subnetID uint64
+		subnet   string
+		index    int
+		addrRange
+	}
+	var issues []lintIssue
+	var pools []pool
+	for _, id := range sortedKeys(c.Dhcp4.SubnetConfigs) {
+		sn := c.Dhcp4.SubnetConfigs[id]
+		subnetRange := addrRange{}
+		if p, err := netip.ParsePrefix(sn.Netname); err == nil {
+			subnetRange = prefixRange(p)
+		}
+		if len(sn.Pools) == 0 {
+			issues = append(issues, lintIssue{checkSubnetWithoutPools, sn.Netname, fmt.Sprintf("subnet %d has no pools", id)})
+		}
+		var ranges []addrRange
+		for i, p := range sn.Pools {
+			r, err := parsePool(p.Pool)
+			if err != nil {
+				issues = append(issues, lintIssue{checkInvalidPool, sn.Netname, fmt.Sprintf("pool %d of subnet %d: %v", i, id, err)})
+				continue
+			}
+			if subnetRange.first.IsValid() && (!subnetRange.contains(r.first) || !subnetRange.contains(r.last)) {
+				issues = append(issues, lintIssue{checkPoolOutsideSubnet, sn.Netname, fmt.Sprintf("pool %d (%s) of subnet %d is not inside %s", i, p.Pool, id, sn.Netname)})
+			}
+			ranges = append(ranges, r)
+			pools = append(pools, pool{id, sn.Netname, i, r})
+		}
+		for _, rsv := range sn.Reservations {
+			a, err := netip.ParseAddr(rsv.IPAddress)
+			if err != nil {
+				continue
+			}
+			if slices.ContainsFunc(ranges, func(r addrRange) bool { return r.contains(a) }) {
+				host := cmp.Or(rsv.Hostname, rsv.HWAddress, rsv.ClientID)
+				issues = append(issues, lintIssue{checkReservationInPool, sn.Netname, fmt.Sprintf("reservation of %s for %s is inside a pool of subnet %d", rsv.IPAddress, host, id)})
+			}
+		}
+		if m == nil {
+			continue
+		}
+		if _, ok := m.SubnetMetrics[id]; !ok {
+			issues = append(issues, lintIssue{checkSubnetWithoutStats, sn.Netname, fmt.Sprintf("subnet %d has no statistics", id)})
+		}
+	}
+
+	// Pools overlap if one starts before an earlier starting one ends.
+	slices.SortStableFunc(pools, func(a, b pool) int { return a.first.Compare(b.first) })
+	for i, a := range pools {
+		for _, b := range pools[i+1:] {
+			if a.last.Less(b.first) {
+				break
+			}
+			if a.first.BitLen() != b.first.BitLen() {
+				continue
+			}
+			issues = append(issues, lintIssue{checkPoolOverlap, b.subnet, fmt.Sprintf("pool %d of subnet %d overlaps pool %d of subnet %d", b.index, b.subnetID, a.index, a.subnetID)})
+		}
+	}
+
+	if m != nil {
+		for _, id := range sortedKeys(m.SubnetMetrics) {
+			if _, ok := c.Dhcp4.SubnetConfigs[id]; !ok {
+				issues = append(issues, lintIssue{checkStatsWithoutSubnet, "unknown", fmt.Sprintf("subnet %d has statistics, but is not configured", id)})
+			}
+		}
+	}
+	return issues
+}
+
+// runLint checks the Kea configuration of every target, and exits with 1 if
+// it finds issues.
+func runLint(cfg *Config) int {
+	n, err := lint(context.Background(), cfg, os.Stdout)
+	if err != nil {
+		logger.Error("Could not check Kea configuration", "error", err)
+		return 2
+	}
+	if n > 0 {
+		return 1
+	}
+	return 0
+}
+
+// lint writes the issues found in the configuration of every target to w, if
+// there are any, and returns their number. Targets that only have a
+// configuration file are checked without statistics.
+func lint(ctx context.Context, cfg *Config, w io.Writer) (int, error) {
+	ctx = newScrapeContext(ctx)
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	n := 0
+	var errs []error
+	for _, t := range cfg.Targets {
+		var c *KeaConfig
+		var m *KeaCookedMetrics
+		var err error
+		if t.ConfigFile != "" && t.StatsFile == "" {
+			c, err = queryConfig(ctx, t)
+		} else {
+			var snap *keaSnapshot
+			if snap, err = takeSnapshot(ctx, t); err == nil {
+				c, m = snap.Config, snap.Metrics
+			}
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("target '%s': %w", t.Name, err))
+			continue
+		}
+		for _, is := range lintConfig(c, m) {
+			if n == 0 {
+				fmt.Fprintln(tw, "TARGET\tCHECK\tSUBNET\tISSUE")
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", t.Name, is.Check, is.Subnet, is.Message)
+			n++
+		}
+	}
+	if err := tw.Flush(); err != nil {
+		errs = append(errs, err)
+	}
+	return n, errors.Join(errs...)
+}
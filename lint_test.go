@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"pkg.i-no.de/pkg/gkse/keatest"
+)
+
+// lintTestConfig has one issue of every check that works without
+// statistics.
+const lintTestConfig = `{"result": 0, "arguments": {"Dhcp4": {
+	"subnet4": [
+		{"id": 1, "subnet": "192.0.2.0/24", "pools": [{"pool": "192.0.2.10 - 192.0.2.100"}],
+			"reservations": [{"hw-address": "aa:bb:cc:dd:ee:ff", "ip-address": "192.0.2.50"}, {"hostname": "printer", "ip-address": "192.0.2.5"}]},
+		{"id": 2, "subnet": "198.51.100.0/24", "pools": [{"pool": "198.51.100.0/25"}, {"pool": "198.51.100.200-198.51.101.10"}]},
+		{"id": 4, "subnet": "192.0.2.64/26", "pools": [{"pool": "192.0.2.64/27"}, {"pool": "banana"}]}],
+	"shared-networks": [{"name": "lab", "subnet4": [{"id": 3, "subnet": "203.0.113.0/25"}]}]}}}`
+
+func TestLintConfig(t *testing.T) {
+	c, err := fromJSON([]byte(lintTestConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &KeaCookedMetrics{SubnetMetrics: map[uint64]KeaSubnetMetrics{1: {}, 2: {}, 3: {}, 7: {}}}
+	want := []lintIssue{
+		{checkReservationInPool, "192.0.2.0/24", "reservation of 192.0.2.50 for aa:bb:cc:dd:ee:ff is inside a pool of subnet 1"},
+		{checkPoolOutsideSubnet, "198.51.100.0/24", "pool 1 (198.51.100.200-198.51.101.10) of subnet 2 is not inside 198.51.100.0/24"},
+		{checkSubnetWithoutPools, "203.0.113.0/25", "subnet 3 has no pools"},
+		{checkInvalidPool, "192.0.2.64/26", `pool 1 of subnet 4: netip.ParsePrefix("banana"): no '/'`},
+		{checkSubnetWithoutStats, "192.0.2.64/26", "subnet 4 has no statistics"},
+		{checkPoolOverlap, "192.0.2.64/26", "pool 0 of subnet 4 overlaps pool 0 of subnet 1"},
+		{checkStatsWithoutSubnet, "unknown", "subnet 7 has statistics, but is not configured"},
+	}
+	got := lintConfig(c, m)
+	if len(got) != len(want) {
+		t.Errorf("got %d issues, want %d: %v", len(got), len(want), got)
+	}
+	for i := range min(len(got), len(want)) {
+		if got[i] != want[i] {
+			t.Errorf("issue %d is %+v, want %+v", i, got[i], want[i])
+		}
+	}
+
+	// Without statistics, only the configuration is checked.
+	for _, is := range lintConfig(c, nil) {
+		if is.Check == checkSubnetWithoutStats || is.Check == checkStatsWithoutSubnet {
+			t.Errorf("got %+v without statistics", is)
+		}
+	}
+}
+
+func TestParsePool(t *testing.T) {
+	for in, want := range map[string]string{
+		"192.0.2.0/24":     "192.0.2.0 - 192.0.2.255",
+		"192.0.2.77/26":    "192.0.2.64 - 192.0.2.127",
+		"192.0.2.1/32":     "192.0.2.1 - 192.0.2.1",
+		"2001:db8::/64":    "2001:db8:: - 2001:db8::ffff:ffff:ffff:ffff",
+		"198.51.100.0/23":  "198.51.100.0 - 198.51.101.255",
+		"203.0.113.128/25": "203.0.113.128 - 203.0.113.255",
+	} {
+		r, err := parsePool(in)
+		if err != nil {
+			t.Errorf("parsePool(%q): %v", in, err)
+			continue
+		}
+		if got := r.first.String() + " - " + r.last.String(); got != want {
+			t.Errorf("parsePool(%q) = %s, want %s", in, got, want)
+		}
+	}
+	for _, in := range []string{"192.0.2.10 - 192.0.2.1", "192.0.2.1 - 2001:db8::1", "192.0.2.0/33"} {
+		if _, err := parsePool(in); err == nil {
+			t.Errorf("parsePool(%q) succeeded, want an error", in)
+		}
+	}
+}
+
+func TestLintCommand(t *testing.T) {
+	dir := t.TempDir()
+	bad := filepath.Join(dir, "bad.json")
+	if err := os.WriteFile(bad, []byte(lintTestConfig), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	// A Kea configuration file, as given with -c, with comments.
+	commented := filepath.Join(dir, "kea-dhcp4.conf")
+	if err := os.WriteFile(commented, []byte(`{
+# The DHCPv4 server
+"Dhcp4": {
+	// Pools are given as "first - last" or prefixes, like "192.0.2.0/25".
+	"subnet4": [{"id": 1, "subnet": "192.0.2.0/24", /* no pools */ "user-context": {"url": "http://wiki/#dhcp"}}]
+}
+}
+`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cfg := defaultConfig()
+	cfg.Targets = []TargetConfig{
+		{Name: "good", ConfigFile: filepath.Join("testdata", "kea-2.6", "config-get.json")},
+		{Name: "bad", ConfigFile: bad},
+		{Name: "commented", ConfigFile: commented},
+	}
+	var b strings.Builder
+	n, err := lint(context.Background(), cfg, &b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The statistics checks need a Kea server.
+	if n != 6 {
+		t.Errorf("lint found %d issues, want 6:\n%s", n, b.String())
+	}
+	if want := "commented  subnet_without_pools  192.0.2.0/24     subnet 1 has no pools\n"; !strings.HasSuffix(b.String(), want) {
+		t.Errorf("lint output does not end in %q:\n%s", want, b.String())
+	}
+	if !strings.HasPrefix(b.String(), "TARGET") || strings.Contains(b.String(), "good") {
+		t.Errorf("lint output has no header, or issues of the good target:\n%s", b.String())
+	}
+
+	cfg.Targets = cfg.Targets[:1]
+	b.Reset()
+	if n, err := lint(context.Background(), cfg, &b); n != 0 || err != nil || b.Len() != 0 {
+		t.Errorf("lint of a good configuration = %d, %v, output %q, want 0, nil and none", n, err, b.String())
+	}
+}
+
+func TestMetricsConfigIssues(t *testing.T) {
+	kea := keatest.NewServer(t)
+	kea.Handle(statsCommand, keatest.File(t, filepath.Join("testdata", "kea-2.6", "statistic-get-all.json")))
+	kea.Handle(configCommand, keatest.JSON(lintTestConfig))
+	url := newTestExporter(t, TargetConfig{Name: "dhcp1", Socket: kea.SocketPath, Timeout: time.Second})
+	got := scrapeKeaMetrics(t, url)
+	for _, want := range []string{
+		`kea_config_issues{check="pool_overlap",subnet="192.0.2.64/26"} 1`,
+		`kea_config_issues{check="subnet_without_pools",subnet="203.0.113.0/25"} 1`,
+		`kea_config_issues{check="subnet_without_stats",subnet="192.0.2.64/26"} 1`,
+	} {
+		if !strings.Contains(got, want+"\n") {
+			t.Errorf("/metrics has no line %s", want)
+		}
+	}
+}
@@ -1,19 +1,93 @@
 package main
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"flag"
+	"fmt"
 	"io"
 	"log/slog"
+	"strings"
 
 	"github.com/lmittmann/tint"
 )
 
-func logSetup(w io.Writer, level slog.Level, timefmt string, color bool) *slog.Logger {
-	logger := slog.New(
-		tint.NewHandler(w, &tint.Options{
+var (
+	logLevelFlag  = flag.String("log.level", "info", "Log level: debug, info, warn or error")
+	logFormatFlag = flag.String("log.format", "text", "Log format: text, json, logfmt or journald")
+
+	// logLevel is shared by all handlers, so the level can be changed on
+	// configuration reload.
+	logLevel = new(slog.LevelVar)
+)
+
+var logFormats = []string{"text", "json", "logfmt", "journald"}
+
+func logSetup(w io.Writer, level slog.Leveler, format, timefmt string, color bool) (*slog.Logger, error) {
+	var h slog.Handler
+	switch format {
+	case "text":
+		h = tint.NewHandler(w, &tint.Options{
 			NoColor:    !color,
 			TimeFormat: timefmt,
 			Level:      level,
-		}),
-	)
-	return logger
+		})
+	case "json":
+		h = slog.NewJSONHandler(w, &slog.HandlerOptions{Level: level})
+	case "logfmt":
+		h = slog.NewTextHandler(w, &slog.HandlerOptions{Level: level})
+	case "journald":
+		jh, err := newJournaldHandler(level)
+		if err != nil {
+			return nil, err
+		}
+		h = jh
+	default:
+		return nil, fmt.Errorf("unknown log format '%s', want one of %s", format, strings.Join(logFormats, ", "))
+	}
+	return slog.New(contextHandler{h}), nil
+}
+
+func parseLogLevel(s string) (slog.Level, error) {
+	var l slog.Level
+	err := l.UnmarshalText([]byte(s))
+	return l, err
+}
+
+type scrapeIDKey struct{}
+
+// newScrapeContext returns a context carrying a fresh scrape ID. Log records
+// emitted with this context (or one derived from it) carry the ID as the
+// scrape_id attribute.
+func newScrapeContext(ctx context.Context) context.Context {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return context.WithValue(ctx, scrapeIDKey{}, hex.EncodeToString(b))
+}
+
+func scrapeID(ctx context.Context) string {
+	id, _ := ctx.Value(scrapeIDKey{}).(string)
+	return id
+}
+
+// contextHandler adds the scrape ID from the context of a log call to the
+// record.
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, r slog.Record) error {
+	if id := scrapeID(ctx); id != "" {
+		r.AddAttrs(slog.String("scrape_id", id))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
 }
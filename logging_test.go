@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLogSetup(t *testing.T) {
+	ctx := context.WithValue(context.Background(), scrapeIDKey{}, "0123456789abcdef")
+	for _, tc := range []struct {
+		format string
+		want   string
+	}{
+		{"text", "INF Scraped target=dhcp1 scrape_id=0123456789abcdef\n"},
+		{"logfmt", "level=INFO msg=Scraped target=dhcp1 scrape_id=0123456789abcdef\n"},
+		{"json", `"level":"INFO","msg":"Scraped","target":"dhcp1","scrape_id":"0123456789abcdef"}` + "\n"},
+	} {
+		t.Run(tc.format, func(t *testing.T) {
+			var b bytes.Buffer
+			l, err := logSetup(&b, slog.LevelInfo, tc.format, "", false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			l.DebugContext(ctx, "Not logged")
+			l.InfoContext(ctx, "Scraped", "target", "dhcp1")
+			if !strings.HasSuffix(b.String(), tc.want) || strings.Count(b.String(), "\n") != 1 {
+				t.Errorf("logged %q, want one line ending in %q", b.String(), tc.want)
+			}
+			if tc.format == "json" && !json.Valid(b.Bytes()) {
+				t.Errorf("logged invalid JSON %q", b.String())
+			}
+		})
+	}
+
+	l, err := logSetup(os.Stderr, slog.LevelInfo, "xml", "", false)
+	if l != nil || err == nil || err.Error() != "unknown log format 'xml', want one of text, json, logfmt, journald" {
+		t.Errorf("logSetup() of an unknown format = %v, %v", l, err)
+	}
+	if _, err := os.Stat(journaldSocket); err != nil {
+		l, err := logSetup(os.Stderr, slog.LevelInfo, "journald", "", false)
+		if l != nil || err == nil || !strings.HasPrefix(err.Error(), "could not connect to journald: ") {
+			t.Errorf("logSetup() of journald without its socket = %v, %v", l, err)
+		}
+	}
+}
+
+func TestParseLogLevel(t *testing.T) {
+	for in, want := range map[string]slog.Level{
+		"debug": slog.LevelDebug,
+		"info":  slog.LevelInfo,
+		"WARN":  slog.LevelWarn,
+		"error": slog.LevelError,
+	} {
+		if got, err := parseLogLevel(in); err != nil || got != want {
+			t.Errorf("parseLogLevel(%q) = %v, %v, want %v", in, got, err, want)
+		}
+	}
+	if _, err := parseLogLevel("verbose"); err == nil {
+		t.Error("parseLogLevel(\"verbose\") succeeded")
+	}
+}
+
+func TestContextHandler(t *testing.T) {
+	var b bytes.Buffer
+	l := slog.New(contextHandler{slog.NewTextHandler(&b, nil)})
+	ctx := newScrapeContext(context.Background())
+	id := scrapeID(ctx)
+	if len(id) != 16 {
+		t.Fatalf("scrape ID %q, want 16 hex digits", id)
+	}
+	if other := scrapeID(newScrapeContext(context.Background())); other == id {
+		t.Errorf("two scrape contexts have the same ID %s", id)
+	}
+
+	// The ID is kept by derived loggers and contexts, and is not added
+	// without one.
+	derived, cancel := context.WithCancel(ctx)
+	defer cancel()
+	l.With("target", "dhcp1").WithGroup("g").InfoContext(derived, "Scraped", "n", 1)
+	l.Info("No scrape")
+	want := "msg=Scraped target=dhcp1 g.n=1 g.scrape_id=" + id + "\n"
+	lines := strings.SplitAfter(b.String(), "\n")
+	if !strings.HasSuffix(lines[0], want) {
+		t.Errorf("logged %q, want it to end in %q", lines[0], want)
+	}
+	if strings.Contains(lines[1], "scrape_id") {
+		t.Errorf("logged %q without a scrape context", lines[1])
+	}
+}
+
+func TestJournaldHandler(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal.sock")
+	srv, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	l := slog.New(&journaldHandler{conn: conn, level: slog.LevelInfo})
+
+	l.Debug("Not logged")
+	l.With("target", "dhcp1").WithGroup("kea").Warn("Query failed", "error", "line 1\nline 2", slog.Group("resp", "bytes", 42), "2xx", 0)
+	buf := make([]byte, 4096)
+	n, err := srv.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want bytes.Buffer
+	want.WriteString("MESSAGE=Query failed\nPRIORITY=4\nSYSLOG_IDENTIFIER=gkse\nTARGET=dhcp1\n")
+	// Values with newlines have their length in front.
+	want.WriteString("KEA_ERROR\n")
+	binary.Write(&want, binary.LittleEndian, uint64(len("line 1\nline 2")))
+	want.WriteString("line 1\nline 2\n")
+	want.WriteString("KEA_RESP_BYTES=42\nKEA_2XX=0\n")
+	if got := buf[:n]; !bytes.Equal(got, want.Bytes()) {
+		t.Errorf("sent\n%q\nwant\n%q", got, want.Bytes())
+	}
+}
+
+func TestJournalFieldName(t *testing.T) {
+	for key, want := range map[string]string{
+		"target":     "TARGET",
+		"scrape_id":  "SCRAPE_ID",
+		"subnet.idx": "SUBNET_IDX",
+		"_private":   "PRIVATE",
+		"2xx":        "X2XX",
+		"___":        "X",
+		"Grüße":      "GR__E",
+	} {
+		if got := journalFieldName(key); got != want {
+			t.Errorf("journalFieldName(%q) = %q, want %q", key, got, want)
+		}
+	}
+	for l, want := range map[slog.Level]string{
+		slog.LevelDebug: "7",
+		slog.LevelInfo:  "6",
+		slog.LevelWarn:  "4",
+		slog.LevelError: "3",
+	} {
+		if got := journalPriority(l); got != want {
+			t.Errorf("journalPriority(%v) = %s, want %s", l, got, want)
+		}
+	}
+}
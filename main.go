@@ -19,40 +19,221 @@ package main
 */
 
 import (
+	"context"
 	"flag"
+	"fmt"
 	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
+	"reflect"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
-const version = "0.1.0"
+const (
+	version       = "0.1.0"
+	logTimeFormat = "20060102-15:04:05.000"
+)
 
 var (
-	listen   = flag.String("l", ":9988", "IP:port to listen on")
+	listen   = stringListFlag("l", []string{":9988"}, "IP:port or unix:/path/to/socket to listen on, may be given multiple times")
 	timeout  = flag.Duration("timeout", time.Second*3, "Timeout for webserver reading client request")
 	logColor = flag.Bool("cl", false, "Enable color in logs")
 
 	logger *slog.Logger
 )
 
+// subcommands maps the names accepted as the first argument to their
+// implementations. Without a subcommand, gkse runs serve.
+var subcommands = map[string]func(cfg *Config) int{
+	"serve":     runServe,
+	"dump":      runDump,
+	"textfile":  runTextfile,
+	"push":      runPush,
+	"rules":     runRules,
+	"dashboard": runGrafanaDashboard,
+	"lint":      runLint,
+}
+
 func main() {
-	flag.Parse()
-	logger = logSetup(os.Stderr, slog.LevelInfo, "20060102-15:04:05.000", *logColor)
+	flag.Usage = usage
+	cmd := "serve"
+	args := os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		cmd, args = args[0], args[1:]
+	}
+	run, ok := subcommands[cmd]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Unknown subcommand '%s'\n", cmd)
+		flag.Usage()
+		os.Exit(2)
+	}
+	flag.CommandLine.Parse(args)
+	if flag.NArg() > 0 {
+		// The subcommand must come first, so "gkse -log.level=debug dump"
+		// does not start the server.
+		fmt.Fprintf(os.Stderr, "Unexpected arguments after the flags: %s\n", strings.Join(flag.Args(), " "))
+		flag.Usage()
+		os.Exit(2)
+	}
+	// Until the configuration is loaded, log with the defaults.
+	logger, _ = logSetup(os.Stderr, slog.LevelInfo, "text", logTimeFormat, *logColor)
+
+	cfg, err := loadConfig(*configFile)
+	if err != nil {
+		logger.Error("Could not load configuration", "error", err)
+		os.Exit(1)
+	}
+	currentCfg.Store(cfg)
+	level, _ := parseLogLevel(cfg.Log.Level)
+	logLevel.Set(level)
+	l, err := logSetup(os.Stderr, logLevel, cfg.Log.Format, logTimeFormat, cfg.Log.Color)
+	if err != nil {
+		// Still the logger with the defaults.
+		logger.Error("Could not set up logging", "error", err)
+		os.Exit(1)
+	}
+	logger = l
+	os.Exit(run(cfg))
+}
+
+func usage() {
+	fmt.Fprintf(flag.CommandLine.Output(), `Usage: %s [serve|dump|textfile|push|rules|dashboard|lint] [flags]
+
+Subcommands:
+  serve     Run the exporter (default)
+  dump      Query Kea once and print subnet and pool utilization
+  textfile  Periodically write metrics to a file for the node_exporter textfile collector
+  push      Periodically push metrics to a Pushgateway, remote-write, OTLP, InfluxDB or Graphite endpoint
+  rules     Print Prometheus recording and alerting rules for the subnets in the Kea configuration
+  dashboard Print a Grafana dashboard for the exported metrics
+  lint      Check the Kea configuration for mistakes; exits with 1 if any are found
+
+Flags:
+`, os.Args[0])
+	flag.PrintDefaults()
+}
 
+// runServe runs the exporter until the web server fails.
+func runServe(cfg *Config) int {
 	logger.Info("Kea DHCP v4 stats exporter starting", "version", version)
-	http.Handle("/metrics", promhttp.Handler())
+	kc := &collectorSet{}
+	kc.update(cfg)
+	r := &reloader{path: *configFile, collectors: kc}
+	go r.watchSignals()
+	if cfg.Push.enabled() {
+		go func() {
+			if err := pushLoop(context.Background(), cfg, kc); err != nil {
+				logger.Error("Could not set up push destinations", "error", err)
+			}
+		}()
+	}
+
 	srv := &http.Server{
-		Addr:              *listen,
-		ReadHeaderTimeout: *timeout,
+		Handler:           newMux(kc, r),
+		ReadHeaderTimeout: cfg.Web.ReadTimeout,
 	}
 
+	logger.Info("Starting webserver", "listenAddresses", cfg.Web.ListenAddresses, "webConfigFile", cfg.Web.ConfigFile)
+	logger.Error("Exiting", "reason", serve(srv, cfg.Web))
+	return 1
+}
+
+// newMux sets up a registry for the Kea collectors in kc and the exporter's
+// own metrics, and returns a mux serving it along with all other endpoints.
+func newMux(kc *collectorSet, r *reloader) *http.ServeMux {
 	reg := prometheus.NewPedanticRegistry()
-	jt := newKeaCollector(*namespace)
-	prometheus.MustRegister(jt, reg)
-	logger.Info("Starting webserver", "listenAddress", *listen)
-	logger.Error("Exiting", "reason", srv.ListenAndServe())
+	reg.MustRegister(
+		kc,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	registerSelfMetrics(reg)
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.InstrumentHandlerInFlight(scrapesInFlight,
+		promhttp.InstrumentMetricHandler(reg, promhttp.HandlerFor(reg, promhttp.HandlerOpts{
+			ErrorLog:      promhttpLogger{},
+			ErrorHandling: promhttp.ContinueOnError,
+			Registry:      reg,
+		})),
+	))
+	mux.HandleFunc("/-/reload", r.handleReload)
+	mux.HandleFunc("/healthz", handleHealthz)
+	mux.HandleFunc("/readyz", handleReadyz)
+	(&api{kc: kc}).register(mux)
+	(&dashboard{kc: kc}).register(mux)
+	mux.HandleFunc("/", handleLanding)
+	return mux
+}
+
+// reloader re-reads the configuration file and swaps in the result. A
+// configuration that fails to load or validate leaves the running one in
+// place.
+type reloader struct {
+	mu         sync.Mutex
+	path       string
+	collectors *collectorSet
+}
+
+func (r *reloader) reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	cfg, err := loadConfig(r.path)
+	if err != nil {
+		return err
+	}
+	old := currentConfig()
+	currentCfg.Store(cfg)
+	r.collectors.update(cfg)
+	level, _ := parseLogLevel(cfg.Log.Level)
+	logLevel.Set(level)
+	var restart []string
+	if !reflect.DeepEqual(old.Web, cfg.Web) {
+		restart = append(restart, "web")
+	}
+	if old.Log.Format != cfg.Log.Format || old.Log.Color != cfg.Log.Color {
+		restart = append(restart, "log.format", "log.color")
+	}
+	if old.Textfile != cfg.Textfile {
+		restart = append(restart, "textfile")
+	}
+	if !reflect.DeepEqual(old.Push, cfg.Push) {
+		restart = append(restart, "push")
+	}
+	if len(restart) > 0 {
+		logger.Warn("Some changes only take effect after a restart", "settings", restart)
+	}
+	logger.Info("Configuration reloaded", "path", r.path, "targets", len(cfg.Targets))
+	return nil
+}
+
+func (r *reloader) watchSignals() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		if err := r.reload(); err != nil {
+			logger.Error("Could not reload configuration", "error", err)
+		}
+	}
+}
+
+func (r *reloader) handleReload(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "This endpoint requires a POST request", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.reload(); err != nil {
+		logger.Error("Could not reload configuration", "error", err)
+		http.Error(w, "failed to reload config: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
 }
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// ObserveConfig configures how often the snapshots of a target feed the
+// forecast history and the anomaly detection: at most once per Interval,
+// however often it is collected.
+type ObserveConfig struct {
+	Interval time.Duration `yaml:"interval"`
+}
+
+// observer feeds the snapshots of collections to the forecaster and the
+// anomaly detector. All collections of a target go through it, whether by
+// scrapes, pushes or textfile writes, and it passes on at most one snapshot
+// per interval, so the history and the baselines do not depend on how many
+// of them there are or how they interleave. Snapshots older than the last
+// one passed on are dropped.
+type observer struct {
+	mu         sync.Mutex
+	interval   time.Duration
+	last       map[string]time.Time // by target, time of the last snapshot passed on
+	forecaster *forecaster          // nil unless forecasting is enabled
+	anomalies  *anomalyDetector     // nil unless anomaly detection is enabled
+}
+
+func newObserver() *observer {
+	return &observer{last: make(map[string]time.Time)}
+}
+
+// observe passes snap of target on if it is at least the interval newer than
+// the last one. ctx is that of the collection.
+func (o *observer) observe(ctx context.Context, target string, snap *keaSnapshot) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if last, ok := o.last[target]; ok && snap.Time.Sub(last) < max(o.interval, 1) {
+		return
+	}
+	o.last[target] = snap.Time
+	if o.forecaster != nil {
+		o.forecaster.observe(target, snap.Time, snap.Metrics)
+	}
+	if o.anomalies != nil {
+		o.anomalies.observe(ctx, target, snap.Time, snap.Metrics)
+	}
+}
+
+// configure sets the interval, the forecaster and the anomaly detector,
+// which are nil if disabled.
+func (o *observer) configure(interval time.Duration, forecaster *forecaster, anomalies *anomalyDetector) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.interval, o.forecaster, o.anomalies = interval, forecaster, anomalies
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestObserverInterleavedCollectors(t *testing.T) {
+	cfg := defaultConfig().Anomaly
+	cfg.Enabled = true
+	cfg.Warmup = 1
+	ctx := context.Background()
+	// want is fed by one collector, got by two whose snapshots are 200ms
+	// apart, one packet more, and now and then arrive late.
+	want, got := newAnomalyDetector(), newAnomalyDetector()
+	want.configure(cfg)
+	got.configure(cfg)
+	o := newObserver()
+	o.configure(10*time.Second, nil, got)
+	snap := func(at time.Time, n float64) *keaSnapshot {
+		return &keaSnapshot{Time: at, Metrics: &KeaCookedMetrics{
+			Pkt4DiscoverReceived: n, Pkt4RequestReceived: n, Pkt4AckSent: n, Pkt4Received: 2 * n}}
+	}
+	start := time.Unix(1700000000, 0)
+	var n float64
+	for i := range 40 {
+		n += float64(15 + i%3 - 1)
+		at := start.Add(time.Duration(i) * 15 * time.Second)
+		want.observe(ctx, "dhcp1", at, snap(at, n).Metrics)
+		o.observe(ctx, "dhcp1", snap(at, n))
+		if i%5 == 4 {
+			o.observe(ctx, "dhcp1", snap(at.Add(-time.Second), n-1))
+		}
+		o.observe(ctx, "dhcp1", snap(at.Add(200*time.Millisecond), n+1))
+	}
+	wantScores, wantBaselines, wantRatios, _ := want.state("dhcp1")
+	scores, baselines, ratios, ok := got.state("dhcp1")
+	if !ok {
+		t.Fatal("state() has nothing")
+	}
+	if !slices.Equal(scores, wantScores) || !slices.Equal(baselines, wantBaselines) || !slices.Equal(ratios, wantRatios) {
+		t.Errorf("two collectors give scores %v, baselines %v and ratios %v, want %v, %v and %v as of one",
+			scores, baselines, ratios, wantScores, wantBaselines, wantRatios)
+	}
+	if n, want := got.targets["dhcp1"].baselines[0].n, want.targets["dhcp1"].baselines[0].n; n != want {
+		t.Errorf("two collectors give %d rates, want %d", n, want)
+	}
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetricgrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
+	"go.opentelemetry.io/otel/sdk/instrumentation"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	"go.opentelemetry.io/otel/sdk/resource"
+)
+
+var (
+	otlpEndpoint = flag.String("push.otlp.endpoint", "", "if nonempty, export metrics to this OpenTelemetry collector URL, e.g. http://localhost:4317")
+	otlpProtocol = flag.String("push.otlp.protocol", "grpc", "OTLP protocol: grpc or http")
+)
+
+var otlpProtocols = []string{"grpc", "http"}
+
+// processStart is the start time of counters that do not come from Kea.
+var processStart = time.Now()
+
+// OTLPConfig configures exporting to an OpenTelemetry collector. With the
+// http protocol, Endpoint is the full URL including the path, usually
+// /v1/metrics. An http:// URL disables TLS.
+type OTLPConfig struct {
+	Endpoint string            `yaml:"endpoint"`
+	Protocol string            `yaml:"protocol"`
+	Headers  map[string]string `yaml:"headers"`
+	Timeout  time.Duration     `yaml:"timeout"`
+}
+
+// otlpPusher converts gathered metrics to OTLP and exports them.
+type otlpPusher struct {
+	exporter  sdkmetric.Exporter
+	namespace string
+	resource  *resource.Resource
+}
+
+func newOTLPPusher(ctx context.Context, cfg OTLPConfig, namespace string) (*otlpPusher, error) {
+	var exp sdkmetric.Exporter
+	var err error
+	switch cfg.Protocol {
+	case "grpc":
+		exp, err = otlpmetricgrpc.New(ctx,
+			otlpmetricgrpc.WithEndpointURL(cfg.Endpoint),
+			otlpmetricgrpc.WithHeaders(cfg.Headers),
+			otlpmetricgrpc.WithTimeout(cfg.Timeout))
+	case "http":
+		exp, err = otlpmetrichttp.New(ctx,
+			otlpmetrichttp.WithEndpointURL(cfg.Endpoint),
+			otlpmetrichttp.WithHeaders(cfg.Headers),
+			otlpmetrichttp.WithTimeout(cfg.Timeout))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not create OTLP exporter: %w", err)
+	}
+	return &otlpPusher{
+		exporter:  exp,
+		namespace: namespace,
+		resource: resource.NewSchemaless(
+			attribute.String("service.name", "gkse"),
+			attribute.String("service.version", version),
+		),
+	}, nil
+}
+
+func (p *otlpPusher) export(ctx context.Context, mfs []*dto.MetricFamily, now time.Time) error {
+	return p.exporter.Export(ctx, toResourceMetrics(mfs, p.resource, p.namespace, now))
+}
+
+// toResourceMetrics converts metric families to OTLP. Counters become
+// cumulative monotonic sums, gauges stay gauges and labels become
+// attributes. Kea counters start when their Kea server started, as reported
+// by the <namespace>_start_time_seconds metric of the same series, or
+// behind a Control Agent by <namespace>_daemon_start_time_seconds of dhcp4;
+// all other counters start when GKSE started.
+func toResourceMetrics(mfs []*dto.MetricFamily, res *resource.Resource, namespace string, now time.Time) *metricdata.ResourceMetrics {
+	keaStarts := seriesStarts(mfs, namespace+"_start_time_seconds")
+	daemonStarts := seriesStarts(mfs, namespace+"_daemon_start_time_seconds")
+	startTime := func(name string, m *dto.Metric) time.Time {
+		if strings.HasPrefix(name, namespace+"_") {
+			for _, starts := range [][]seriesStart{keaStarts, daemonStarts} {
+				for _, s := range starts {
+					if s.matches(m) {
+						return s.time
+					}
+				}
+			}
+		}
+		return processStart
+	}
+
+	var metrics []metricdata.Metrics
+	for _, mf := range mfs {
+		name := mf.GetName()
+		out := metricdata.Metrics{Name: name, Description: mf.GetHelp(), Unit: otlpUnit(name)}
+		switch mf.GetType() {
+		case dto.MetricType_COUNTER:
+			sum := metricdata.Sum[float64]{Temporality: metricdata.CumulativeTemporality, IsMonotonic: true}
+			for _, m := range mf.GetMetric() {
+				sum.DataPoints = append(sum.DataPoints, metricdata.DataPoint[float64]{
+					Attributes: attributes(m),
+					StartTime:  startTime(name, m),
+					Time:       now,
+					Value:      m.GetCounter().GetValue(),
+				})
+			}
+			out.Data = sum
+		case dto.MetricType_GAUGE, dto.MetricType_UNTYPED:
+			var g metricdata.Gauge[float64]
+			for _, m := range mf.GetMetric() {
+				v := m.GetGauge().GetValue()
+				if mf.GetType() == dto.MetricType_UNTYPED {
+					v = m.GetUntyped().GetValue()
+				}
+				g.DataPoints = append(g.DataPoints, metricdata.DataPoint[float64]{
+					Attributes: attributes(m),
+					Time:       now,
+					Value:      v,
+				})
+			}
+			out.Data = g
+		case dto.MetricType_HISTOGRAM:
+			h := metricdata.Histogram[float64]{Temporality: metricdata.CumulativeTemporality}
+			for _, m := range mf.GetMetric() {
+				ph := m.GetHistogram()
+				dp := metricdata.HistogramDataPoint[float64]{
+					Attributes: attributes(m),
+					StartTime:  startTime(name, m),
+					Time:       now,
+					Count:      ph.GetSampleCount(),
+					Sum:        ph.GetSampleSum(),
+				}
+				// Prometheus buckets are cumulative, OTLP buckets are not.
+				var prev uint64
+				for _, b := range ph.GetBucket() {
+					dp.Bounds = append(dp.Bounds, b.GetUpperBound())
+					dp.BucketCounts = append(dp.BucketCounts, b.GetCumulativeCount()-prev)
+					prev = b.GetCumulativeCount()
+				}
+				dp.BucketCounts = append(dp.BucketCounts, ph.GetSampleCount()-prev)
+				h.DataPoints = append(h.DataPoints, dp)
+			}
+			out.Data = h
+		default:
+			continue
+		}
+		metrics = append(metrics, out)
+	}
+	return &metricdata.ResourceMetrics{
+		Resource: res,
+		ScopeMetrics: []metricdata.ScopeMetrics{{
+			Scope:   instrumentation.Scope{Name: "pkg.i-no.de/pkg/gkse", Version: version},
+			Metrics: metrics,
+		}},
+	}
+}
+
+// seriesStart is the start time of the Kea server whose metrics have
+// labels: those of its target, daemon and identity.
+type seriesStart struct {
+	labels []*dto.LabelPair
+	time   time.Time
+}
+
+// seriesStarts returns the start times in the gauge called name.
+func seriesStarts(mfs []*dto.MetricFamily, name string) []seriesStart {
+	var starts []seriesStart
+	for _, mf := range mfs {
+		if mf.GetName() != name {
+			continue
+		}
+		for _, m := range mf.GetMetric() {
+			starts = append(starts, seriesStart{m.GetLabel(), time.Unix(0, int64(m.GetGauge().GetValue()*1e9))})
+		}
+	}
+	return starts
+}
+
+// matches returns whether m has all the labels of s, and so comes from the
+// same Kea server.
+func (s seriesStart) matches(m *dto.Metric) bool {
+	for _, lp := range s.labels {
+		if v, ok := lookupLabel(m, lp.GetName()); !ok || v != lp.GetValue() {
+			return false
+		}
+	}
+	return true
+}
+
+func attributes(m *dto.Metric) attribute.Set {
+	kvs := make([]attribute.KeyValue, 0, len(m.GetLabel()))
+	for _, lp := range m.GetLabel() {
+		kvs = append(kvs, attribute.String(lp.GetName(), lp.GetValue()))
+	}
+	return attribute.NewSet(kvs...)
+}
+
+func lookupLabel(m *dto.Metric, name string) (string, bool) {
+	for _, lp := range m.GetLabel() {
+		if lp.GetName() == name {
+			return lp.GetValue(), true
+		}
+	}
+	return "", false
+}
+
+// otlpUnit derives the UCUM unit from the Prometheus unit suffix.
+func otlpUnit(name string) string {
+	name = strings.TrimSuffix(name, "_total")
+	switch {
+	case strings.HasSuffix(name, "_seconds"):
+		return "s"
+	case strings.HasSuffix(name, "_bytes"):
+		return "By"
+	}
+	return ""
+}
+
+func (cfg OTLPConfig) validate() error {
+	if cfg.Endpoint == "" {
+		return nil
+	}
+	var errs []error
+	if u, err := url.Parse(cfg.Endpoint); err != nil {
+		errs = append(errs, fmt.Errorf("push.otlp.endpoint: %w", err))
+	} else if u.Scheme != "http" && u.Scheme != "https" {
+		errs = append(errs, fmt.Errorf("push.otlp.endpoint: want an http:// or https:// URL, got '%s'", cfg.Endpoint))
+	}
+	if !slices.Contains(otlpProtocols, cfg.Protocol) {
+		errs = append(errs, fmt.Errorf("push.otlp.protocol: unknown protocol '%s', want one of %s", cfg.Protocol, strings.Join(otlpProtocols, ", ")))
+	}
+	if cfg.Timeout <= 0 {
+		errs = append(errs, fmt.Errorf("push.otlp.timeout: must be positive, got %s", cfg.Timeout))
+	}
+	return errors.Join(errs...)
+}
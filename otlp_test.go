@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	colmetricspb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	"google.golang.org/protobuf/proto"
+
+	"pkg.i-no.de/pkg/gkse/keatest"
+)
+
+func TestOTLPExport(t *testing.T) {
+	requests := make(chan *colmetricspb.ExportMetricsServiceRequest, 1)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/metrics" {
+			t.Errorf("OTLP request to %s, want /v1/metrics", r.URL.Path)
+		}
+		body, _ := io.ReadAll(r.Body)
+		var req colmetricspb.ExportMetricsServiceRequest
+		if err := proto.Unmarshal(body, &req); err != nil {
+			t.Errorf("could not decode OTLP request: %v", err)
+		}
+		requests <- &req
+		w.Header().Set("Content-Type", "application/x-protobuf")
+		resp, _ := proto.Marshal(&colmetricspb.ExportMetricsServiceResponse{})
+		w.Write(resp)
+	}))
+	defer collector.Close()
+
+	kea := newFixtureServer(t, "kea-2.4")
+	kea.Handle(statusCommand, keatest.JSON(`{"result": 0, "arguments": {"pid": 42, "uptime": 3600}}`))
+	cfg := defaultConfig()
+	cfg.Targets = []TargetConfig{{Name: "dhcp1", Socket: kea.SocketPath, Timeout: time.Second}}
+	cfg.Push.OTLP.Endpoint = collector.URL + "/v1/metrics"
+	cfg.Push.OTLP.Protocol = "http"
+	currentCfg.Store(cfg)
+	kc := &collectorSet{}
+	kc.update(cfg)
+	ctx := context.Background()
+	otlp, err := newOTLPPusher(ctx, cfg.Push.OTLP, cfg.Namespace)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer otlp.exporter.Shutdown(ctx)
+	reg := newPushRegistry(kc)
+	// The self-metrics of a collection are only in the next one.
+	reg.Gather()
+	pushOnce(ctx, reg, &pushDestinations{otlp: otlp})
+
+	var req *colmetricspb.ExportMetricsServiceRequest
+	select {
+	case req = <-requests:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no OTLP request received")
+	}
+	metrics := make(map[string]*metricspb.Metric)
+	for _, rm := range req.GetResourceMetrics() {
+		for _, sm := range rm.GetScopeMetrics() {
+			for _, m := range sm.GetMetrics() {
+				metrics[m.GetName()] = m
+			}
+		}
+	}
+
+	sum := metrics["kea_addresses_assigned_total"].GetSum()
+	if sum == nil || !sum.GetIsMonotonic() || sum.GetAggregationTemporality() != metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE {
+		t.Fatalf("kea_addresses_assigned_total is %v, want a cumulative monotonic sum", metrics["kea_addresses_assigned_total"])
+	}
+	dp := sum.GetDataPoints()[0]
+	if d := time.Duration(dp.GetTimeUnixNano()-dp.GetStartTimeUnixNano()) - time.Hour; d < -5*time.Second || d > 5*time.Second {
+		t.Errorf("counter starts %s before the sample, want Kea's uptime of 1h", time.Duration(dp.GetTimeUnixNano()-dp.GetStartTimeUnixNano()))
+	}
+
+	gauge := metrics["kea_subnet_addresses"].GetGauge()
+	if gauge == nil || len(gauge.GetDataPoints()) != 2 {
+		t.Fatalf("kea_subnet_addresses is %v, want a gauge with two subnets", metrics["kea_subnet_addresses"])
+	}
+	attrs := make(map[string]string)
+	for _, kv := range gauge.GetDataPoints()[0].GetAttributes() {
+		attrs[kv.GetKey()] = kv.GetValue().GetStringValue()
+	}
+	if attrs["subnet"] == "" || attrs["subnetidx"] == "" {
+		t.Errorf("kea_subnet_addresses has attributes %v, want subnet and subnetidx", attrs)
+	}
+
+	if h := metrics["gkse_parse_duration_seconds"]; h.GetHistogram() == nil || h.GetUnit() != "s" {
+		t.Errorf("gkse_parse_duration_seconds is %v, want a histogram in seconds", h)
+	}
+}
+
+func TestOTLPStartTimes(t *testing.T) {
+	metric := func(v float64, labels ...string) *dto.Metric {
+		m := &dto.Metric{Gauge: &dto.Gauge{Value: proto.Float64(v)}, Counter: &dto.Counter{Value: proto.Float64(v)}}
+		for i := 0; i < len(labels); i += 2 {
+			m.Label = append(m.Label, &dto.LabelPair{Name: proto.String(labels[i]), Value: proto.String(labels[i+1])})
+		}
+		return m
+	}
+	family := func(name string, typ dto.MetricType, ms ...*dto.Metric) *dto.MetricFamily {
+		return &dto.MetricFamily{Name: proto.String(name), Type: typ.Enum(), Metric: ms}
+	}
+	mfs := []*dto.MetricFamily{
+		family("kea_start_time_seconds", dto.MetricType_GAUGE,
+			metric(1000, "server", "dhcp-a", "target", "a"),
+			metric(2000, "server", "dhcp-b", "target", "b")),
+		family("kea_daemon_start_time_seconds", dto.MetricType_GAUGE,
+			metric(3000, "daemon", "dhcp4", "target", "c"),
+			metric(4000, "daemon", "d2", "target", "c")),
+		family("kea_addresses_assigned_total", dto.MetricType_COUNTER,
+			metric(1, "server", "dhcp-a", "target", "a"),
+			metric(1, "server", "dhcp-b", "target", "b"),
+			metric(1, "daemon", "dhcp4", "server", "dhcp-c", "target", "c"),
+			metric(1, "server", "dhcp-d", "target", "d")),
+		family("gkse_kea_read_bytes_total", dto.MetricType_COUNTER,
+			metric(1, "target", "a")),
+	}
+	want := map[string]time.Time{
+		"a":       time.Unix(1000, 0),
+		"b":       time.Unix(2000, 0),
+		"c":       time.Unix(3000, 0),
+		"d":       processStart,
+		"gkse, a": processStart,
+	}
+	rm := toResourceMetrics(mfs, nil, "kea", time.Now())
+	for _, m := range rm.ScopeMetrics[0].Metrics {
+		sum, ok := m.Data.(metricdata.Sum[float64])
+		if !ok {
+			continue
+		}
+		for _, dp := range sum.DataPoints {
+			target, _ := dp.Attributes.Value("target")
+			key := target.AsString()
+			if strings.HasPrefix(m.Name, "gkse_") {
+				key = "gkse, " + key
+			}
+			if !dp.StartTime.Equal(want[key]) {
+				t.Errorf("%s of %s starts at %s, want %s", m.Name, key, dp.StartTime, want[key])
+			}
+			delete(want, key)
+		}
+	}
+	if len(want) != 0 {
+		t.Errorf("no sums for %v", want)
+	}
+}
@@ -1,74 +1,117 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 )
 
 var namespace = flag.String("namespace", "kea", "Namespace (prefix) to use for Prometheus metrics")
 
-func newKeaCollector(namespace string) prometheus.Collector {
-	subnetlabels := []string{"subnetidx", "subnet"}
-	poollabels := make([]string, 0, len(subnetlabels))
-	copy(subnetlabels, poollabels)
-	poollabels = append(poollabels, "poolidx")
+func newKeaCollector(cfg *Config, target TargetConfig, constLabels prometheus.Labels) *jsonCollector4 {
+	namespace := cfg.Namespace
+	// The identity labels come first on every metric but the scrape error.
+	idlabels := cfg.Identity.names()
+	subnetlabels := slices.Concat(idlabels, []string{"subnetidx", "subnet"}, cfg.UserContext.names())
+	poollabels := append(slices.Clone(subnetlabels), "poolidx")
 
 	c4 := jsonCollector4{
 		namespace:                   namespace,
-		CumulativeAssignedAddresses: prometheus.NewDesc(namespace+"_addresses_assigned_total", "Cumulative number of addresses that have been assigned since server startup", nil, nil),
-		DeclinedAddresses:           prometheus.NewDesc(namespace+"_addresses_declined_total", "Number of IPv4 addresses that are currently declined; a count of the number of leases currently unavailable", nil, nil),
+		target:                      target,
+		enabled:                     cfg.Collectors,
+		userContext:                 cfg.UserContext,
+		identity:                    cfg.Identity,
+		labels:                      constLabels,
+		scrapeError:                 prometheus.NewDesc(namespace+"_scrape_error", "Error querying Kea", nil, constLabels),
+		Up:                          prometheus.NewDesc(namespace+"_up", "Whether querying the Kea server succeeded (1) or not (0)", idlabels, constLabels),
+		StartTime:                   prometheus.NewDesc(namespace+"_start_time_seconds", "Start time of the Kea server since unix epoch in seconds, derived from the uptime reported by status-get", idlabels, constLabels),
+		CumulativeAssignedAddresses: prometheus.NewDesc(namespace+"_addresses_assigned_total", "Cumulative number of addresses that have been assigned since server startup", idlabels, constLabels),
+		DeclinedAddresses:           prometheus.NewDesc(namespace+"_addresses_declined_total", "Number of IPv4 addresses that are currently declined; a count of the number of leases currently unavailable", idlabels, constLabels),
 		// Totals (v4)
-		Pkt4Received: prometheus.NewDesc(namespace+"_v4_packets_received_total", "Number of DHCPv4 packets received. This includes all packets: valid, bogus, corrupted, rejected, etc.", nil, nil),
-		Pkt4Sent:     prometheus.NewDesc(namespace+"_v4_packets_sent_total", "Number of DHCPv4 packets sent", nil, nil),
+		Pkt4Received: prometheus.NewDesc(namespace+"_v4_packets_received_total", "Number of DHCPv4 packets received. This includes all packets: valid, bogus, corrupted, rejected, etc.", idlabels, constLabels),
+		Pkt4Sent:     prometheus.NewDesc(namespace+"_v4_packets_sent_total", "Number of DHCPv4 packets sent", idlabels, constLabels),
 		// RX types (v4)
-		Pkt4AckReceived:      prometheus.NewDesc(namespace+"_v4_packet_types_received_total", "Number v4 of packets received", nil, map[string]string{"pkttype": "ack"}),
-		Pkt4DeclineReceived:  prometheus.NewDesc(namespace+"_v4_packet_types_received_total", "Number v4 of packets received", nil, map[string]string{"pkttype": "decline"}),
-		Pkt4DiscoverReceived: prometheus.NewDesc(namespace+"_v4_packet_types_received_total", "Number v4 of packets received", nil, map[string]string{"pkttype": "discover"}),
-		Pkt4InformReceived:   prometheus.NewDesc(namespace+"_v4_packet_types_received_total", "Number v4 of packets received", nil, map[string]string{"pkttype": "inform"}),
-		Pkt4NakReceived:      prometheus.NewDesc(namespace+"_v4_packet_types_received_total", "Number v4 of packets received", nil, map[string]string{"pkttype": "nak"}),
-		Pkt4OfferReceived:    prometheus.NewDesc(namespace+"_v4_packet_types_received_total", "Number v4 of packets received", nil, map[string]string{"pkttype": "offer"}),
-		Pkt4ReleaseReceived:  prometheus.NewDesc(namespace+"_v4_packet_types_received_total", "Number v4 of packets received", nil, map[string]string{"pkttype": "release"}),
-		Pkt4RequestReceived:  prometheus.NewDesc(namespace+"_v4_packet_types_received_total", "Number v4 of packets received", nil, map[string]string{"pkttype": "request"}),
-		Pkt4UnknownReceived:  prometheus.NewDesc(namespace+"_v4_packet_types_received_total", "Number v4 of packets received", nil, map[string]string{"pkttype": "unknown"}),
+		Pkt4AckReceived:      prometheus.NewDesc(namespace+"_v4_packet_types_received_total", "Number v4 of packets received", idlabels, withLabel(constLabels, "pkttype", "ack")),
+		Pkt4DeclineReceived:  prometheus.NewDesc(namespace+"_v4_packet_types_received_total", "Number v4 of packets received", idlabels, withLabel(constLabels, "pkttype", "decline")),
+		Pkt4DiscoverReceived: prometheus.NewDesc(namespace+"_v4_packet_types_received_total", "Number v4 of packets received", idlabels, withLabel(constLabels, "pkttype", "discover")),
+		Pkt4InformReceived:   prometheus.NewDesc(namespace+"_v4_packet_types_received_total", "Number v4 of packets received", idlabels, withLabel(constLabels, "pkttype", "inform")),
+		Pkt4NakReceived:      prometheus.NewDesc(namespace+"_v4_packet_types_received_total", "Number v4 of packets received", idlabels, withLabel(constLabels, "pkttype", "nak")),
+		Pkt4OfferReceived:    prometheus.NewDesc(namespace+"_v4_packet_types_received_total", "Number v4 of packets received", idlabels, withLabel(constLabels, "pkttype", "offer")),
+		Pkt4ReleaseReceived:  prometheus.NewDesc(namespace+"_v4_packet_types_received_total", "Number v4 of packets received", idlabels, withLabel(constLabels, "pkttype", "release")),
+		Pkt4RequestReceived:  prometheus.NewDesc(namespace+"_v4_packet_types_received_total", "Number v4 of packets received", idlabels, withLabel(constLabels, "pkttype", "request")),
+		Pkt4UnknownReceived:  prometheus.NewDesc(namespace+"_v4_packet_types_received_total", "Number v4 of packets received", idlabels, withLabel(constLabels, "pkttype", "unknown")),
 		// TX types (v4)
-		Pkt4AckSent:   prometheus.NewDesc(namespace+"_v4_packet_types_sent_total", "Number of v4 packets sent", nil, map[string]string{"pkttype": "ack"}),
-		Pkt4NakSent:   prometheus.NewDesc(namespace+"_v4_packet_types_sent_total", "Number of v4 packets sent", nil, map[string]string{"pkttype": "nak"}),
-		Pkt4OfferSent: prometheus.NewDesc(namespace+"_v4_packet_types_sent_total", "Number of v4 packets sent", nil, map[string]string{"pkttype": "offer"}),
+		Pkt4AckSent:   prometheus.NewDesc(namespace+"_v4_packet_types_sent_total", "Number of v4 packets sent", idlabels, withLabel(constLabels, "pkttype", "ack")),
+		Pkt4NakSent:   prometheus.NewDesc(namespace+"_v4_packet_types_sent_total", "Number of v4 packets sent", idlabels, withLabel(constLabels, "pkttype", "nak")),
+		Pkt4OfferSent: prometheus.NewDesc(namespace+"_v4_packet_types_sent_total", "Number of v4 packets sent", idlabels, withLabel(constLabels, "pkttype", "offer")),
 		// Misc (v4)
-		Pkt4ParseFailed:               prometheus.NewDesc(namespace+"_v4_packets_parse_failed_total", "Number of incoming packets that could not be parsed", nil, nil),
-		Pkt4ReceiveDrop:               prometheus.NewDesc(namespace+"_v4_packets_dropped_on_receive_total", "Number of incoming packets that were dropped", nil, nil),
-		V4AllocationFailClasses:       prometheus.NewDesc(namespace+"_v4_allocation_failures_classes_total", "Number of address allocation failures when the client's packet belongs to one or more classes", nil, nil),
-		V4AllocationFailNoPools:       prometheus.NewDesc(namespace+"_v4_allocation_failures_no_pools_total", "Number of address allocation failures because the server could not use any configured pools for a particular client", nil, nil),
-		V4AllocationFail:              prometheus.NewDesc(namespace+"_v4_allocation_failures_total", "Number of total address allocation failures", nil, nil),
-		V4AllocationFailSharedNetwork: prometheus.NewDesc(namespace+"_v4_allocation_failures_shared_network_total", "Number of address allocation", nil, nil),
-		V4AllocationFailSubnet:        prometheus.NewDesc(namespace+"_v4_allocation_failures_subnet_total", "Number of address allocation failures for a particular client connected to a subnet that does not belong to a shared network", nil, nil),
-		V4ReservationConflicts:        prometheus.NewDesc(namespace+"_v4_reservation_conflicts_total", "Number of host reservation allocation conflicts which have occurred across every subnet", nil, nil),
+		Pkt4ParseFailed:               prometheus.NewDesc(namespace+"_v4_packets_parse_failed_total", "Number of incoming packets that could not be parsed", idlabels, constLabels),
+		Pkt4ReceiveDrop:               prometheus.NewDesc(namespace+"_v4_packets_dropped_on_receive_total", "Number of incoming packets that were dropped", idlabels, constLabels),
+		V4AllocationFailClasses:       prometheus.NewDesc(namespace+"_v4_allocation_failures_classes_total", "Number of address allocation failures when the client's packet belongs to one or more classes", idlabels, constLabels),
+		V4AllocationFailNoPools:       prometheus.NewDesc(namespace+"_v4_allocation_failures_no_pools_total", "Number of address allocation failures because the server could not use any configured pools for a particular client", idlabels, constLabels),
+		V4AllocationFail:              prometheus.NewDesc(namespace+"_v4_allocation_failures_total", "Number of total address allocation failures", idlabels, constLabels),
+		V4AllocationFailSharedNetwork: prometheus.NewDesc(namespace+"_v4_allocation_failures_shared_network_total", "Number of address allocation", idlabels, constLabels),
+		V4AllocationFailSubnet:        prometheus.NewDesc(namespace+"_v4_allocation_failures_subnet_total", "Number of address allocation failures for a particular client connected to a subnet that does not belong to a shared network", idlabels, constLabels),
+		V4ReservationConflicts:        prometheus.NewDesc(namespace+"_v4_reservation_conflicts_total", "Number of host reservation allocation conflicts which have occurred across every subnet", idlabels, constLabels),
+		// Anomaly detection (v4)
+		AnomalyScore:    prometheus.NewDesc(namespace+"_v4_anomaly_score", "Deviation of the rate of a given packet counter since the previous query from its baseline, in standard deviations", append(slices.Clone(idlabels), "counter"), constLabels),
+		AnomalyBaseline: prometheus.NewDesc(namespace+"_v4_anomaly_baseline_rate", "Exponentially weighted average rate of a given packet counter per second", append(slices.Clone(idlabels), "counter"), constLabels),
 		// Misc
-		ReclaimedDeclinedAddresses: prometheus.NewDesc(namespace+"_reclaimed_declined_addresses_total", "Number of IPv4 addresses that were declined, but have now been recovered", nil, nil),
-		ReclaimedLeases:            prometheus.NewDesc(namespace+"_reclaimed_leases_total", "Number of expired leases that have been reclaimed since server startup", nil, nil),
+		ReclaimedDeclinedAddresses: prometheus.NewDesc(namespace+"_reclaimed_declined_addresses_total", "Number of IPv4 addresses that were declined, but have now been recovered", idlabels, constLabels),
+		ReclaimedLeases:            prometheus.NewDesc(namespace+"_reclaimed_leases_total", "Number of expired leases that have been reclaimed since server startup", idlabels, constLabels),
 		// Subnet metrics
-		SubnetAssignedAddresses:               prometheus.NewDesc(namespace+"_subnet_assigned_addresses", "Number of assigned addresses in a given subnet", subnetlabels, nil),
-		SubnetAssignedAddressesTotal:          prometheus.NewDesc(namespace+"_subnet_assigned_addresses_total", "Cumulative number of assigned addresses in a given subnet", subnetlabels, nil),
-		SubnetDeclinedAddressesTotal:          prometheus.NewDesc(namespace+"_subnet_declined_addresses_total", "Number of IPv4 addresses that are currently declined in a given subnet; a count of the number of leases currently unavailable", subnetlabels, nil),
-		SubnetReclaimedDeclinedAddressesTotal: prometheus.NewDesc(namespace+"_subnet_reclaimed_declined_addresses", "Number of IPv4 addresses that were declined, but have now been recovered", subnetlabels, nil),
-		SubnetReclaimedLeasesTotal:            prometheus.NewDesc(namespace+"_subnet_reclaimed_leases_total", "Number of expired leases associated with a given subnet that have been reclaimed since server startup", subnetlabels, nil),
-		SubnetAddressesTotal:                  prometheus.NewDesc(namespace+"_subnet_addresses", "Total number of addresses available for DHCPv4 management for a given subnet; in other words, this is the count of all addresses in all configured pools", subnetlabels, nil),
-		SubnetReservationConflictsTotal:       prometheus.NewDesc(namespace+"_subnet_reservation_conflicts_total", "Number of host reservation allocation conflicts which have occurred in a specific subnet.", subnetlabels, nil),
+		SubnetAssignedAddresses:               prometheus.NewDesc(namespace+"_subnet_assigned_addresses", "Number of assigned addresses in a given subnet", subnetlabels, constLabels),
+		SubnetAssignedAddressesTotal:          prometheus.NewDesc(namespace+"_subnet_assigned_addresses_total", "Cumulative number of assigned addresses in a given subnet", subnetlabels, constLabels),
+		SubnetDeclinedAddressesTotal:          prometheus.NewDesc(namespace+"_subnet_declined_addresses_total", "Number of IPv4 addresses that are currently declined in a given subnet; a count of the number of leases currently unavailable", subnetlabels, constLabels),
+		SubnetReclaimedDeclinedAddressesTotal: prometheus.NewDesc(namespace+"_subnet_reclaimed_declined_addresses", "Number of IPv4 addresses that were declined, but have now been recovered", subnetlabels, constLabels),
+		SubnetReclaimedLeasesTotal:            prometheus.NewDesc(namespace+"_subnet_reclaimed_leases_total", "Number of expired leases associated with a given subnet that have been reclaimed since server startup", subnetlabels, constLabels),
+		SubnetAddressesTotal:                  prometheus.NewDesc(namespace+"_subnet_addresses", "Total number of addresses available for DHCPv4 management for a given subnet; in other words, this is the count of all addresses in all configured pools", subnetlabels, constLabels),
+		SubnetReservationConflictsTotal:       prometheus.NewDesc(namespace+"_subnet_reservation_conflicts_total", "Number of host reservation allocation conflicts which have occurred in a specific subnet.", subnetlabels, constLabels),
+		SubnetInfo:                            prometheus.NewDesc(namespace+"_subnet_info", "Configuration of a given subnet, including the values inherited from its shared network and the global configuration; always 1", append(slices.Clone(subnetlabels), subnetInfoLabels...), constLabels),
+		ConfigIssues:                          prometheus.NewDesc(namespace+"_config_issues", "Number of issues found by a given check of the Kea configuration, by subnet", append(slices.Clone(idlabels), "check", "subnet"), constLabels),
+		SubnetValidLifetime:                   prometheus.NewDesc(namespace+"_subnet_valid_lifetime_seconds", "Valid lifetime of the leases in a given subnet", subnetlabels, constLabels),
+		SubnetPredictedExhaustion:             prometheus.NewDesc(namespace+"_subnet_predicted_exhaustion_seconds", "Predicted time until all addresses of a given subnet are assigned, +Inf if not within a year", subnetlabels, constLabels),
+		SubnetForecastUtilization:             prometheus.NewDesc(namespace+"_subnet_forecast_utilization", "Forecast ratio of assigned to total addresses of a given subnet at a given horizon", append(slices.Clone(subnetlabels), "horizon"), constLabels),
 		// Pool metrics
-		PoolTotalAddresses:              prometheus.NewDesc(namespace+"_subnet_pool_addresses", "Total number of addresses available for DHCPv4 management for a given subnet pool", poollabels, nil),
-		PoolCumulativeAssignedAddresses: prometheus.NewDesc(namespace+"_subnet_pool_addresses_assigned_total", "Cumulative number of assigned addresses in a given subnet pool", poollabels, nil),
-		PoolAssignedAddresses:           prometheus.NewDesc(namespace+"_subnet_pool_assigned_addresses", "Number of assigned addresses in a given subnet pool", poollabels, nil),
-		PoolReclaimedLeases:             prometheus.NewDesc(namespace+"_subnet_pool_reclaimed_leases_total", "Number of expired leases associated with a given subnet pool that have been reclaimed since server startup", poollabels, nil),
-		PoolDeclinedAddresses:           prometheus.NewDesc(namespace+"_subnet_pool_addresses_declined_total", "Number of IPv4 addresses that are currently declined in a given subnet pool; a count of the number of leases currently unavailable", poollabels, nil),
-		PoolReclaimedDeclinedAddresses:  prometheus.NewDesc(namespace+"_subnet_pool_reclaimed_declined_addresses_total", "Number of IPv4 addresses that were declined, but have now been recovered in this pool", poollabels, nil),
+		PoolTotalAddresses:              prometheus.NewDesc(namespace+"_subnet_pool_addresses", "Total number of addresses available for DHCPv4 management for a given subnet pool", poollabels, constLabels),
+		PoolCumulativeAssignedAddresses: prometheus.NewDesc(namespace+"_subnet_pool_addresses_assigned_total", "Cumulative number of assigned addresses in a given subnet pool", poollabels, constLabels),
+		PoolAssignedAddresses:           prometheus.NewDesc(namespace+"_subnet_pool_assigned_addresses", "Number of assigned addresses in a given subnet pool", poollabels, constLabels),
+		PoolReclaimedLeases:             prometheus.NewDesc(namespace+"_subnet_pool_reclaimed_leases_total", "Number of expired leases associated with a given subnet pool that have been reclaimed since server startup", poollabels, constLabels),
+		PoolDeclinedAddresses:           prometheus.NewDesc(namespace+"_subnet_pool_addresses_declined_total", "Number of IPv4 addresses that are currently declined in a given subnet pool; a count of the number of leases currently unavailable", poollabels, constLabels),
+		PoolReclaimedDeclinedAddresses:  prometheus.NewDesc(namespace+"_subnet_pool_reclaimed_declined_addresses_total", "Number of IPv4 addresses that were declined, but have now been recovered in this pool", poollabels, constLabels),
+		PoolPredictedExhaustion:         prometheus.NewDesc(namespace+"_subnet_pool_predicted_exhaustion_seconds", "Predicted time until all addresses of this pool are assigned, +Inf if not within a year", poollabels, constLabels),
+		PoolForecastUtilization:         prometheus.NewDesc(namespace+"_subnet_pool_forecast_utilization", "Forecast ratio of assigned to total addresses of this pool at a given horizon", append(slices.Clone(poollabels), "horizon"), constLabels),
+	}
+	for _, r := range anomalyRatios {
+		c4.AnomalyRatios = append(c4.AnomalyRatios, prometheus.NewDesc(namespace+"_v4_"+r.name+"_ratio", "Ratio of the increases of two packet counters since the previous query, "+strings.ReplaceAll(r.name, "_", " to "), idlabels, constLabels))
 	}
 	return &c4
 }
 
 type jsonCollector4 struct {
 	namespace                   string
+	target                      TargetConfig
+	enabled                     CollectorsConfig
+	userContext                 UserContextConfig
+	identity                    IdentityConfig
+	agent                       bool             // collected by the agentCollector of its target
+	forecaster                  *forecaster      // nil unless forecasting is enabled
+	anomalies                   *anomalyDetector // nil unless anomaly detection is enabled
+	observer                    *observer
+	labels                      prometheus.Labels
+	last                        atomic.Pointer[keaSnapshot]
+	scrapeError                 *prometheus.Desc
+	Up                          *prometheus.Desc
+	StartTime                   *prometheus.Desc
 	CumulativeAssignedAddresses *prometheus.Desc
 	DeclinedAddresses           *prometheus.Desc
 	// Totals
@@ -99,6 +142,10 @@ type jsonCollector4 struct {
 	V4AllocationFailSharedNetwork *prometheus.Desc
 	V4AllocationFailSubnet        *prometheus.Desc
 	V4ReservationConflicts        *prometheus.Desc
+	// Anomaly detection (v4)
+	AnomalyScore    *prometheus.Desc
+	AnomalyBaseline *prometheus.Desc
+	AnomalyRatios   []*prometheus.Desc // by anomalyRatios
 	// Subnet metrics
 	SubnetAssignedAddresses               *prometheus.Desc
 	SubnetAssignedAddressesTotal          *prometheus.Desc
@@ -107,6 +154,11 @@ type jsonCollector4 struct {
 	SubnetReclaimedLeasesTotal            *prometheus.Desc
 	SubnetAddressesTotal                  *prometheus.Desc
 	SubnetReservationConflictsTotal       *prometheus.Desc
+	SubnetInfo                            *prometheus.Desc
+	SubnetValidLifetime                   *prometheus.Desc
+	ConfigIssues                          *prometheus.Desc
+	SubnetPredictedExhaustion             *prometheus.Desc
+	SubnetForecastUtilization             *prometheus.Desc
 	// Pool metrics
 	PoolTotalAddresses              *prometheus.Desc
 	PoolCumulativeAssignedAddresses *prometheus.Desc
@@ -114,6 +166,8 @@ type jsonCollector4 struct {
 	PoolReclaimedLeases             *prometheus.Desc
 	PoolDeclinedAddresses           *prometheus.Desc
 	PoolReclaimedDeclinedAddresses  *prometheus.Desc
+	PoolPredictedExhaustion         *prometheus.Desc
+	PoolForecastUtilization         *prometheus.Desc
 }
 
 func (c *jsonCollector4) Describe(ch chan<- *prometheus.Desc) {
@@ -121,107 +175,235 @@ func (c *jsonCollector4) Describe(ch chan<- *prometheus.Desc) {
 }
 
 func (c *jsonCollector4) Collect(ch chan<- prometheus.Metric) {
-	var rawJSON []byte
-	var err error
-	logger.Debug("Fetching stats from Kea")
-	rawJSON, err = getStatsJSON()
+	c.collect(collectContext(newScrapeContext(context.Background())), ch)
+}
+
+type collectKey struct{}
+
+// collectContext marks ctx as that of a collection of the metrics, as
+// opposed to a look at the current state for the API or dashboard. Only
+// collections move a replay in scrape mode on to the next snapshot.
+func collectContext(ctx context.Context) context.Context {
+	return context.WithValue(ctx, collectKey{}, true)
+}
+
+func isCollect(ctx context.Context) bool {
+	c, _ := ctx.Value(collectKey{}).(bool)
+	return c
+}
+
+// collect queries Kea and sends the resulting metrics to ch. All log records
+// carry the scrape ID from ctx.
+func (c *jsonCollector4) collect(ctx context.Context, ch chan<- prometheus.Metric) {
+	start := time.Now()
+	defer func() { scrapeDuration.WithLabelValues(c.target.Name).Observe(time.Since(start).Seconds()) }()
+	logger.DebugContext(ctx, "Fetching stats from Kea", "target", c.target.Name)
+	snap, err := c.snapshot(ctx)
 	if err != nil {
-		logger.Error("Could not fetch stats from Kea", "error", err)
+		logger.ErrorContext(ctx, "Could not get stats from Kea", "target", c.target.Name, "error", err)
+		c.collectFailure(ctx, ch, err)
 		return
 	}
-	cooked, err := parseStats(rawJSON)
-	if err != nil {
-		logger.Error("Could not parse raw JSON stats", "error", err)
-		return
+	cooked, config := snap.Metrics, snap.Config
+	// Only collections feed the history and the baselines, not looks from
+	// the API or dashboard, through the observer, which takes one snapshot
+	// per interval of all the collections.
+	if c.observer != nil {
+		c.observer.observe(ctx, c.target.Name, snap)
+	}
+	id := c.identity.values(c.target, config)
+	logger.DebugContext(ctx, "Sending stats to channel", "target", c.target.Name)
+	ch <- prometheus.MustNewConstMetric(c.Up, prometheus.GaugeValue, 1, id...)
+	if c.enabled.Global {
+		c.collectGlobal(ch, cooked, id)
+		c.collectStartTime(ctx, ch, id)
+		c.collectAnomalies(ch, id)
+	}
+	if c.enabled.Subnets || c.enabled.Pools {
+		c.collectSubnets(ctx, ch, snap.Time, cooked, config, id)
+	}
+	if c.enabled.Subnets {
+		c.collectSubnetInfo(ch, config, id)
+	}
+	if c.enabled.Lint {
+		c.collectConfigIssues(ch, config, cooked, id)
 	}
-	config, err := queryConfig()
+	logger.DebugContext(ctx, "Sending stats to channel complete", "target", c.target.Name, "duration", time.Since(start))
+}
+
+// collectFailure sends the metrics of a collection that failed with err: Kea
+// being down, and an invalid metric that makes the metrics handler report
+// the failure. Kea being down is left out while its identity is not known,
+// so that the up series does not change labels once Kea is reached.
+func (c *jsonCollector4) collectFailure(ctx context.Context, ch chan<- prometheus.Metric, err error) {
+	// The identity is that of the last successful query, if any.
+	var config *KeaConfig
+	if last := c.last.Load(); last != nil {
+		config = last.Config
+	}
+	if c.identity.known(c.target, config) {
+		ch <- prometheus.MustNewConstMetric(c.Up, prometheus.GaugeValue, 0, c.identity.values(c.target, config)...)
+	}
+	ch <- prometheus.NewInvalidMetric(c.scrapeError, fmt.Errorf("target '%s' (scrape_id %s): %w", c.target.Name, scrapeID(ctx), err))
+}
+
+// snapshot takes a snapshot of the target and keeps it as the newest one.
+func (c *jsonCollector4) snapshot(ctx context.Context) (*keaSnapshot, error) {
+	start := time.Now()
+	snap, err := takeSnapshot(ctx, c.target)
+	scrapeStatus.record(c.target.Name, start, err)
 	if err != nil {
-		logger.Error("Could not query Kea config", "error", err)
-		return
+		return nil, err
 	}
-	logger.Debug("Sending stats to channel")
+	snap.Labels = c.labels
+	if last := c.last.Load(); last != nil {
+		// Only one snapshot is kept, not the whole chain.
+		prev := *last
+		prev.Prev = nil
+		snap.Prev = &prev
+	}
+	c.last.Store(snap)
+	return snap, nil
+}
+
+// collectGlobal sends the global metrics. id holds the identity label values.
+func (c *jsonCollector4) collectGlobal(ch chan<- prometheus.Metric, cooked *KeaCookedMetrics, id []string) {
 	ch <- prometheus.MustNewConstMetric(
-		c.CumulativeAssignedAddresses, prometheus.CounterValue, cooked.CumulativeAssignedAddresses)
+		c.CumulativeAssignedAddresses, prometheus.CounterValue, cooked.CumulativeAssignedAddresses, id...)
 	ch <- prometheus.MustNewConstMetric(
-		c.DeclinedAddresses, prometheus.GaugeValue, cooked.DeclinedAddresses)
+		c.DeclinedAddresses, prometheus.GaugeValue, cooked.DeclinedAddresses, id...)
 	ch <- prometheus.MustNewConstMetric(
-		c.Pkt4AckReceived, prometheus.CounterValue, cooked.Pkt4AckReceived)
+		c.Pkt4AckReceived, prometheus.CounterValue, cooked.Pkt4AckReceived, id...)
 	ch <- prometheus.MustNewConstMetric(
-		c.Pkt4AckSent, prometheus.CounterValue, cooked.Pkt4AckSent)
+		c.Pkt4AckSent, prometheus.CounterValue, cooked.Pkt4AckSent, id...)
 	ch <- prometheus.MustNewConstMetric(
-		c.Pkt4DeclineReceived, prometheus.CounterValue, cooked.Pkt4DeclineReceived)
+		c.Pkt4DeclineReceived, prometheus.CounterValue, cooked.Pkt4DeclineReceived, id...)
 	ch <- prometheus.MustNewConstMetric(
-		c.Pkt4DiscoverReceived, prometheus.CounterValue, cooked.Pkt4DiscoverReceived)
+		c.Pkt4DiscoverReceived, prometheus.CounterValue, cooked.Pkt4DiscoverReceived, id...)
 	ch <- prometheus.MustNewConstMetric(
-		c.Pkt4InformReceived, prometheus.CounterValue, cooked.Pkt4InformReceived)
+		c.Pkt4InformReceived, prometheus.CounterValue, cooked.Pkt4InformReceived, id...)
 	ch <- prometheus.MustNewConstMetric(
-		c.Pkt4NakReceived, prometheus.CounterValue, cooked.Pkt4NakReceived)
+		c.Pkt4NakReceived, prometheus.CounterValue, cooked.Pkt4NakReceived, id...)
 	ch <- prometheus.MustNewConstMetric(
-		c.Pkt4NakSent, prometheus.CounterValue, cooked.Pkt4NakSent)
+		c.Pkt4NakSent, prometheus.CounterValue, cooked.Pkt4NakSent, id...)
 	ch <- prometheus.MustNewConstMetric(
-		c.Pkt4OfferReceived, prometheus.CounterValue, cooked.Pkt4OfferReceived)
+		c.Pkt4OfferReceived, prometheus.CounterValue, cooked.Pkt4OfferReceived, id...)
 	ch <- prometheus.MustNewConstMetric(
-		c.Pkt4OfferSent, prometheus.CounterValue, cooked.Pkt4OfferSent)
+		c.Pkt4OfferSent, prometheus.CounterValue, cooked.Pkt4OfferSent, id...)
 	ch <- prometheus.MustNewConstMetric(
-		c.Pkt4ParseFailed, prometheus.CounterValue, cooked.Pkt4ParseFailed)
+		c.Pkt4ParseFailed, prometheus.CounterValue, cooked.Pkt4ParseFailed, id...)
 	ch <- prometheus.MustNewConstMetric(
-		c.Pkt4ReceiveDrop, prometheus.CounterValue, cooked.Pkt4ReceiveDrop)
+		c.Pkt4ReceiveDrop, prometheus.CounterValue, cooked.Pkt4ReceiveDrop, id...)
 	ch <- prometheus.MustNewConstMetric(
-		c.Pkt4Received, prometheus.CounterValue, cooked.Pkt4Received)
+		c.Pkt4Received, prometheus.CounterValue, cooked.Pkt4Received, id...)
 	ch <- prometheus.MustNewConstMetric(
-		c.Pkt4ReleaseReceived, prometheus.CounterValue, cooked.Pkt4ReleaseReceived)
+		c.Pkt4ReleaseReceived, prometheus.CounterValue, cooked.Pkt4ReleaseReceived, id...)
 	ch <- prometheus.MustNewConstMetric(
-		c.Pkt4RequestReceived, prometheus.CounterValue, cooked.Pkt4RequestReceived)
+		c.Pkt4RequestReceived, prometheus.CounterValue, cooked.Pkt4RequestReceived, id...)
 	ch <- prometheus.MustNewConstMetric(
-		c.Pkt4Sent, prometheus.CounterValue, cooked.Pkt4Sent)
+		c.Pkt4Sent, prometheus.CounterValue, cooked.Pkt4Sent, id...)
 	ch <- prometheus.MustNewConstMetric(
-		c.Pkt4UnknownReceived, prometheus.CounterValue, cooked.Pkt4UnknownReceived)
+		c.Pkt4UnknownReceived, prometheus.CounterValue, cooked.Pkt4UnknownReceived, id...)
 	ch <- prometheus.MustNewConstMetric(
-		c.ReclaimedDeclinedAddresses, prometheus.CounterValue, cooked.ReclaimedDeclinedAddresses)
+		c.ReclaimedDeclinedAddresses, prometheus.CounterValue, cooked.ReclaimedDeclinedAddresses, id...)
 	ch <- prometheus.MustNewConstMetric(
-		c.ReclaimedLeases, prometheus.CounterValue, cooked.ReclaimedLeases)
+		c.ReclaimedLeases, prometheus.CounterValue, cooked.ReclaimedLeases, id...)
 	ch <- prometheus.MustNewConstMetric(
-		c.V4AllocationFail, prometheus.CounterValue, cooked.V4AllocationFail)
+		c.V4AllocationFail, prometheus.CounterValue, cooked.V4AllocationFail, id...)
 	ch <- prometheus.MustNewConstMetric(
-		c.V4AllocationFailClasses, prometheus.CounterValue, cooked.V4AllocationFailClasses)
+		c.V4AllocationFailClasses, prometheus.CounterValue, cooked.V4AllocationFailClasses, id...)
 	ch <- prometheus.MustNewConstMetric(
-		c.V4AllocationFailNoPools, prometheus.CounterValue, cooked.V4AllocationFailNoPools)
+		c.V4AllocationFailNoPools, prometheus.CounterValue, cooked.V4AllocationFailNoPools, id...)
 	ch <- prometheus.MustNewConstMetric(
-		c.V4AllocationFailSharedNetwork, prometheus.CounterValue, cooked.V4AllocationFailSharedNetwork)
+		c.V4AllocationFailSharedNetwork, prometheus.CounterValue, cooked.V4AllocationFailSharedNetwork, id...)
 	ch <- prometheus.MustNewConstMetric(
-		c.V4AllocationFailSubnet, prometheus.CounterValue, cooked.V4AllocationFailSubnet)
+		c.V4AllocationFailSubnet, prometheus.CounterValue, cooked.V4AllocationFailSubnet, id...)
 	ch <- prometheus.MustNewConstMetric(
-		c.V4ReservationConflicts, prometheus.CounterValue, cooked.V4ReservationConflicts)
+		c.V4ReservationConflicts, prometheus.CounterValue, cooked.V4ReservationConflicts, id...)
+}
+
+// collectStartTime sends the start time of the Kea server. Failures are not
+// scrape errors, as Kea versions before 1.7.3 do not support status-get.
+func (c *jsonCollector4) collectStartTime(ctx context.Context, ch chan<- prometheus.Metric, id []string) {
+	if c.target.StatsFile != "" || c.agent {
+		// Through an agent, it is exported as the daemon start time.
+		return
+	}
+	status, err := queryStatus(ctx, c.target)
+	if err != nil {
+		logger.DebugContext(ctx, "Could not get Kea start time", "target", c.target.Name, "error", err)
+		return
+	}
+	start := status.startTime(time.Now())
+	ch <- prometheus.MustNewConstMetric(c.StartTime, prometheus.GaugeValue, float64(start.UnixNano())/1e9, id...)
+}
+
+// collectAnomalies sends the anomaly scores, baselines and ratios of the
+// packet counters. Those not known yet are left out.
+func (c *jsonCollector4) collectAnomalies(ch chan<- prometheus.Metric, id []string) {
+	if c.anomalies == nil {
+		return
+	}
+	scores, baselines, ratios, ok := c.anomalies.state(c.target.Name)
+	if !ok {
+		return
+	}
+	for i, ac := range anomalyCounters {
+		values := append(slices.Clone(id), ac.name)
+		if !math.IsNaN(scores[i]) {
+			ch <- prometheus.MustNewConstMetric(c.AnomalyScore, prometheus.GaugeValue, scores[i], values...)
+		}
+		if !math.IsNaN(baselines[i]) {
+			ch <- prometheus.MustNewConstMetric(c.AnomalyBaseline, prometheus.GaugeValue, baselines[i], values...)
+		}
+	}
+	for i, desc := range c.AnomalyRatios {
+		if !math.IsNaN(ratios[i]) {
+			ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, ratios[i], id...)
+		}
+	}
+}
+
+func (c *jsonCollector4) collectSubnets(ctx context.Context, ch chan<- prometheus.Metric, t time.Time, cooked *KeaCookedMetrics, config *KeaConfig, id []string) {
 	for _, subnetMetrics := range cooked.SubnetMetrics {
-		subnetvalues := []string{fmt.Sprintf("%d", subnetMetrics.SubnetIndex)}
+		subnetvalues := append(slices.Clone(id), fmt.Sprintf("%d", subnetMetrics.SubnetIndex))
 		sn, err := config.subnetFromID(4, subnetMetrics.SubnetIndex)
 		if err != nil {
-			logger.Error("v4 Subnet of index has no entry in the config", "subnetIndex", subnetMetrics.SubnetIndex)
+			logger.ErrorContext(ctx, "v4 Subnet of index has no entry in the config", "target", c.target.Name, "subnetIndex", subnetMetrics.SubnetIndex)
 			sn = "unknown"
 		}
 		subnetvalues = append(subnetvalues, sn)
-		ch <- prometheus.MustNewConstMetric(c.SubnetAssignedAddresses,
-			prometheus.GaugeValue, subnetMetrics.AssignedAddresses, subnetvalues...)
-		ch <- prometheus.MustNewConstMetric(c.SubnetAssignedAddressesTotal,
-			prometheus.CounterValue, subnetMetrics.CumulativeAssignedAddresses, subnetvalues...)
-		ch <- prometheus.MustNewConstMetric(c.SubnetDeclinedAddressesTotal,
-			prometheus.GaugeValue, subnetMetrics.DeclinedAddresses, subnetvalues...)
-		ch <- prometheus.MustNewConstMetric(c.SubnetReclaimedDeclinedAddressesTotal,
-			prometheus.CounterValue, subnetMetrics.ReclaimedDeclinedAddresses, subnetvalues...)
-		ch <- prometheus.MustNewConstMetric(c.SubnetReclaimedLeasesTotal,
-			prometheus.CounterValue, subnetMetrics.ReclaimedLeases, subnetvalues...)
-		ch <- prometheus.MustNewConstMetric(c.SubnetAddressesTotal,
-			prometheus.GaugeValue, subnetMetrics.TotalAddresses, subnetvalues...)
-		ch <- prometheus.MustNewConstMetric(c.SubnetReservationConflictsTotal,
-			prometheus.CounterValue, subnetMetrics.V4ReservationConflicts, subnetvalues...)
+		sc := config.Dhcp4.SubnetConfigs[subnetMetrics.SubnetIndex]
+		baseValues := subnetvalues
+		subnetvalues = append(slices.Clone(baseValues), c.userContext.values(sc.UserContext, sc.SharedNetworkContext)...)
+		if c.enabled.Subnets {
+			ch <- prometheus.MustNewConstMetric(c.SubnetAssignedAddresses,
+				prometheus.GaugeValue, subnetMetrics.AssignedAddresses, subnetvalues...)
+			ch <- prometheus.MustNewConstMetric(c.SubnetAssignedAddressesTotal,
+				prometheus.CounterValue, subnetMetrics.CumulativeAssignedAddresses, subnetvalues...)
+			ch <- prometheus.MustNewConstMetric(c.SubnetDeclinedAddressesTotal,
+				prometheus.GaugeValue, subnetMetrics.DeclinedAddresses, subnetvalues...)
+			ch <- prometheus.MustNewConstMetric(c.SubnetReclaimedDeclinedAddressesTotal,
+				prometheus.CounterValue, subnetMetrics.ReclaimedDeclinedAddresses, subnetvalues...)
+			ch <- prometheus.MustNewConstMetric(c.SubnetReclaimedLeasesTotal,
+				prometheus.CounterValue, subnetMetrics.ReclaimedLeases, subnetvalues...)
+			ch <- prometheus.MustNewConstMetric(c.SubnetAddressesTotal,
+				prometheus.GaugeValue, subnetMetrics.TotalAddresses, subnetvalues...)
+			ch <- prometheus.MustNewConstMetric(c.SubnetReservationConflictsTotal,
+				prometheus.CounterValue, subnetMetrics.V4ReservationConflicts, subnetvalues...)
+			c.collectForecast(ch, c.SubnetPredictedExhaustion, c.SubnetForecastUtilization, t,
+				seriesKey{c.target.Name, subnetMetrics.SubnetIndex, -1}, subnetMetrics.AssignedAddresses, subnetMetrics.TotalAddresses, subnetvalues)
+		}
+		if !c.enabled.Pools {
+			continue
+		}
 		for _, poolMetrics := range subnetMetrics.PoolMetrics {
-			poolValues := []string{fmt.Sprintf("%d", poolMetrics.PoolIndex)}
-			pn, err := config.subnetFromID(4, poolMetrics.PoolIndex)
-			if err != nil {
-				logger.Error("v4 Subnet in Pool has no entry in the config", "subnetIndex", subnetMetrics.SubnetIndex, "poolIndex", poolMetrics.PoolIndex)
-				pn = "unknown"
+			var poolContext map[string]any
+			if poolMetrics.PoolIndex < uint64(len(sc.Pools)) {
+				poolContext = sc.Pools[poolMetrics.PoolIndex].UserContext
 			}
-			poolValues = append(poolValues, pn)
+			poolValues := append(slices.Clone(baseValues), c.userContext.values(poolContext, sc.UserContext, sc.SharedNetworkContext)...)
+			poolValues = append(poolValues, fmt.Sprintf("%d", poolMetrics.PoolIndex))
 			ch <- prometheus.MustNewConstMetric(c.PoolTotalAddresses,
 				prometheus.GaugeValue, poolMetrics.TotalAddresses, poolValues...)
 			ch <- prometheus.MustNewConstMetric(c.PoolCumulativeAssignedAddresses,
@@ -234,7 +416,236 @@ func (c *jsonCollector4) Collect(ch chan<- prometheus.Metric) {
 				prometheus.GaugeValue, poolMetrics.DeclinedAddresses, poolValues...)
 			ch <- prometheus.MustNewConstMetric(c.PoolReclaimedDeclinedAddresses,
 				prometheus.GaugeValue, poolMetrics.ReclaimedDeclinedAddresses, poolValues...)
+			c.collectForecast(ch, c.PoolPredictedExhaustion, c.PoolForecastUtilization, t,
+				seriesKey{c.target.Name, subnetMetrics.SubnetIndex, int(poolMetrics.PoolIndex)}, poolMetrics.AssignedAddresses, poolMetrics.TotalAddresses, poolValues)
+		}
+	}
+}
+
+// collectForecast sends the predicted exhaustion and forecast utilization of
+// the subnet or pool k, if there is enough history to forecast it.
+func (c *jsonCollector4) collectForecast(ch chan<- prometheus.Metric, exhaustion, utilization *prometheus.Desc, t time.Time, k seriesKey, assigned, total float64, values []string) {
+	if c.forecaster == nil {
+		return
+	}
+	fc, ok := c.forecaster.forecast(k, t, assigned, total)
+	if !ok {
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(exhaustion, prometheus.GaugeValue, fc.Exhaustion, values...)
+	for i, hz := range forecastHorizons {
+		ch <- prometheus.MustNewConstMetric(utilization, prometheus.GaugeValue, fc.Utilization[i], append(slices.Clone(values), hz.label)...)
+	}
+}
+
+// subnetInfoLabels are the labels of the subnet info metric besides the
+// subnet labels. Unset parameters have empty values.
+var subnetInfoLabels = []string{
+	"shared_network", "interface", "relay_addresses", "client_class", "routers",
+	"valid_lifetime", "min_valid_lifetime", "max_valid_lifetime", "renew_timer", "rebind_timer",
+}
+
+// collectSubnetInfo sends the info metric and the valid lifetime of every
+// subnet in config.
+func (c *jsonCollector4) collectSubnetInfo(ch chan<- prometheus.Metric, config *KeaConfig, id []string) {
+	seconds := func(v *uint64) string {
+		if v == nil {
+			return ""
+		}
+		return strconv.FormatUint(*v, 10)
+	}
+	for _, subnetID := range sortedKeys(config.Dhcp4.SubnetConfigs) {
+		sc := config.Dhcp4.SubnetConfigs[subnetID]
+		p := sc.Effective
+		values := slices.Concat(id, []string{strconv.FormatUint(subnetID, 10), sc.Netname}, c.userContext.values(sc.UserContext, sc.SharedNetworkContext))
+		ch <- prometheus.MustNewConstMetric(c.SubnetInfo, prometheus.GaugeValue, 1, append(slices.Clone(values),
+			sc.SharedNetwork, p.Interface, strings.Join(p.relayAddresses(), ","), p.ClientClass, p.routers(),
+			seconds(p.ValidLifetime), seconds(p.MinValidLifetime), seconds(p.MaxValidLifetime), seconds(p.RenewTimer), seconds(p.RebindTimer))...)
+		if p.ValidLifetime != nil {
+			ch <- prometheus.MustNewConstMetric(c.SubnetValidLifetime, prometheus.GaugeValue, float64(*p.ValidLifetime), values...)
+		}
+	}
+}
+
+// collectConfigIssues sends the number of issues lintConfig finds, by check
+// and subnet. Checks without issues are left out.
+func (c *jsonCollector4) collectConfigIssues(ch chan<- prometheus.Metric, config *KeaConfig, cooked *KeaCookedMetrics, id []string) {
+	type key struct{ check, subnet string }
+	counts := make(map[key]int)
+	var keys []key
+	for _, is := range lintConfig(config, cooked) {
+		k := key{is.Check, is.Subnet}
+		if counts[k] == 0 {
+			keys = append(keys, k)
+		}
+		counts[k]++
+	}
+	for _, k := range keys {
+		ch <- prometheus.MustNewConstMetric(c.ConfigIssues, prometheus.GaugeValue, float64(counts[k]), append(slices.Clone(id), k.check, k.subnet)...)
+	}
+}
+
+// withLabel returns a copy of labels with name set to value.
+func withLabel(labels prometheus.Labels, name, value string) prometheus.Labels {
+	l := make(prometheus.Labels, len(labels)+1)
+	for k, v := range labels {
+		l[k] = v
+	}
+	l[name] = value
+	return l
+}
+
+// collectorSet holds one Kea collector per target, and one agent collector
+// per target that queries several daemons through a Control Agent. It is
+// registered as an unchecked collector, so the set of targets and their
+// labels can change on configuration reloads without re-registering anything.
+type collectorSet struct {
+	collectors atomic.Pointer[[]*jsonCollector4]
+	agents     atomic.Pointer[[]*agentCollector]
+	forecaster *forecaster      // kept across updates to keep the history
+	anomalies  *anomalyDetector // kept across updates to keep the baselines
+	observer   *observer        // kept across updates to keep the last observations
+}
+
+// update replaces the Kea collectors with ones built from cfg.
+func (cs *collectorSet) update(cfg *Config) {
+	collectors := make([]*jsonCollector4, 0, len(cfg.Targets))
+	var agents []*agentCollector
+	var fc *forecaster
+	if cfg.Forecast.Enabled {
+		if cs.forecaster == nil {
+			cs.forecaster = newForecaster()
+		}
+		cs.forecaster.configure(cfg.Forecast)
+		fc = cs.forecaster
+	}
+	var ad *anomalyDetector
+	if cfg.Anomaly.Enabled {
+		if cs.anomalies == nil {
+			cs.anomalies = newAnomalyDetector()
+		}
+		cs.anomalies.configure(cfg.Anomaly)
+		ad = cs.anomalies
+	}
+	if cs.observer == nil {
+		cs.observer = newObserver()
+	}
+	cs.observer.configure(cfg.Observe.Interval, fc, ad)
+	for _, t := range cfg.Targets {
+		labels := prometheus.Labels{}
+		for k, v := range cfg.Labels {
+			labels[k] = v
+		}
+		for k, v := range t.Labels {
+			labels[k] = v
+		}
+		if len(cfg.Targets) > 1 {
+			labels["target"] = t.Name
+		}
+		if len(t.Daemons) == 0 {
+			c := newKeaCollector(cfg, t, labels)
+			c.forecaster = fc
+			c.anomalies = ad
+			c.observer = cs.observer
+			collectors = append(collectors, c)
+			continue
+		}
+		var c4 *jsonCollector4
+		if slices.Contains(t.Daemons, "dhcp4") || slices.Contains(t.Daemons, "all") {
+			t4 := t
+			t4.service = "dhcp4"
+			c4 = newKeaCollector(cfg, t4, withLabel(labels, "daemon", "dhcp4"))
+			c4.agent = true
+			c4.forecaster = fc
+			c4.anomalies = ad
+			c4.observer = cs.observer
+			collectors = append(collectors, c4)
+		}
+		agents = append(agents, newAgentCollector(cfg.Namespace, t, c4, labels))
+	}
+	cs.collectors.Store(&collectors)
+	cs.agents.Store(&agents)
+}
+
+// snapshots returns the newest snapshot of every target that has been
+// collected successfully at least once.
+func (cs *collectorSet) snapshots() []*keaSnapshot {
+	collectors := cs.collectors.Load()
+	if collectors == nil {
+		return nil
+	}
+	var snaps []*keaSnapshot
+	for _, c := range *collectors {
+		if s := c.last.Load(); s != nil {
+			snaps = append(snaps, s)
+		}
+	}
+	return snaps
+}
+
+// refresh returns a snapshot of every target, in configuration order. Targets
+// whose newest snapshot is older than maxAge are queried again, in parallel;
+// the errors of those that fail are returned by target name.
+func (cs *collectorSet) refresh(ctx context.Context, maxAge time.Duration) ([]*keaSnapshot, map[string]error) {
+	collectors := cs.collectors.Load()
+	if collectors == nil {
+		return nil, nil
+	}
+	snaps := make([]*keaSnapshot, len(*collectors))
+	errs := make([]error, len(*collectors))
+	var wg sync.WaitGroup
+	for i, c := range *collectors {
+		if s := c.last.Load(); s != nil && time.Since(s.Time) < maxAge {
+			snaps[i] = s
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			snaps[i], errs[i] = c.snapshot(ctx)
+		}()
+	}
+	wg.Wait()
+	var ok []*keaSnapshot
+	failed := make(map[string]error)
+	for i, c := range *collectors {
+		if errs[i] != nil {
+			failed[c.target.Name] = errs[i]
+			continue
+		}
+		ok = append(ok, snaps[i])
+	}
+	return ok, failed
+}
+
+func (cs *collectorSet) Describe(chan<- *prometheus.Desc) {}
+
+func (cs *collectorSet) Collect(ch chan<- prometheus.Metric) {
+	collectors := cs.collectors.Load()
+	if collectors == nil {
+		return
+	}
+	// One scrape ID covers all targets queried for this scrape.
+	ctx := collectContext(newScrapeContext(context.Background()))
+	var wg sync.WaitGroup
+	for _, c := range *collectors {
+		if c.agent {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.collect(ctx, ch)
+		}()
+	}
+	if agents := cs.agents.Load(); agents != nil {
+		for _, a := range *agents {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				a.collect(ctx, ch)
+			}()
 		}
 	}
-	logger.Debug("Sending stats to channel complete")
+	wg.Wait()
 }
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+	dto "github.com/prometheus/client_model/go"
+)
+
+var (
+	pushInterval       = flag.Duration("push.interval", time.Minute, "Interval between pushes to push destinations")
+	pushGatewayURL     = flag.String("push.gateway.url", "", "if nonempty, push metrics to this Pushgateway")
+	pushGatewayJob     = flag.String("push.gateway.job", "kea", "Job name to push to the Pushgateway")
+	pushRemoteWriteURL = flag.String("push.remote-write.url", "", "if nonempty, send metrics to this Prometheus remote-write endpoint")
+)
+
+// PushConfig configures the destinations the metrics are periodically sent
+// to: a Pushgateway, a remote-write receiver, an OpenTelemetry collector,
+// InfluxDB and Graphite. The push subcommand sends only there; serve sends
+// there in addition to serving /metrics.
+type PushConfig struct {
+	Interval    time.Duration     `yaml:"interval"`
+	Pushgateway PushgatewayConfig `yaml:"pushgateway"`
+	RemoteWrite RemoteWriteConfig `yaml:"remote_write"`
+	OTLP        OTLPConfig        `yaml:"otlp"`
+	InfluxDB    InfluxDBConfig    `yaml:"influxdb"`
+	Graphite    GraphiteConfig    `yaml:"graphite"`
+}
+
+// PushgatewayConfig configures pushing to a Pushgateway. Every push replaces
+// all metrics in the group identified by Job and Grouping.
+type PushgatewayConfig struct {
+	URL      string            `yaml:"url"`
+	Job      string            `yaml:"job"`
+	Grouping map[string]string `yaml:"grouping"`
+	Timeout  time.Duration     `yaml:"timeout"`
+}
+
+// RemoteWriteConfig configures sending samples with the Prometheus
+// remote-write protocol. Samples that cannot be sent are queued in memory,
+// up to QueueCapacity samples; beyond that the oldest are dropped.
+type RemoteWriteConfig struct {
+	URL               string            `yaml:"url"`
+	Timeout           time.Duration     `yaml:"timeout"`
+	Headers           map[string]string `yaml:"headers"`
+	QueueCapacity     int               `yaml:"queue_capacity"`
+	MaxSamplesPerSend int               `yaml:"max_samples_per_send"`
+	MinBackoff        time.Duration     `yaml:"min_backoff"`
+	MaxBackoff        time.Duration     `yaml:"max_backoff"`
+}
+
+func defaultPushConfig() PushConfig {
+	return PushConfig{
+		Interval: flagDuration("push.interval"),
+		Pushgateway: PushgatewayConfig{
+			Job:     flagDefault("push.gateway.job"),
+			Timeout: 10 * time.Second,
+		},
+		RemoteWrite: RemoteWriteConfig{
+			Timeout:           30 * time.Second,
+			QueueCapacity:     100000,
+			MaxSamplesPerSend: 5000,
+			MinBackoff:        500 * time.Millisecond,
+			MaxBackoff:        time.Minute,
+		},
+		OTLP: OTLPConfig{
+			Protocol: flagDefault("push.otlp.protocol"),
+			Timeout:  10 * time.Second,
+		},
+		InfluxDB: InfluxDBConfig{
+			Timeout:      10 * time.Second,
+			Measurements: NameTemplates{Global: "kea", Subnet: "kea_subnet", Pool: "kea_pool"},
+		},
+		Graphite: GraphiteConfig{
+			Timeout: 10 * time.Second,
+			Paths: NameTemplates{
+				Global: "kea.{{.Target}}.{{.Metric}}",
+				Subnet: "kea.{{.Target}}.subnet.{{.Prefix}}.{{.Metric}}",
+				Pool:   "kea.{{.Target}}.subnet.{{.Prefix}}.pool.{{.Pool}}.{{.Metric}}",
+			},
+		},
+	}
+}
+
+// newPushRegistry returns a registry with the Kea collectors in kc and the
+// exporter's own metrics, which are sent along so push problems can be
+// monitored as well.
+func newPushRegistry(kc *collectorSet) *prometheus.Registry {
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(kc)
+	registerSelfMetrics(reg)
+	registerPushMetrics(reg)
+	return reg
+}
+
+// partialGatherer gathers from g and logs errors instead of returning them,
+// so a failing target does not keep the metrics of the others from being
+// pushed. This matches what /metrics returns in the same situation.
+func partialGatherer(ctx context.Context, g prometheus.Gatherer) prometheus.Gatherer {
+	return prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		mfs, err := g.Gather()
+		if err != nil {
+			logger.ErrorContext(ctx, "Could not collect all metrics", "error", err)
+		}
+		return mfs, nil
+	})
+}
+
+func newPusher(cfg PushgatewayConfig, g prometheus.Gatherer) *push.Pusher {
+	p := push.New(cfg.URL, cfg.Job).Gatherer(g).Client(&http.Client{Timeout: cfg.Timeout})
+	for k, v := range cfg.Grouping {
+		p = p.Grouping(k, v)
+	}
+	return p
+}
+
+// pushDestinations holds the configured destinations; unconfigured ones
+// are nil. InfluxDB and Graphite are written from the snapshots in kc
+// rather than from the gathered metrics.
+type pushDestinations struct {
+	pusher   *push.Pusher
+	rw       *remoteWriter
+	otlp     *otlpPusher
+	influx   *influxWriter
+	graphite *graphiteWriter
+	kc       *collectorSet
+	mfs      []*dto.MetricFamily // gathered by the current push
+}
+
+// gatherer returns a gatherer of the metrics of the current push, for the
+// Pushgateway, so it does not gather again.
+func (d *pushDestinations) gatherer() prometheus.Gatherer {
+	return prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		return d.mfs, nil
+	})
+}
+
+// newPushDestinations sets up the destinations configured in cfg. The
+// remote writer's sender runs until ctx is done.
+func newPushDestinations(ctx context.Context, cfg *Config, kc *collectorSet) (*pushDestinations, error) {
+	pc := cfg.Push
+	d := &pushDestinations{kc: kc}
+	if pc.Pushgateway.URL != "" {
+		d.pusher = newPusher(pc.Pushgateway, d.gatherer())
+	}
+	if pc.RemoteWrite.URL != "" {
+		d.rw = newRemoteWriter(pc.RemoteWrite)
+		go d.rw.run(ctx)
+	}
+	if pc.OTLP.Endpoint != "" {
+		var err error
+		d.otlp, err = newOTLPPusher(ctx, pc.OTLP, cfg.Namespace)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if pc.InfluxDB.URL != "" {
+		var err error
+		d.influx, err = newInfluxWriter(pc.InfluxDB, cfg.Collectors)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if pc.Graphite.Address != "" {
+		var err error
+		d.graphite, err = newGraphiteWriter(pc.Graphite, cfg.Collectors)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return d, nil
+}
+
+func (cfg PushConfig) enabled() bool {
+	return cfg.Pushgateway.URL != "" || cfg.RemoteWrite.URL != "" || cfg.OTLP.Endpoint != "" ||
+		cfg.InfluxDB.URL != "" || cfg.Graphite.Address != ""
+}
+
+// runPush gathers and sends the metrics every push.interval until it is
+// terminated.
+func runPush(cfg *Config) int {
+	if !cfg.Push.enabled() {
+		logger.Error("Push mode requires at least one of a Pushgateway, remote-write, OTLP, InfluxDB or Graphite endpoint")
+		return 2
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	kc := &collectorSet{}
+	kc.update(cfg)
+	r := &reloader{path: *configFile, collectors: kc}
+	go r.watchSignals()
+	if err := pushLoop(ctx, cfg, kc); err != nil {
+		logger.Error("Could not set up push destinations", "error", err)
+		return 1
+	}
+	logger.Info("Exiting on signal")
+	return 0
+}
+
+// pushLoop pushes the metrics of kc to the destinations in cfg every
+// push.interval until ctx is done.
+func pushLoop(ctx context.Context, cfg *Config, kc *collectorSet) error {
+	reg := newPushRegistry(kc)
+	dests, err := newPushDestinations(ctx, cfg, kc)
+	if err != nil {
+		return err
+	}
+	pc := cfg.Push
+	logger.Info("Pushing metrics", "interval", pc.Interval, "pushgateway", pc.Pushgateway.URL, "remoteWrite", pc.RemoteWrite.URL, "otlp", pc.OTLP.Endpoint, "influxdb", pc.InfluxDB.URL, "graphite", pc.Graphite.Address)
+	ticker := time.NewTicker(pc.Interval)
+	defer ticker.Stop()
+	for {
+		pushOnce(ctx, reg, dests)
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			dests.shutdown()
+			return nil
+		}
+	}
+}
+
+// pushOnce gathers the metrics once and hands them to every destination.
+func pushOnce(ctx context.Context, reg prometheus.Gatherer, d *pushDestinations) {
+	ctx = newScrapeContext(ctx)
+	start := time.Now()
+	mfs, _ := partialGatherer(ctx, reg).Gather()
+	now := time.Now()
+	if d.pusher != nil {
+		d.mfs = mfs
+		if err := d.pusher.PushContext(ctx); err != nil {
+			logger.ErrorContext(ctx, "Could not push to Pushgateway", "error", err)
+			pushesTotal.WithLabelValues("pushgateway", "error").Inc()
+		} else {
+			pushesTotal.WithLabelValues("pushgateway", "success").Inc()
+		}
+		d.mfs = nil
+	}
+	if d.rw != nil {
+		d.rw.enqueue(mfs, now)
+	}
+	if d.otlp != nil {
+		if err := d.otlp.export(ctx, mfs, now); err != nil {
+			logger.ErrorContext(ctx, "Could not export to OTLP endpoint", "error", err)
+			pushesTotal.WithLabelValues("otlp", "error").Inc()
+		} else {
+			pushesTotal.WithLabelValues("otlp", "success").Inc()
+		}
+	}
+	if d.influx == nil && d.graphite == nil {
+		return
+	}
+	// Gathering took a fresh snapshot of every target that could be
+	// reached; older ones are not sent again.
+	var snaps []*keaSnapshot
+	for _, s := range d.kc.snapshots() {
+		if !s.Time.Before(start) {
+			snaps = append(snaps, s)
+		}
+	}
+	if d.influx != nil {
+		if err := d.influx.write(ctx, snaps); err != nil {
+			logger.ErrorContext(ctx, "Could not write to InfluxDB", "error", err)
+			pushesTotal.WithLabelValues("influxdb", "error").Inc()
+		} else {
+			pushesTotal.WithLabelValues("influxdb", "success").Inc()
+		}
+	}
+	if d.graphite != nil {
+		if err := d.graphite.write(ctx, snaps); err != nil {
+			logger.ErrorContext(ctx, "Could not write to Graphite", "error", err)
+			pushesTotal.WithLabelValues("graphite", "error").Inc()
+		} else {
+			pushesTotal.WithLabelValues("graphite", "success").Inc()
+		}
+	}
+}
+
+func (d *pushDestinations) shutdown() {
+	if d.otlp != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := d.otlp.exporter.Shutdown(ctx); err != nil {
+			logger.Error("Could not shut down OTLP exporter", "error", err)
+		}
+	}
+}
+
+func (cfg PushConfig) validate() error {
+	var errs []error
+	if cfg.Interval <= 0 {
+		errs = append(errs, fmt.Errorf("push.interval: must be positive, got %s", cfg.Interval))
+	}
+	if cfg.Pushgateway.URL != "" {
+		if _, err := url.Parse(cfg.Pushgateway.URL); err != nil {
+			errs = append(errs, fmt.Errorf("push.pushgateway.url: %w", err))
+		}
+		if cfg.Pushgateway.Job == "" {
+			errs = append(errs, errors.New("push.pushgateway.job: must not be empty"))
+		}
+		errs = append(errs, validateLabels("push.pushgateway.grouping", cfg.Pushgateway.Grouping)...)
+	}
+	rw := cfg.RemoteWrite
+	if rw.URL != "" {
+		if _, err := url.Parse(rw.URL); err != nil {
+			errs = append(errs, fmt.Errorf("push.remote_write.url: %w", err))
+		}
+		if rw.QueueCapacity <= 0 {
+			errs = append(errs, fmt.Errorf("push.remote_write.queue_capacity: must be positive, got %d", rw.QueueCapacity))
+		}
+		if rw.MaxSamplesPerSend <= 0 {
+			errs = append(errs, fmt.Errorf("push.remote_write.max_samples_per_send: must be positive, got %d", rw.MaxSamplesPerSend))
+		}
+		if rw.MinBackoff <= 0 || rw.MaxBackoff < rw.MinBackoff {
+			errs = append(errs, fmt.Errorf("push.remote_write: need 0 < min_backoff <= max_backoff, got %s and %s", rw.MinBackoff, rw.MaxBackoff))
+		}
+	}
+	if err := cfg.OTLP.validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := cfg.InfluxDB.validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := cfg.Graphite.validate(); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+func TestPushgateway(t *testing.T) {
+	type push struct {
+		method, path string
+		body         []byte
+	}
+	pushes := make(chan push, 1)
+	gw := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		pushes <- push{r.Method, r.URL.Path, body}
+	}))
+	defer gw.Close()
+
+	cfg := fixtureConfig("kea-2.4")
+	cfg.Push.Pushgateway.URL = gw.URL
+	cfg.Push.Pushgateway.Grouping = map[string]string{"instance": "dhcp1"}
+	kc := &collectorSet{}
+	kc.update(cfg)
+	reg := newPushRegistry(kc)
+	d, err := newPushDestinations(context.Background(), cfg, kc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pushOnce(context.Background(), reg, d)
+
+	p := <-pushes
+	if p.method != http.MethodPut || p.path != "/metrics/job/kea/instance/dhcp1" {
+		t.Errorf("got %s %s, want PUT /metrics/job/kea/instance/dhcp1", p.method, p.path)
+	}
+	if !strings.Contains(string(p.body), "kea_subnet_addresses") {
+		t.Errorf("pushed metrics do not contain kea_subnet_addresses")
+	}
+}
+
+// decodeWriteRequest decodes a snappy-compressed remote-write request into
+// one map of labels per series, with the sample value under "value".
+func decodeWriteRequest(t *testing.T, body []byte) []map[string]string {
+	t.Helper()
+	raw, err := snappy.Decode(nil, body)
+	if err != nil {
+		t.Fatalf("snappy: %v", err)
+	}
+	fields := func(b []byte, f func(num protowire.Number, v []byte, u uint64)) {
+		for len(b) > 0 {
+			num, typ, n := protowire.ConsumeTag(b)
+			if n < 0 {
+				t.Fatalf("bad tag: %v", protowire.ParseError(n))
+			}
+			b = b[n:]
+			switch typ {
+			case protowire.BytesType:
+				v, n := protowire.ConsumeBytes(b)
+				if n < 0 {
+					t.Fatalf("bad bytes: %v", protowire.ParseError(n))
+				}
+				f(num, v, 0)
+				b = b[n:]
+			case protowire.Fixed64Type:
+				v, n := protowire.ConsumeFixed64(b)
+				f(num, nil, v)
+				b = b[n:]
+			case protowire.VarintType:
+				v, n := protowire.ConsumeVarint(b)
+				f(num, nil, v)
+				b = b[n:]
+			default:
+				t.Fatalf("unexpected wire type %d", typ)
+			}
+		}
+	}
+	var series []map[string]string
+	fields(raw, func(_ protowire.Number, ts []byte, _ uint64) {
+		s := make(map[string]string)
+		fields(ts, func(num protowire.Number, v []byte, _ uint64) {
+			switch num {
+			case 1:
+				var name string
+				fields(v, func(num protowire.Number, v []byte, _ uint64) {
+					if num == 1 {
+						name = string(v)
+					} else {
+						s[name] = string(v)
+					}
+				})
+			case 2:
+				fields(v, func(num protowire.Number, _ []byte, u uint64) {
+					if num == 1 {
+						s["value"] = strconv.FormatFloat(math.Float64frombits(u), 'g', -1, 64)
+					}
+				})
+			}
+		})
+		series = append(series, s)
+	})
+	return series
+}
+
+// rwReceiver is a remote-write receiver that answers with the given status
+// codes in turn, repeating the last one.
+type rwReceiver struct {
+	t        *testing.T
+	statuses []int
+
+	mu       sync.Mutex
+	requests int
+	series   []map[string]string
+	accepted chan struct{}
+}
+
+func newRWReceiver(t *testing.T, statuses ...int) (*rwReceiver, string) {
+	rr := &rwReceiver{t: t, statuses: statuses, accepted: make(chan struct{}, 100)}
+	srv := httptest.NewServer(rr)
+	t.Cleanup(srv.Close)
+	return rr, srv.URL
+}
+
+func (rr *rwReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Content-Encoding") != "snappy" || r.Header.Get("Content-Type") != "application/x-protobuf" {
+		rr.t.Errorf("unexpected headers %v", r.Header)
+	}
+	body, _ := io.ReadAll(r.Body)
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+	status := rr.statuses[min(rr.requests, len(rr.statuses)-1)]
+	rr.requests++
+	if status/100 == 2 {
+		rr.series = append(rr.series, decodeWriteRequest(rr.t, body)...)
+		rr.accepted <- struct{}{}
+	}
+	w.WriteHeader(status)
+}
+
+func testRemoteWriteConfig(url string) RemoteWriteConfig {
+	cfg := defaultPushConfig().RemoteWrite
+	cfg.URL = url
+	cfg.MinBackoff = time.Millisecond
+	cfg.MaxBackoff = 10 * time.Millisecond
+	return cfg
+}
+
+func TestRemoteWriteRetry(t *testing.T) {
+	rr, url := newRWReceiver(t, http.StatusServiceUnavailable, http.StatusTooManyRequests, http.StatusNoContent)
+	cfg := fixtureConfig("kea-2.4")
+	kc := &collectorSet{}
+	kc.update(cfg)
+	reg := newPushRegistry(kc)
+	rw := newRemoteWriter(testRemoteWriteConfig(url))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go rw.run(ctx)
+	pushOnce(ctx, reg, &pushDestinations{rw: rw})
+
+	select {
+	case <-rr.accepted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no samples accepted")
+	}
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+	if rr.requests != 3 {
+		t.Errorf("receiver got %d requests, want 3", rr.requests)
+	}
+	var found bool
+	for _, s := range rr.series {
+		if s["__name__"] == "kea_subnet_addresses" && s["subnet"] == "192.0.2.0/24" {
+			found = true
+			if s["value"] != "191" || s["subnetidx"] != "1" {
+				t.Errorf("got series %v, want subnetidx 1 and value 191", s)
+			}
+		}
+	}
+	if !found {
+		t.Errorf("kea_subnet_addresses for 192.0.2.0/24 not received")
+	}
+}
+
+func TestRemoteWriteQueue(t *testing.T) {
+	rr, url := newRWReceiver(t, http.StatusBadRequest, http.StatusOK)
+	cfg := testRemoteWriteConfig(url)
+	cfg.MaxSamplesPerSend = 1
+	cfg.QueueCapacity = 2
+	rw := newRemoteWriter(cfg)
+	var mfs []*dto.MetricFamily
+	for _, name := range []string{"a", "b", "c"} {
+		g := prometheus.NewGauge(prometheus.GaugeOpts{Name: name})
+		reg := prometheus.NewRegistry()
+		reg.MustRegister(g)
+		m, _ := reg.Gather()
+		mfs = append(mfs, m...)
+	}
+	// Three samples in batches of one, the oldest is dropped.
+	rw.enqueue(mfs, time.Now())
+	if rw.samples != 2 || rw.queue[0][0].labels[0].value != "b" {
+		t.Fatalf("queue holds %d samples starting with %v, want b and c", rw.samples, rw.queue[0][0].labels)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go rw.run(ctx)
+	select {
+	case <-rr.accepted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no samples accepted")
+	}
+	// b was rejected with 400 and not retried, c was accepted.
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+	if rr.requests != 2 || len(rr.series) != 1 || rr.series[0]["__name__"] != "c" {
+		t.Errorf("got %d requests and series %v, want 2 requests and only c accepted", rr.requests, rr.series)
+	}
+}
@@ -1,10 +1,18 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
 	"fmt"
 	"io"
 	"net"
+	"net/http"
 	"os"
+	"strings"
+	"time"
 )
 
 func getRawJSONFromFile(path string) ([]byte, error) {
@@ -15,30 +23,232 @@ func getRawJSONFromFile(path string) ([]byte, error) {
 	return rawJSON, nil
 }
 
-func reader(r io.Reader, rc chan []byte) {
-	var acc []byte
-	buf := make([]byte, 1024)
+type readResult struct {
+	data []byte
+	err  error
+}
+
+// reader reads from r until EOF. Any other error, such as hitting the
+// deadline, is passed on along with what was read so far.
+func reader(r io.Reader, rc chan readResult) {
+	var b bytes.Buffer
+	_, err := b.ReadFrom(r)
+	rc <- readResult{b.Bytes(), err}
+}
+
+// countingReader counts the bytes read through it and keeps the first error
+// other than io.EOF, so that failing to read can be told from failing to
+// parse.
+type countingReader struct {
+	r   io.Reader
+	n   int64
+	err error
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	if err != nil && err != io.EOF && c.err == nil {
+		c.err = err
+	}
+	return n, err
+}
+
+// keaCommand builds a Kea command. The service is only needed when talking
+// to the Control Agent, which forwards the command to the named daemon.
+func keaCommand(command, service string) []byte {
+	cmd := struct {
+		Command string   `json:"command"`
+		Service []string `json:"service,omitempty"`
+	}{Command: command}
+	if service != "" {
+		cmd.Service = []string{service}
+	}
+	q, _ := json.Marshal(cmd)
+	return q
+}
+
+// recordName is the directory of the target's recordings. Daemons behind a
+// Control Agent get a subdirectory each.
+func (t TargetConfig) recordName() string {
+	if t.service == "" {
+		return t.Name
+	}
+	return t.Name + "/" + t.service
+}
+
+// queryKea sends command to the target, using whichever transport the target
+// is configured for. If replay is enabled, the answer comes from a recording
+// instead; if recording is enabled, the answer is saved.
+func queryKea(ctx context.Context, t TargetConfig, command string) ([]byte, error) {
+	var rec RecordConfig
+	var rep ReplayConfig
+	if cfg := currentConfig(); cfg != nil {
+		rec, rep = cfg.Record, cfg.Replay
+	}
+	start := time.Now()
+	var resp []byte
+	var err error
+	switch {
+	case rep.Dir != "":
+		resp, err = getReplayer(rep).response(t.recordName(), command, isCollect(ctx))
+	case t.URL != "":
+		resp, err = queryKeaHTTP(ctx, t.URL, t.Timeout, keaCommand(command, t.agentService()))
+	default:
+		resp, err = queryKeaOnce(ctx, t.Socket, t.Timeout, keaCommand(command, ""))
+	}
+	logger.DebugContext(ctx, "Queried Kea", "target", t.Name, "service", t.service, "command", command, "bytes", len(resp), "duration", time.Since(start), "error", err)
+	if err == nil && rec.Dir != "" {
+		if rerr := recordResponse(rec, t.recordName(), command, start, resp); rerr != nil {
+			logger.ErrorContext(ctx, "Could not record Kea response", "target", t.Name, "command", command, "error", rerr)
+		}
+	}
+	return resp, err
+}
+
+// agentService is the service a Control Agent is to forward commands for t
+// to, "" for the agent itself.
+func (t TargetConfig) agentService() string {
+	service := cmp.Or(t.service, "dhcp4")
+	if service == controlAgentService {
+		return ""
+	}
+	return service
+}
+
+// openKea sends command to the target like queryKea, but returns the answer
+// as a stream, so that a large one is parsed as it arrives rather than held
+// in memory as a whole. The caller must close it. Recording and replay work
+// on whole responses, so with either the answer comes from queryKea.
+func openKea(ctx context.Context, t TargetConfig, command string) (io.ReadCloser, error) {
+	if cfg := currentConfig(); cfg != nil && (cfg.Record.Dir != "" || cfg.Replay.Dir != "") {
+		resp, err := queryKea(ctx, t, command)
+		if err != nil {
+			return nil, err
+		}
+		return io.NopCloser(bytes.NewReader(resp)), nil
+	}
+	var r io.ReadCloser
+	var err error
+	if t.URL != "" {
+		r, err = openKeaHTTP(ctx, t.URL, t.Timeout, keaCommand(command, t.agentService()))
+	} else {
+		r, err = openKeaSocket(ctx, t.Socket, t.Timeout, keaCommand(command, ""))
+	}
+	logger.DebugContext(ctx, "Opened Kea response", "target", t.Name, "service", t.service, "command", command, "error", err)
+	return r, err
+}
+
+// openKeaSocket sends query to the control socket at sockPath and returns
+// the connection to read the answer from. The timeout covers reading it.
+func openKeaSocket(ctx context.Context, sockPath string, timeout time.Duration, query []byte) (io.ReadCloser, error) {
+	d := net.Dialer{Timeout: timeout}
+	c, err := d.DialContext(ctx, "unix", sockPath)
+	if err != nil {
+		return nil, err
+	}
+	if timeout > 0 {
+		if err := c.SetDeadline(time.Now().Add(timeout)); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	if _, err := c.Write(query); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// openKeaHTTP sends query to a Kea Control Agent and returns its answer
+// positioned at the first response of the list, for a decoder that stops
+// after one JSON value.
+func openKeaHTTP(ctx context.Context, url string, timeout time.Duration, query []byte) (io.ReadCloser, error) {
+	client := http.Client{Timeout: timeout}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(query))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("control agent returned HTTP status %s", resp.Status)
+	}
+	br := bufio.NewReader(resp.Body)
 	for {
-		n, err := r.Read(buf)
+		b, err := br.ReadByte()
 		if err != nil {
+			resp.Body.Close()
+			return nil, fmt.Errorf("could not parse control agent response: %w", err)
+		}
+		if b == '[' {
 			break
 		}
-		acc = append(acc, buf[:n]...)
+		if !strings.ContainsRune(" \t\r\n", rune(b)) {
+			resp.Body.Close()
+			return nil, fmt.Errorf("could not parse control agent response: want a list, got %q", b)
+		}
 	}
-	rc <- acc
+	return struct {
+		io.Reader
+		io.Closer
+	}{br, resp.Body}, nil
 }
 
-func queryKeaOnce(query string) ([]byte, error) {
-	c, err := net.Dial("unix", *sockPath)
+func queryKeaOnce(ctx context.Context, sockPath string, timeout time.Duration, query []byte) ([]byte, error) {
+	d := net.Dialer{Timeout: timeout}
+	c, err := d.DialContext(ctx, "unix", sockPath)
 	if err != nil {
 		return nil, err
 	}
-	rc := make(chan []byte, 2)
+	defer c.Close()
+	if timeout > 0 {
+		if err := c.SetDeadline(time.Now().Add(timeout)); err != nil {
+			return nil, err
+		}
+	}
+	rc := make(chan readResult, 2)
 	go reader(c, rc)
-	_, err = c.Write([]byte(query))
+	_, err = c.Write(query)
 	if err != nil {
 		return nil, err
 	}
 
-	return <-rc, nil
+	res := <-rc
+	return res.data, res.err
+}
+
+// queryKeaHTTP sends query to a Kea Control Agent. The agent answers with a
+// list of responses, one per service; only the first one is returned.
+func queryKeaHTTP(ctx context.Context, url string, timeout time.Duration, query []byte) ([]byte, error) {
+	client := http.Client{Timeout: timeout}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(query))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("control agent returned HTTP status %s", resp.Status)
+	}
+	var responses []json.RawMessage
+	if err := json.Unmarshal(body, &responses); err != nil {
+		return nil, fmt.Errorf("could not parse control agent response: %w", err)
+	}
+	if len(responses) == 0 {
+		return nil, fmt.Errorf("control agent returned no responses")
+	}
+	return responses[0], nil
 }
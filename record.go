@@ -0,0 +1,266 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	recordDir  = flag.String("record.dir", "", "if nonempty, save every raw Kea response to this directory")
+	replayDir  = flag.String("replay.dir", "", "if nonempty, answer Kea commands from responses previously saved with -record.dir")
+	replayMode = flag.String("replay.mode", "scrape", "Replay pace: 'scrape' serves the next snapshot on every query, 'realtime' follows the recorded timestamps")
+)
+
+// Recorded responses are stored as <dir>/<target>/<command>/<time>.json,
+// where time is in recordTimeFormat. The format sorts lexically in time order.
+const recordTimeFormat = "20060102T150405.000000000Z"
+
+var replayModes = []string{"scrape", "realtime"}
+
+// RecordConfig configures saving of raw Kea responses. Responses older than
+// MaxAge are removed, as are the oldest ones of a target and command once
+// they take up more than MaxBytes; zero means no limit.
+type RecordConfig struct {
+	Dir      string        `yaml:"dir"`
+	MaxAge   time.Duration `yaml:"max_age"`
+	MaxBytes int64         `yaml:"max_bytes"`
+}
+
+func (cfg RecordConfig) validate() error {
+	var errs []error
+	if cfg.MaxAge < 0 {
+		errs = append(errs, fmt.Errorf("record.max_age: must not be negative, got %s", cfg.MaxAge))
+	}
+	if cfg.MaxBytes < 0 {
+		errs = append(errs, fmt.Errorf("record.max_bytes: must not be negative, got %d", cfg.MaxBytes))
+	}
+	return errors.Join(errs...)
+}
+
+// ReplayConfig configures answering Kea commands from recorded responses
+// instead of querying Kea. When the recording is exhausted, the last
+// snapshot is served, or replay starts over if Loop is set.
+type ReplayConfig struct {
+	Dir  string `yaml:"dir"`
+	Mode string `yaml:"mode"`
+	Loop bool   `yaml:"loop"`
+}
+
+func recordResponse(cfg RecordConfig, target, command string, t time.Time, resp []byte) error {
+	d := filepath.Join(cfg.Dir, target, command)
+	if err := os.MkdirAll(d, 0o755); err != nil {
+		return err
+	}
+	// A concurrent replay must never see a partial response.
+	if err := writeFileAtomic(filepath.Join(d, t.UTC().Format(recordTimeFormat)+".json"), resp, 0o600); err != nil {
+		return err
+	}
+	return pruneRecording(cfg, d, t)
+}
+
+// pruneRecording removes the responses in dir that are older than
+// cfg.MaxAge at t, and the oldest ones beyond cfg.MaxBytes. The newest
+// response is always kept, and files that are not recorded responses are
+// left alone.
+func pruneRecording(cfg RecordConfig, dir string, t time.Time) error {
+	if cfg.MaxAge == 0 && cfg.MaxBytes == 0 {
+		return nil
+	}
+	// Sorted by name, which is oldest first.
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	var size int64
+	var errs []error
+	kept := 0
+	for i := len(entries) - 1; i >= 0; i-- {
+		e := entries[i]
+		name, ok := strings.CutSuffix(e.Name(), ".json")
+		if !ok || e.IsDir() {
+			continue
+		}
+		rt, err := time.Parse(recordTimeFormat, name)
+		if err != nil {
+			continue
+		}
+		fi, err := e.Info()
+		if err != nil {
+			continue
+		}
+		size += fi.Size()
+		if kept > 0 && (cfg.MaxAge > 0 && t.Sub(rt) > cfg.MaxAge || cfg.MaxBytes > 0 && size > cfg.MaxBytes) {
+			if err := os.Remove(filepath.Join(dir, e.Name())); err != nil {
+				errs = append(errs, err)
+			}
+			continue
+		}
+		kept++
+	}
+	return errors.Join(errs...)
+}
+
+// writeFileAtomic writes data to a temporary file in the directory of name
+// and renames it to name, so readers see either the old or the new content.
+// The temporary file name starts with a dot and has no extension, so tools
+// that pick up files by extension ignore it.
+func writeFileAtomic(name string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(name), "."+filepath.Base(name)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), name)
+}
+
+type snapshot struct {
+	path string
+	t    time.Time
+}
+
+type replaySequence struct {
+	snapshots []snapshot
+	next      int
+	served    int // the snapshot served last in scrape mode, -1 for none
+}
+
+// replayer serves recorded responses, keeping track of the position in the
+// recording separately for every target and command.
+type replayer struct {
+	cfg   ReplayConfig
+	start time.Time
+
+	mu   sync.Mutex
+	seqs map[string]*replaySequence
+}
+
+var (
+	replayerMu     sync.Mutex
+	activeReplayer *replayer
+)
+
+// getReplayer returns the replayer for cfg. A new replayer, starting from
+// the beginning of the recording, is only created when cfg changes.
+func getReplayer(cfg ReplayConfig) *replayer {
+	replayerMu.Lock()
+	defer replayerMu.Unlock()
+	if activeReplayer == nil || activeReplayer.cfg != cfg {
+		activeReplayer = &replayer{cfg: cfg, start: time.Now(), seqs: make(map[string]*replaySequence)}
+	}
+	return activeReplayer
+}
+
+func loadSnapshots(dir string) ([]snapshot, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var snaps []snapshot
+	for _, e := range entries {
+		name, ok := strings.CutSuffix(e.Name(), ".json")
+		if !ok || e.IsDir() {
+			continue
+		}
+		t, err := time.Parse(recordTimeFormat, name)
+		if err != nil {
+			return nil, fmt.Errorf("unexpected file name '%s' in recording: %w", e.Name(), err)
+		}
+		snaps = append(snaps, snapshot{filepath.Join(dir, e.Name()), t})
+	}
+	if len(snaps) == 0 {
+		return nil, fmt.Errorf("no recorded responses in '%s'", dir)
+	}
+	sort.Slice(snaps, func(i, j int) bool { return snaps[i].t.Before(snaps[j].t) })
+	return snaps, nil
+}
+
+// response returns the recorded response to command for target. In scrape
+// mode, only a query with advance set moves on to the next snapshot; others
+// get the one served last again.
+func (r *replayer) response(target, command string, advance bool) ([]byte, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	key := target + "/" + command
+	seq, ok := r.seqs[key]
+	if !ok {
+		snaps, err := loadSnapshots(filepath.Join(r.cfg.Dir, target, command))
+		if err != nil {
+			return nil, err
+		}
+		seq = &replaySequence{snapshots: snaps, served: -1}
+		r.seqs[key] = seq
+	}
+	var i int
+	switch r.cfg.Mode {
+	case "realtime":
+		i = seq.realtimeIndex(time.Since(r.start), r.cfg.Loop)
+	default:
+		if !advance {
+			i = max(seq.served, 0)
+			break
+		}
+		i = seq.next
+		seq.served = i
+		seq.next++
+		if seq.next == len(seq.snapshots) {
+			if r.cfg.Loop {
+				seq.next = 0
+			} else {
+				seq.next = len(seq.snapshots) - 1
+			}
+		}
+	}
+	logger.Debug("Replaying Kea response", "target", target, "command", command, "snapshot", seq.snapshots[i].path)
+	return os.ReadFile(seq.snapshots[i].path)
+}
+
+// realtimeIndex returns the newest snapshot that was recorded no later than
+// elapsed after the first one.
+func (seq *replaySequence) realtimeIndex(elapsed time.Duration, loop bool) int {
+	first := seq.snapshots[0].t
+	total := seq.snapshots[len(seq.snapshots)-1].t.Sub(first)
+	if loop && total > 0 {
+		elapsed %= total
+	}
+	i := sort.Search(len(seq.snapshots), func(i int) bool {
+		return seq.snapshots[i].t.Sub(first) > elapsed
+	})
+	return max(i-1, 0)
+}
+
+func (cfg ReplayConfig) validate() error {
+	if cfg.Dir == "" {
+		return nil
+	}
+	var errs []error
+	if fi, err := os.Stat(cfg.Dir); err != nil {
+		errs = append(errs, fmt.Errorf("replay.dir: %w", err))
+	} else if !fi.IsDir() {
+		errs = append(errs, fmt.Errorf("replay.dir: '%s' is not a directory", cfg.Dir))
+	}
+	if !slices.Contains(replayModes, cfg.Mode) {
+		errs = append(errs, fmt.Errorf("replay.mode: unknown mode '%s', want one of %s", cfg.Mode, strings.Join(replayModes, ", ")))
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"pkg.i-no.de/pkg/gkse/keatest"
+)
+
+func statsResponse(n int) string {
+	return fmt.Sprintf(`[{"result":0,"arguments":{"n":%d}}]`, n)
+}
+
+// recordedFiles returns the names of the responses recorded in dir.
+func recordedFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	return names
+}
+
+func TestRecordReplay(t *testing.T) {
+	kea := keatest.NewServer(t)
+	kea.Handle(statsCommand, keatest.JSON(statsResponse(1)), keatest.JSON(statsResponse(2)), keatest.JSON(statsResponse(3)))
+	dir := t.TempDir()
+	target := TargetConfig{Name: "dhcp1", Socket: kea.SocketPath, Timeout: time.Second}
+	cfg := defaultConfig()
+	cfg.Record.Dir = dir
+	currentCfg.Store(cfg)
+	ctx := context.Background()
+	for range 3 {
+		if _, err := queryKea(ctx, target, statsCommand); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if files := recordedFiles(t, filepath.Join(dir, "dhcp1", statsCommand)); len(files) != 3 {
+		t.Fatalf("recorded %q, want 3 responses", files)
+	}
+
+	for _, tc := range []struct {
+		name    string
+		loop    bool
+		collect []bool // whether each query is that of a collection
+		want    []int
+	}{
+		{"sequence", false, []bool{true, true, true, true}, []int{1, 2, 3, 3}},
+		{"loop", true, []bool{true, true, true, true}, []int{1, 2, 3, 1}},
+		// Other reads get the last snapshot served, or the first one
+		// before any.
+		{"other reads", false, []bool{false, true, false, false, true}, []int{1, 1, 1, 1, 2}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := defaultConfig()
+			cfg.Replay = ReplayConfig{Dir: dir, Mode: "scrape", Loop: tc.loop}
+			currentCfg.Store(cfg)
+			// A fresh replayer, starting from the beginning.
+			replayerMu.Lock()
+			activeReplayer = nil
+			replayerMu.Unlock()
+			var got []int
+			for _, collect := range tc.collect {
+				ctx := context.Background()
+				if collect {
+					ctx = collectContext(ctx)
+				}
+				resp, err := queryKea(ctx, target, statsCommand)
+				if err != nil {
+					t.Fatal(err)
+				}
+				var n int
+				if _, err := fmt.Sscanf(string(resp), `[{"result":0,"arguments":{"n":%d}}]`, &n); err != nil {
+					t.Fatalf("unexpected response %q: %v", resp, err)
+				}
+				got = append(got, n)
+			}
+			if !slices.Equal(got, tc.want) {
+				t.Errorf("replayed %v, want %v", got, tc.want)
+			}
+		})
+	}
+	if n := kea.Requests(statsCommand); n != 3 {
+		t.Errorf("Kea got %d queries, want only the 3 recorded", n)
+	}
+}
+
+func TestReplayRealtime(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	seq := &replaySequence{snapshots: []snapshot{{"a", start}, {"b", start.Add(10 * time.Second)}, {"c", start.Add(20 * time.Second)}}}
+	for _, tc := range []struct {
+		elapsed time.Duration
+		loop    bool
+		want    int
+	}{
+		{0, false, 0},
+		{5 * time.Second, false, 0},
+		{10 * time.Second, false, 1},
+		{25 * time.Second, false, 2},
+		{25 * time.Second, true, 0},
+		{31 * time.Second, true, 1},
+	} {
+		if got := seq.realtimeIndex(tc.elapsed, tc.loop); got != tc.want {
+			t.Errorf("realtimeIndex(%s, loop %t) = %d, want %d", tc.elapsed, tc.loop, got, tc.want)
+		}
+	}
+}
+
+func TestRecordRetention(t *testing.T) {
+	start := time.Unix(1700000000, 0).UTC()
+	name := func(i int) string {
+		return start.Add(time.Duration(i)*time.Minute).Format(recordTimeFormat) + ".json"
+	}
+	for _, tc := range []struct {
+		name string
+		cfg  RecordConfig
+		want []int // the responses left, by minute
+	}{
+		{"no limit", RecordConfig{}, []int{0, 1, 2, 3, 4}},
+		{"max_age", RecordConfig{MaxAge: 2 * time.Minute}, []int{2, 3, 4}},
+		// Every response is 34 bytes.
+		{"max_bytes", RecordConfig{MaxBytes: 110}, []int{2, 3, 4}},
+		{"both", RecordConfig{MaxAge: 3 * time.Minute, MaxBytes: 80}, []int{3, 4}},
+		{"newest is kept", RecordConfig{MaxAge: time.Nanosecond, MaxBytes: 1}, []int{4}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.cfg.Dir = t.TempDir()
+			d := filepath.Join(tc.cfg.Dir, "dhcp1", statsCommand)
+			for i := range 5 {
+				if err := recordResponse(tc.cfg, "dhcp1", statsCommand, start.Add(time.Duration(i)*time.Minute), []byte(statsResponse(i))); err != nil {
+					t.Fatal(err)
+				}
+			}
+			// Unrelated files are left alone.
+			if err := os.WriteFile(filepath.Join(d, "README"), nil, 0o644); err != nil {
+				t.Fatal(err)
+			}
+			if err := pruneRecording(tc.cfg, d, start.Add(4*time.Minute)); err != nil {
+				t.Fatal(err)
+			}
+			want := []string{}
+			for _, i := range tc.want {
+				want = append(want, name(i))
+			}
+			want = append(want, "README")
+			slices.Sort(want)
+			if got := recordedFiles(t, d); !slices.Equal(got, want) {
+				t.Errorf("left %q, want %q", got, want)
+			}
+		})
+	}
+
+	if err := (RecordConfig{MaxAge: -time.Second, MaxBytes: -1}).validate(); err == nil ||
+		err.Error() != "record.max_age: must not be negative, got -1s\nrecord.max_bytes: must not be negative, got -1" {
+		t.Errorf("validate() = %v", err)
+	}
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/klauspost/compress/snappy"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// rwLabel and rwSeries mirror the Label and TimeSeries messages of the
+// remote-write protocol (prometheus/prompb), which is simple enough to
+// encode by hand.
+type rwLabel struct {
+	name, value string
+}
+
+type rwSeries struct {
+	labels []rwLabel // sorted by name, including __name__
+	value  float64
+	ts     int64 // milliseconds since the epoch
+}
+
+// toSeries flattens metric families into one series per sample, the way
+// Prometheus would store them after a scrape.
+func toSeries(mfs []*dto.MetricFamily, now time.Time) []rwSeries {
+	ts := now.UnixMilli()
+	var series []rwSeries
+	add := func(name string, m *dto.Metric, v float64, extra ...rwLabel) {
+		labels := make([]rwLabel, 0, len(m.GetLabel())+len(extra)+1)
+		labels = append(labels, rwLabel{"__name__", name})
+		for _, lp := range m.GetLabel() {
+			labels = append(labels, rwLabel{lp.GetName(), lp.GetValue()})
+		}
+		labels = append(labels, extra...)
+		sort.Slice(labels, func(i, j int) bool { return labels[i].name < labels[j].name })
+		series = append(series, rwSeries{labels, v, ts})
+	}
+	for _, mf := range mfs {
+		name := mf.GetName()
+		for _, m := range mf.GetMetric() {
+			switch mf.GetType() {
+			case dto.MetricType_COUNTER:
+				add(name, m, m.GetCounter().GetValue())
+			case dto.MetricType_GAUGE:
+				add(name, m, m.GetGauge().GetValue())
+			case dto.MetricType_UNTYPED:
+				add(name, m, m.GetUntyped().GetValue())
+			case dto.MetricType_SUMMARY:
+				s := m.GetSummary()
+				for _, q := range s.GetQuantile() {
+					add(name, m, q.GetValue(), rwLabel{"quantile", strconv.FormatFloat(q.GetQuantile(), 'g', -1, 64)})
+				}
+				add(name+"_sum", m, s.GetSampleSum())
+				add(name+"_count", m, float64(s.GetSampleCount()))
+			case dto.MetricType_HISTOGRAM:
+				h := m.GetHistogram()
+				for _, b := range h.GetBucket() {
+					add(name+"_bucket", m, float64(b.GetCumulativeCount()), rwLabel{"le", strconv.FormatFloat(b.GetUpperBound(), 'g', -1, 64)})
+				}
+				add(name+"_bucket", m, float64(h.GetSampleCount()), rwLabel{"le", "+Inf"})
+				add(name+"_sum", m, h.GetSampleSum())
+				add(name+"_count", m, float64(h.GetSampleCount()))
+			}
+		}
+	}
+	return series
+}
+
+// encodeWriteRequest returns the protobuf encoding of a WriteRequest
+// holding series.
+func encodeWriteRequest(series []rwSeries) []byte {
+	var req, ts, buf []byte
+	for _, s := range series {
+		ts = ts[:0]
+		for _, l := range s.labels {
+			buf = buf[:0]
+			buf = protowire.AppendTag(buf, 1, protowire.BytesType)
+			buf = protowire.AppendString(buf, l.name)
+			buf = protowire.AppendTag(buf, 2, protowire.BytesType)
+			buf = protowire.AppendString(buf, l.value)
+			ts = protowire.AppendTag(ts, 1, protowire.BytesType)
+			ts = protowire.AppendBytes(ts, buf)
+		}
+		buf = buf[:0]
+		buf = protowire.AppendTag(buf, 1, protowire.Fixed64Type)
+		buf = protowire.AppendFixed64(buf, math.Float64bits(s.value))
+		buf = protowire.AppendTag(buf, 2, protowire.VarintType)
+		buf = protowire.AppendVarint(buf, uint64(s.ts))
+		ts = protowire.AppendTag(ts, 2, protowire.BytesType)
+		ts = protowire.AppendBytes(ts, buf)
+		req = protowire.AppendTag(req, 1, protowire.BytesType)
+		req = protowire.AppendBytes(req, ts)
+	}
+	return req
+}
+
+// remoteWriter sends queued samples to a remote-write receiver. Gathered
+// samples are queued in batches of at most MaxSamplesPerSend, and sent
+// oldest first. A batch that fails with a network error, a 5xx or a 429
+// status is retried with exponential backoff; other errors drop it.
+type remoteWriter struct {
+	cfg    RemoteWriteConfig
+	client *http.Client
+
+	mu      sync.Mutex
+	queue   [][]rwSeries
+	samples int
+	wake    chan struct{}
+}
+
+func newRemoteWriter(cfg RemoteWriteConfig) *remoteWriter {
+	return &remoteWriter{
+		cfg:    cfg,
+		client: &http.Client{Timeout: cfg.Timeout},
+		wake:   make(chan struct{}, 1),
+	}
+}
+
+// enqueue adds the samples in mfs to the queue, dropping the oldest batches
+// if the queue would exceed its capacity.
+func (rw *remoteWriter) enqueue(mfs []*dto.MetricFamily, now time.Time) {
+	series := toSeries(mfs, now)
+	rw.mu.Lock()
+	for len(series) > 0 {
+		n := min(len(series), rw.cfg.MaxSamplesPerSend)
+		rw.queue = append(rw.queue, series[:n])
+		rw.samples += n
+		series = series[n:]
+	}
+	dropped := 0
+	for rw.samples > rw.cfg.QueueCapacity {
+		dropped += len(rw.queue[0])
+		rw.samples -= len(rw.queue[0])
+		rw.queue = rw.queue[1:]
+	}
+	remoteWriteQueueSamples.Set(float64(rw.samples))
+	rw.mu.Unlock()
+	if dropped > 0 {
+		logger.Warn("Remote-write queue full, dropped oldest samples", "dropped", dropped)
+		remoteWriteSamplesDropped.WithLabelValues("queue_full").Add(float64(dropped))
+	}
+	select {
+	case rw.wake <- struct{}{}:
+	default:
+	}
+}
+
+// next returns the oldest batch without removing it from the queue.
+func (rw *remoteWriter) next() []rwSeries {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	if len(rw.queue) == 0 {
+		return nil
+	}
+	return rw.queue[0]
+}
+
+// done removes batch from the queue, unless enqueue already dropped it.
+func (rw *remoteWriter) done(batch []rwSeries) {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	if len(rw.queue) > 0 && &rw.queue[0][0] == &batch[0] {
+		rw.samples -= len(batch)
+		rw.queue = rw.queue[1:]
+	}
+	remoteWriteQueueSamples.Set(float64(rw.samples))
+}
+
+// run sends queued batches until ctx is done.
+func (rw *remoteWriter) run(ctx context.Context) {
+	backoff := rw.cfg.MinBackoff
+	for {
+		batch := rw.next()
+		if batch == nil {
+			select {
+			case <-rw.wake:
+				continue
+			case <-ctx.Done():
+				return
+			}
+		}
+		err := rw.send(ctx, batch)
+		var re *retryableError
+		switch {
+		case err == nil:
+			remoteWriteSamplesSent.Add(float64(len(batch)))
+			pushesTotal.WithLabelValues("remote_write", "success").Inc()
+			rw.done(batch)
+			backoff = rw.cfg.MinBackoff
+			continue
+		case errors.As(err, &re):
+			logger.Warn("Remote write failed, will retry", "error", err, "backoff", backoff)
+			pushesTotal.WithLabelValues("remote_write", "error").Inc()
+			remoteWriteRetries.Inc()
+		default:
+			logger.Error("Remote write failed, dropping samples", "error", err, "samples", len(batch))
+			pushesTotal.WithLabelValues("remote_write", "error").Inc()
+			remoteWriteSamplesDropped.WithLabelValues("rejected").Add(float64(len(batch)))
+			rw.done(batch)
+			continue
+		}
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return
+		}
+		backoff = min(2*backoff, rw.cfg.MaxBackoff)
+	}
+}
+
+// retryableError marks errors after which the same request may succeed.
+type retryableError struct {
+	err error
+}
+
+func (e *retryableError) Error() string { return e.err.Error() }
+func (e *retryableError) Unwrap() error { return e.err }
+
+func (rw *remoteWriter) send(ctx context.Context, batch []rwSeries) error {
+	body := snappy.Encode(nil, encodeWriteRequest(batch))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, rw.cfg.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for k, v := range rw.cfg.Headers {
+		req.Header.Set(k, v)
+	}
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("User-Agent", "gkse/"+version)
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	resp, err := rw.client.Do(req)
+	if err != nil {
+		return &retryableError{err}
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 == 2 {
+		io.Copy(io.Discard, resp.Body)
+		return nil
+	}
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	err = fmt.Errorf("server returned %s: %s", resp.Status, bytes.TrimSpace(msg))
+	if resp.StatusCode/100 == 5 || resp.StatusCode == http.StatusTooManyRequests {
+		return &retryableError{err}
+	}
+	return err
+}
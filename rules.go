@@ -0,0 +1,229 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+var rulesJob = flag.String("rules.job", "kea", "Prometheus job name of the exporter, used by the generated exporter-down alert")
+
+// RulesConfig configures the rules subcommand. Subnets overrides the
+// utilization thresholds of individual subnets; unset values fall back to
+// the thresholds section.
+type RulesConfig struct {
+	Job       string             `yaml:"job"`
+	NAKRatio  float64            `yaml:"nak_ratio"`
+	DropRatio float64            `yaml:"drop_ratio"`
+	Subnets   []SubnetThresholds `yaml:"subnets"`
+}
+
+// SubnetThresholds are the utilization thresholds of one subnet, identified
+// by its prefix.
+type SubnetThresholds struct {
+	Subnet              string  `yaml:"subnet"`
+	UtilizationWarning  float64 `yaml:"utilization_warning"`
+	UtilizationCritical float64 `yaml:"utilization_critical"`
+}
+
+// ruleFile, ruleGroup and rule mirror the Prometheus rule file format.
+type ruleFile struct {
+	Groups []ruleGroup `yaml:"groups"`
+}
+
+type ruleGroup struct {
+	Name  string `yaml:"name"`
+	Rules []rule `yaml:"rules"`
+}
+
+type rule struct {
+	Record      string            `yaml:"record,omitempty"`
+	Alert       string            `yaml:"alert,omitempty"`
+	Expr        string            `yaml:"expr"`
+	For         string            `yaml:"for,omitempty"`
+	Labels      map[string]string `yaml:"labels,omitempty"`
+	Annotations map[string]string `yaml:"annotations,omitempty"`
+}
+
+// runRules reads the Kea configuration of every target and prints rules for
+// it to stdout.
+func runRules(cfg *Config) int {
+	if err := writeRules(context.Background(), cfg, os.Stdout); err != nil {
+		logger.Error("Could not generate rules", "error", err)
+		return 1
+	}
+	return 0
+}
+
+func writeRules(ctx context.Context, cfg *Config, w io.Writer) error {
+	ctx = newScrapeContext(ctx)
+	configs := make([]*KeaConfig, len(cfg.Targets))
+	var errs []error
+	for i, t := range cfg.Targets {
+		var err error
+		if configs[i], err = queryConfig(ctx, t); err != nil {
+			errs = append(errs, fmt.Errorf("target '%s': %w", t.Name, err))
+		}
+	}
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	if err := enc.Encode(generateRules(cfg, configs)); err != nil {
+		return err
+	}
+	return enc.Close()
+}
+
+// generateRules returns recording rules for utilization and packet rates, and
+// alerts for every subnet in configs, which hold the Kea configuration of
+// cfg.Targets in order.
+func generateRules(cfg *Config, configs []*KeaConfig) ruleFile {
+	ns := cfg.Namespace
+	rec := func(name, expr string) rule { return rule{Record: ns + ":" + name, Expr: expr} }
+	recording := ruleGroup{Name: ns + "-recording", Rules: []rule{
+		rec("subnet_utilization:ratio", fmt.Sprintf("%[1]s_subnet_assigned_addresses / (%[1]s_subnet_addresses > 0)", ns)),
+		rec("subnet_pool_utilization:ratio", fmt.Sprintf("%[1]s_subnet_pool_assigned_addresses / (%[1]s_subnet_pool_addresses > 0)", ns)),
+		rec("v4_packets_received:rate5m", fmt.Sprintf("rate(%s_v4_packets_received_total[5m])", ns)),
+		rec("v4_packets_sent:rate5m", fmt.Sprintf("rate(%s_v4_packets_sent_total[5m])", ns)),
+		rec("v4_packet_types_received:rate5m", fmt.Sprintf("rate(%s_v4_packet_types_received_total[5m])", ns)),
+		rec("v4_packet_types_sent:rate5m", fmt.Sprintf("rate(%s_v4_packet_types_sent_total[5m])", ns)),
+		rec("v4_packets_dropped_on_receive:rate5m", fmt.Sprintf("rate(%s_v4_packets_dropped_on_receive_total[5m])", ns)),
+		rec("v4_allocation_failures:rate5m", fmt.Sprintf("rate(%s_v4_allocation_failures_total[5m])", ns)),
+		rec("v4_nak_ratio:rate5m", fmt.Sprintf(`%[1]s:v4_packet_types_sent:rate5m{pkttype="nak"} / ignoring(pkttype) (%[1]s:v4_packet_types_received:rate5m{pkttype="request"} > 0)`, ns)),
+		rec("v4_drop_ratio:rate5m", fmt.Sprintf("%[1]s:v4_packets_dropped_on_receive:rate5m / (%[1]s:v4_packets_received:rate5m > 0)", ns)),
+	}}
+
+	alerts := ruleGroup{Name: ns + "-alerts", Rules: []rule{
+		{
+			Alert:       "KeaExporterDown",
+			Expr:        fmt.Sprintf("up{job=%s} == 0", strconv.Quote(cfg.Rules.Job)),
+			For:         "5m",
+			Labels:      map[string]string{"severity": "critical"},
+			Annotations: map[string]string{"summary": "GKSE on {{ $labels.instance }} cannot be scraped"},
+		},
+		{
+			Alert:       "KeaDown",
+			Expr:        fmt.Sprintf("%s_up == 0", ns),
+			For:         "5m",
+			Labels:      map[string]string{"severity": "critical"},
+			Annotations: map[string]string{"summary": "Kea server behind {{ $labels.instance }} cannot be queried"},
+		},
+		{
+			Alert:       "KeaHighNAKRatio",
+			Expr:        fmt.Sprintf("%s:v4_nak_ratio:rate5m > %g", ns, cfg.Rules.NAKRatio),
+			For:         "15m",
+			Labels:      map[string]string{"severity": "warning"},
+			Annotations: map[string]string{"summary": "{{ $value | humanizePercentage }} of DHCP requests on {{ $labels.instance }} are answered with a NAK"},
+		},
+		{
+			Alert:       "KeaHighDropRatio",
+			Expr:        fmt.Sprintf("%s:v4_drop_ratio:rate5m > %g", ns, cfg.Rules.DropRatio),
+			For:         "15m",
+			Labels:      map[string]string{"severity": "warning"},
+			Annotations: map[string]string{"summary": "{{ $value | humanizePercentage }} of DHCP packets received on {{ $labels.instance }} are dropped"},
+		},
+		{
+			Alert:       "KeaAllocationFailures",
+			Expr:        fmt.Sprintf("%s:v4_allocation_failures:rate5m > 0", ns),
+			For:         "15m",
+			Labels:      map[string]string{"severity": "warning"},
+			Annotations: map[string]string{"summary": "Kea on {{ $labels.instance }} fails to allocate addresses"},
+		},
+	}}
+
+	overrides := make(map[string]SubnetThresholds, len(cfg.Rules.Subnets))
+	for _, st := range cfg.Rules.Subnets {
+		overrides[st.Subnet] = st
+	}
+	defaults := func(matchers string) []rule {
+		return utilizationAlerts(ns, matchers, cfg.Thresholds.UtilizationWarning, cfg.Thresholds.UtilizationCritical)
+	}
+	var targets []string
+	for i, t := range cfg.Targets {
+		// The target label only exists with more than one target.
+		var target []string
+		if len(cfg.Targets) > 1 {
+			target = []string{"target=" + strconv.Quote(t.Name)}
+		}
+		targets = append(targets, regexp.QuoteMeta(t.Name))
+		var known []string
+		d := configs[i].Dhcp4
+		for _, id := range sortedKeys(d.SubnetConfigs) {
+			prefix := d.SubnetConfigs[id].Netname
+			known = append(known, regexp.QuoteMeta(prefix))
+			matchers := append(slices.Clone(target), "subnet="+strconv.Quote(prefix))
+			warning, critical := cfg.Thresholds.UtilizationWarning, cfg.Thresholds.UtilizationCritical
+			if o, ok := overrides[prefix]; ok {
+				warning = cmp.Or(o.UtilizationWarning, warning)
+				critical = cmp.Or(o.UtilizationCritical, critical)
+			}
+			alerts.Rules = append(alerts.Rules, utilizationAlerts(ns, strings.Join(matchers, ","), warning, critical)...)
+		}
+		// Subnets added to the target after the rules were generated
+		// still get the default thresholds.
+		matchers := target
+		if len(known) > 0 {
+			matchers = append(slices.Clone(target), "subnet!~"+strconv.Quote(strings.Join(known, "|")))
+		}
+		alerts.Rules = append(alerts.Rules, defaults(strings.Join(matchers, ","))...)
+	}
+	if len(cfg.Targets) > 1 {
+		// As do all subnets of targets added later.
+		alerts.Rules = append(alerts.Rules, defaults("target!~"+strconv.Quote(strings.Join(targets, "|")))...)
+	}
+
+	return ruleFile{Groups: []ruleGroup{recording, alerts}}
+}
+
+// utilizationAlerts returns a warning and a critical alert for the subnets
+// selected by matchers.
+func utilizationAlerts(ns, matchers string, warning, critical float64) []rule {
+	alert := func(severity string, threshold float64) rule {
+		return rule{
+			Alert:       "KeaSubnetUtilization" + strings.ToUpper(severity[:1]) + severity[1:],
+			Expr:        fmt.Sprintf("%s:subnet_utilization:ratio{%s} >= %g", ns, matchers, threshold),
+			For:         "15m",
+			Labels:      map[string]string{"severity": severity},
+			Annotations: map[string]string{"summary": "Subnet {{ $labels.subnet }} is {{ $value | humanizePercentage }} full"},
+		}
+	}
+	return []rule{alert("warning", warning), alert("critical", critical)}
+}
+
+func (cfg RulesConfig) validate() error {
+	var errs []error
+	if cfg.Job == "" {
+		errs = append(errs, errors.New("rules.job: must not be empty"))
+	}
+	if cfg.NAKRatio <= 0 || cfg.NAKRatio > 1 {
+		errs = append(errs, fmt.Errorf("rules.nak_ratio: must be in (0, 1], got %g", cfg.NAKRatio))
+	}
+	if cfg.DropRatio <= 0 || cfg.DropRatio > 1 {
+		errs = append(errs, fmt.Errorf("rules.drop_ratio: must be in (0, 1], got %g", cfg.DropRatio))
+	}
+	for i, st := range cfg.Subnets {
+		field := fmt.Sprintf("rules.subnets[%d]", i)
+		if st.Subnet == "" {
+			errs = append(errs, fmt.Errorf("%s.subnet: must not be empty", field))
+		}
+		if st.UtilizationWarning < 0 || st.UtilizationWarning > 1 {
+			errs = append(errs, fmt.Errorf("%s.utilization_warning: must be in (0, 1], got %g", field, st.UtilizationWarning))
+		}
+		if st.UtilizationCritical < 0 || st.UtilizationCritical > 1 {
+			errs = append(errs, fmt.Errorf("%s.utilization_critical: must be in (0, 1], got %g", field, st.UtilizationCritical))
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"regexp"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"gopkg.in/yaml.v3"
+)
+
+// keaMetricNames returns the names of the metrics the Kea collectors export
+// for cfg.
+func keaMetricNames(t *testing.T, cfg *Config) map[string]bool {
+	t.Helper()
+	kc := &collectorSet{}
+	kc.update(cfg)
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(kc)
+	mfs, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := make(map[string]bool)
+	for _, mf := range mfs {
+		names[mf.GetName()] = true
+	}
+	return names
+}
+
+// referencedMetrics returns the metric names starting with namespace_ in expr.
+func referencedMetrics(namespace, expr string) []string {
+	return regexp.MustCompile(`\b`+namespace+`_[a-z0-9_]+`).FindAllString(expr, -1)
+}
+
+func TestRules(t *testing.T) {
+	cfg := fixtureConfig("kea-2.6")
+	cfg.Namespace = "dhcp"
+	cfg.Rules.Subnets = []SubnetThresholds{{Subnet: "203.0.113.0/25", UtilizationCritical: 0.9}}
+	var b strings.Builder
+	if err := writeRules(context.Background(), cfg, &b); err != nil {
+		t.Fatal(err)
+	}
+	var rf ruleFile
+	if err := yaml.Unmarshal([]byte(b.String()), &rf); err != nil {
+		t.Fatalf("generated rules are not valid YAML: %v", err)
+	}
+
+	exprs := make(map[string][]string) // by alert or record name
+	names := keaMetricNames(t, cfg)
+	for _, g := range rf.Groups {
+		for _, r := range g.Rules {
+			exprs[r.Alert+r.Record] = append(exprs[r.Alert+r.Record], r.Expr)
+			if strings.Contains(r.Expr, "kea_") || strings.Contains(r.Expr, "kea:") {
+				t.Errorf("%s%s does not use the namespace: %s", r.Alert, r.Record, r.Expr)
+			}
+			for _, m := range referencedMetrics("dhcp", r.Expr) {
+				if !names[m] {
+					t.Errorf("%s%s refers to %s, which the collector does not export", r.Alert, r.Record, m)
+				}
+			}
+		}
+	}
+	for name, want := range map[string][]string{
+		"KeaSubnetUtilizationWarning": {
+			`dhcp:subnet_utilization:ratio{subnet="192.0.2.0/24"} >= 0.8`,
+			`dhcp:subnet_utilization:ratio{subnet="198.51.100.0/24"} >= 0.8`,
+			`dhcp:subnet_utilization:ratio{subnet="203.0.113.0/25"} >= 0.8`,
+			`dhcp:subnet_utilization:ratio{subnet!~"192\\.0\\.2\\.0/24|198\\.51\\.100\\.0/24|203\\.0\\.113\\.0/25"} >= 0.8`,
+		},
+		"KeaSubnetUtilizationCritical": {
+			`dhcp:subnet_utilization:ratio{subnet="192.0.2.0/24"} >= 0.95`,
+			`dhcp:subnet_utilization:ratio{subnet="198.51.100.0/24"} >= 0.95`,
+			`dhcp:subnet_utilization:ratio{subnet="203.0.113.0/25"} >= 0.9`,
+			`dhcp:subnet_utilization:ratio{subnet!~"192\\.0\\.2\\.0/24|198\\.51\\.100\\.0/24|203\\.0\\.113\\.0/25"} >= 0.95`,
+		},
+		"KeaDown":         {"dhcp_up == 0"},
+		"KeaExporterDown": {`up{job="kea"} == 0`},
+	} {
+		if got := exprs[name]; strings.Join(got, "\n") != strings.Join(want, "\n") {
+			t.Errorf("%s: got expressions\n%s\nwant\n%s", name, strings.Join(got, "\n"), strings.Join(want, "\n"))
+		}
+	}
+}
+
+func TestRulesMultipleTargets(t *testing.T) {
+	cfg := fixtureConfig("kea-2.6", "kea-2.4")
+	var b strings.Builder
+	if err := writeRules(context.Background(), cfg, &b); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(b.String(), `kea:subnet_utilization:ratio{target="kea-2.4",subnet="192.0.2.0/24"} >= 0.8`) {
+		t.Errorf("subnet alerts do not select the target:\n%s", b.String())
+	}
+
+	// Every target has a catch-all for the subnets it did not have yet,
+	// and there is one for targets added later.
+	var rf ruleFile
+	if err := yaml.Unmarshal([]byte(b.String()), &rf); err != nil {
+		t.Fatal(err)
+	}
+	var exprs []string
+	for _, r := range rf.Groups[1].Rules {
+		if r.Alert == "KeaSubnetUtilizationWarning" {
+			exprs = append(exprs, r.Expr)
+		}
+	}
+	for _, want := range []string{
+		`kea:subnet_utilization:ratio{target="kea-2.6",subnet!~"192\\.0\\.2\\.0/24|198\\.51\\.100\\.0/24|203\\.0\\.113\\.0/25"} >= 0.8`,
+		`kea:subnet_utilization:ratio{target="kea-2.4",subnet!~"192\\.0\\.2\\.0/24|198\\.51\\.100\\.0/24"} >= 0.8`,
+		`kea:subnet_utilization:ratio{target!~"kea-2\\.6|kea-2\\.4"} >= 0.8`,
+	} {
+		if !slices.Contains(exprs, want) {
+			t.Errorf("no warning alert %s in\n%s", want, strings.Join(exprs, "\n"))
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Metrics about the exporter itself. Unlike the Kea metrics, these always use
+// the gkse namespace.
+var (
+	scrapeDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "gkse",
+		Name:      "scrape_duration_seconds",
+		Help:      "Time spent querying Kea and collecting the metrics of a target for a scrape, by target",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 4, 8),
+	}, []string{"target"})
+	keaBytesRead = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "gkse",
+		Name:      "kea_read_bytes_total",
+		Help:      "Number of bytes read from Kea, by target and command",
+	}, []string{"target", "command"})
+	parseDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "gkse",
+		Name:      "parse_duration_seconds",
+		Help:      "Time spent parsing Kea responses, by target and command; statistic-get-all is parsed as it is read, so this includes reading it",
+		Buckets:   prometheus.ExponentialBuckets(0.0005, 4, 8),
+	}, []string{"target", "command"})
+	statsSeen = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "gkse",
+		Name:      "kea_statistics_seen",
+		Help:      "Number of statistics in the last statistic-get-all response",
+	}, []string{"target"})
+	statsExported = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "gkse",
+		Name:      "kea_statistics_exported",
+		Help:      "Number of statistics in the last statistic-get-all response that map to an exported metric",
+	}, []string{"target"})
+	scrapesInFlight = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "gkse",
+		Name:      "scrapes_in_flight",
+		Help:      "Number of /metrics requests currently being served",
+	})
+
+	pushesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "gkse",
+		Name:      "pushes_total",
+		Help:      "Number of pushes in push mode, by destination and result",
+	}, []string{"destination", "result"})
+	remoteWriteSamplesSent = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "gkse",
+		Name:      "remote_write_samples_sent_total",
+		Help:      "Number of samples accepted by the remote-write receiver",
+	})
+	remoteWriteSamplesDropped = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "gkse",
+		Name:      "remote_write_samples_dropped_total",
+		Help:      "Number of samples that were never sent, by reason",
+	}, []string{"reason"})
+	remoteWriteRetries = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "gkse",
+		Name:      "remote_write_retries_total",
+		Help:      "Number of remote-write requests that were retried",
+	})
+	remoteWriteQueueSamples = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "gkse",
+		Name:      "remote_write_queue_samples",
+		Help:      "Number of samples waiting to be sent",
+	})
+)
+
+func registerSelfMetrics(reg prometheus.Registerer) {
+	reg.MustRegister(scrapeDuration, keaBytesRead, parseDuration, statsSeen, statsExported, scrapesInFlight)
+}
+
+func registerPushMetrics(reg prometheus.Registerer) {
+	reg.MustRegister(pushesTotal, remoteWriteSamplesSent, remoteWriteSamplesDropped, remoteWriteRetries, remoteWriteQueueSamples)
+}
+
+// promhttpLogger passes errors from the metrics handler on to logger.
+type promhttpLogger struct{}
+
+func (promhttpLogger) Println(v ...interface{}) {
+	logger.Error("Error serving metrics", "error", fmt.Sprint(v...))
+}
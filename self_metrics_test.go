@@ -0,0 +1,97 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+// gatherSelfMetrics fetches /metrics and returns the metric families of the
+// exporter's own metrics by name.
+func gatherSelfMetrics(t *testing.T, url string) map[string]*dto.MetricFamily {
+	t.Helper()
+	resp, err := http.Get(url + "/metrics")
+	if err != nil {
+		t.Fatalf("GET /metrics: %v", err)
+	}
+	defer resp.Body.Close()
+	var p expfmt.TextParser
+	mfs, err := p.TextToMetricFamilies(resp.Body)
+	if err != nil {
+		t.Fatalf("parsing /metrics: %v", err)
+	}
+	return mfs
+}
+
+// sampleValue returns the value of the sample of mf with the given label
+// values, or the sample count for histograms, and false if there is none.
+func sampleValue(mf *dto.MetricFamily, labels map[string]string) (float64, bool) {
+	if mf == nil {
+		return 0, false
+	}
+next:
+	for _, m := range mf.Metric {
+		for _, lp := range m.Label {
+			if v, ok := labels[lp.GetName()]; ok && v != lp.GetValue() {
+				continue next
+			}
+		}
+		switch {
+		case m.Counter != nil:
+			return m.Counter.GetValue(), true
+		case m.Gauge != nil:
+			return m.Gauge.GetValue(), true
+		case m.Histogram != nil:
+			return float64(m.Histogram.GetSampleCount()), true
+		}
+	}
+	return 0, false
+}
+
+func TestSelfMetrics(t *testing.T) {
+	kea := newFixtureServer(t, "kea-2.6")
+	url := newTestExporter(t, TargetConfig{Name: "self", Socket: kea.SocketPath, Timeout: time.Second})
+
+	type sample struct {
+		name   string
+		labels map[string]string
+	}
+	samples := []sample{
+		{"gkse_scrape_duration_seconds", map[string]string{"target": "self"}},
+		{"gkse_kea_read_bytes_total", map[string]string{"target": "self", "command": statsCommand}},
+		{"gkse_kea_read_bytes_total", map[string]string{"target": "self", "command": configCommand}},
+		{"gkse_parse_duration_seconds", map[string]string{"target": "self", "command": statsCommand}},
+		{"gkse_parse_duration_seconds", map[string]string{"target": "self", "command": configCommand}},
+	}
+	// The values of the first scrape are only in the second one.
+	gatherSelfMetrics(t, url)
+	first := gatherSelfMetrics(t, url)
+	before := make([]float64, len(samples))
+	for i, s := range samples {
+		v, ok := sampleValue(first[s.name], s.labels)
+		if !ok || v <= 0 {
+			t.Errorf("%s%v = %g, %t after a scrape, want it positive", s.name, s.labels, v, ok)
+		}
+		before[i] = v
+	}
+	seen, _ := sampleValue(first["gkse_kea_statistics_seen"], map[string]string{"target": "self"})
+	exported, _ := sampleValue(first["gkse_kea_statistics_exported"], map[string]string{"target": "self"})
+	if seen == 0 || exported == 0 || exported > seen {
+		t.Errorf("%g statistics seen and %g exported, want both positive and no more exported than seen", seen, exported)
+	}
+	if _, ok := first["gkse_scrapes_in_flight"]; !ok {
+		t.Error("gkse_scrapes_in_flight is not registered")
+	}
+
+	second := gatherSelfMetrics(t, url)
+	for i, s := range samples {
+		// The config is only read when it changes, so its bytes and parse
+		// time may stay the same.
+		if v, _ := sampleValue(second[s.name], s.labels); v < before[i] || (s.labels["command"] != configCommand && v == before[i]) {
+			t.Errorf("%s%v went from %g to %g in a scrape, want it to increase", s.name, s.labels, before[i], v)
+		}
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// keaSnapshot is the parsed state of one target at one point in time. The
+// metrics handler, push destinations and dump all work from snapshots.
+type keaSnapshot struct {
+	Target  TargetConfig
+	Time    time.Time
+	Metrics *KeaCookedMetrics
+	Config  *KeaConfig
+	Labels  map[string]string // the constant labels of the target's metrics
+	Prev    *keaSnapshot      // the snapshot before, if any, without its Prev
+}
+
+// takeSnapshot queries the statistics and configuration of t and parses
+// them.
+func takeSnapshot(ctx context.Context, t TargetConfig) (*keaSnapshot, error) {
+	start := time.Now()
+	r, err := openStats(ctx, t)
+	if err != nil {
+		return nil, err
+	}
+	// The response is parsed as it arrives, so the parse time includes
+	// reading it.
+	parseStart := time.Now()
+	cr := &countingReader{r: r}
+	cooked, err := parseStats(cr)
+	r.Close()
+	parseDuration.WithLabelValues(t.Name, statsCommand).Observe(time.Since(parseStart).Seconds())
+	keaBytesRead.WithLabelValues(t.Name, statsCommand).Add(float64(cr.n))
+	switch {
+	case cr.err != nil:
+		return nil, fmt.Errorf("could not get raw JSON stats: %w", cr.err)
+	case err != nil:
+		return nil, fmt.Errorf("could not parse raw JSON stats: %w", err)
+	}
+	statsSeen.WithLabelValues(t.Name).Set(float64(cooked.StatsSeen))
+	statsExported.WithLabelValues(t.Name).Set(float64(cooked.StatsExported))
+	logger.DebugContext(ctx, "Parsed stats", "target", t.Name, "seen", cooked.StatsSeen, "exported", cooked.StatsExported, "duration", time.Since(parseStart))
+	config, err := queryConfig(ctx, t)
+	if err != nil {
+		return nil, err
+	}
+	return &keaSnapshot{Target: t, Time: start, Metrics: cooked, Config: config}, nil
+}
+
+// snapshotPoint is one global, subnet or pool entry of a snapshot, in the
+// shape of the line-based push formats.
+type snapshotPoint struct {
+	Kind   string // global, subnet or pool
+	Name   pointName
+	Fields []pointField
+}
+
+// pointName holds what a measurement or path template can refer to.
+type pointName struct {
+	Target   string
+	SubnetID uint64
+	Prefix   string
+	Pool     uint64
+	Metric   string
+	Labels   map[string]string
+}
+
+// pointField is a statistic, named after the Kea statistic with dashes
+// replaced by underscores.
+type pointField struct {
+	Name  string
+	Value float64
+}
+
+// points flattens s into points, ordered by subnet ID and pool index. Points
+// of disabled collectors are left out.
+func (s *keaSnapshot) points(enabled CollectorsConfig) []snapshotPoint {
+	base := pointName{Target: s.Target.Name, Labels: s.Labels}
+	var pts []snapshotPoint
+	m := s.Metrics
+	if enabled.Global {
+		pts = append(pts, snapshotPoint{Kind: "global", Name: base, Fields: []pointField{
+			{"cumulative_assigned_addresses", m.CumulativeAssignedAddresses},
+			{"declined_addresses", m.DeclinedAddresses},
+			{"pkt4_ack_received", m.Pkt4AckReceived},
+			{"pkt4_ack_sent", m.Pkt4AckSent},
+			{"pkt4_decline_received", m.Pkt4DeclineReceived},
+			{"pkt4_discover_received", m.Pkt4DiscoverReceived},
+			{"pkt4_inform_received", m.Pkt4InformReceived},
+			{"pkt4_nak_received", m.Pkt4NakReceived},
+			{"pkt4_nak_sent", m.Pkt4NakSent},
+			{"pkt4_offer_received", m.Pkt4OfferReceived},
+			{"pkt4_offer_sent", m.Pkt4OfferSent},
+			{"pkt4_parse_failed", m.Pkt4ParseFailed},
+			{"pkt4_receive_drop", m.Pkt4ReceiveDrop},
+			{"pkt4_received", m.Pkt4Received},
+			{"pkt4_release_received", m.Pkt4ReleaseReceived},
+			{"pkt4_request_received", m.Pkt4RequestReceived},
+			{"pkt4_sent", m.Pkt4Sent},
+			{"pkt4_unknown_received", m.Pkt4UnknownReceived},
+			{"reclaimed_declined_addresses", m.ReclaimedDeclinedAddresses},
+			{"reclaimed_leases", m.ReclaimedLeases},
+			{"v4_allocation_fail", m.V4AllocationFail},
+			{"v4_allocation_fail_classes", m.V4AllocationFailClasses},
+			{"v4_allocation_fail_no_pools", m.V4AllocationFailNoPools},
+			{"v4_allocation_fail_shared_network", m.V4AllocationFailSharedNetwork},
+			{"v4_allocation_fail_subnet", m.V4AllocationFailSubnet},
+			{"v4_reservation_conflicts", m.V4ReservationConflicts},
+		}})
+	}
+	if !enabled.Subnets && !enabled.Pools {
+		return pts
+	}
+	for _, id := range sortedKeys(m.SubnetMetrics) {
+		snm := m.SubnetMetrics[id]
+		name := base
+		name.SubnetID = id
+		var err error
+		if name.Prefix, err = s.Config.subnetFromID(4, id); err != nil {
+			name.Prefix = "unknown"
+		}
+		if enabled.Subnets {
+			pts = append(pts, snapshotPoint{Kind: "subnet", Name: name, Fields: []pointField{
+				{"assigned_addresses", snm.AssignedAddresses},
+				{"cumulative_assigned_addresses", snm.CumulativeAssignedAddresses},
+				{"declined_addresses", snm.DeclinedAddresses},
+				{"reclaimed_declined_addresses", snm.ReclaimedDeclinedAddresses},
+				{"reclaimed_leases", snm.ReclaimedLeases},
+				{"total_addresses", snm.TotalAddresses},
+				{"utilization", utilization(snm.AssignedAddresses, snm.TotalAddresses)},
+				{"v4_reservation_conflicts", snm.V4ReservationConflicts},
+			}})
+		}
+		if !enabled.Pools {
+			continue
+		}
+		for _, pid := range sortedKeys(snm.PoolMetrics) {
+			pm := snm.PoolMetrics[pid]
+			name.Pool = pid
+			pts = append(pts, snapshotPoint{Kind: "pool", Name: name, Fields: []pointField{
+				{"assigned_addresses", pm.AssignedAddresses},
+				{"cumulative_assigned_addresses", pm.CumulativeAssignedAddresses},
+				{"declined_addresses", pm.DeclinedAddresses},
+				{"reclaimed_declined_addresses", pm.ReclaimedDeclinedAddresses},
+				{"reclaimed_leases", pm.ReclaimedLeases},
+				{"total_addresses", pm.TotalAddresses},
+				{"utilization", utilization(pm.AssignedAddresses, pm.TotalAddresses)},
+			}})
+		}
+	}
+	return pts
+}
+
+// NameTemplates are text/template templates for the name of global, subnet
+// and pool points. They are executed with a pointName.
+type NameTemplates struct {
+	Global string `yaml:"global"`
+	Subnet string `yaml:"subnet"`
+	Pool   string `yaml:"pool"`
+}
+
+// nameTemplates are parsed NameTemplates, keyed by point kind.
+type nameTemplates map[string]*template.Template
+
+func parseNameTemplates(field string, nt NameTemplates) (nameTemplates, error) {
+	parsed := make(nameTemplates)
+	var errs []error
+	// In a fixed order, so the errors are too.
+	for _, k := range []struct{ kind, text string }{{"global", nt.Global}, {"subnet", nt.Subnet}, {"pool", nt.Pool}} {
+		kind, text := k.kind, k.text
+		if text == "" {
+			errs = append(errs, fmt.Errorf("%s.%s: must not be empty", field, kind))
+			continue
+		}
+		t, err := template.New(kind).Option("missingkey=error").Parse(text)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s.%s: %w", field, kind, err))
+			continue
+		}
+		parsed[kind] = t
+	}
+	return parsed, errors.Join(errs...)
+}
+
+func (nt nameTemplates) execute(kind string, name pointName) (string, error) {
+	var b strings.Builder
+	if err := nt[kind].Execute(&b, name); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
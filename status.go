@@ -0,0 +1,47 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// scrapeResult is the outcome of one attempt to query a Kea target.
+type scrapeResult struct {
+	Time     time.Time
+	Duration time.Duration
+	Err      error
+}
+
+type targetStatus struct {
+	LastAttempt scrapeResult
+	LastSuccess time.Time
+}
+
+// statusTracker remembers the outcome of the most recent Kea query per
+// target, for the health and landing page endpoints.
+type statusTracker struct {
+	mu      sync.Mutex
+	targets map[string]targetStatus
+}
+
+var scrapeStatus = &statusTracker{targets: make(map[string]targetStatus)}
+
+func (st *statusTracker) record(target string, start time.Time, err error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	ts := st.targets[target]
+	ts.LastAttempt = scrapeResult{Time: start, Duration: time.Since(start), Err: err}
+	if err == nil {
+		ts.LastSuccess = start
+	}
+	st.targets[target] = ts
+}
+
+// get returns the status of target. The second return value is false if the
+// target has never been queried.
+func (st *statusTracker) get(target string) (targetStatus, bool) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	ts, ok := st.targets[target]
+	return ts, ok
+}
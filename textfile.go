@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
+)
+
+var (
+	textfilePath     = flag.String("textfile.path", "", "File to write metrics to in textfile mode, e.g. /var/lib/node_exporter/textfile_collector/kea.prom")
+	textfileInterval = flag.Duration("textfile.interval", time.Minute, "Interval between writes in textfile mode; 0 writes once and exits")
+)
+
+// TextfileConfig configures the textfile subcommand, which periodically
+// writes the metrics to a file for the node_exporter textfile collector.
+type TextfileConfig struct {
+	Path     string        `yaml:"path"`
+	Interval time.Duration `yaml:"interval"`
+}
+
+// textfileWriter writes the Kea metrics, along with the time of the write,
+// to a file.
+type textfileWriter struct {
+	path      string
+	reg       *prometheus.Registry
+	lastWrite prometheus.Gauge
+}
+
+func newTextfileWriter(cfg *Config, kc *collectorSet) *textfileWriter {
+	tw := &textfileWriter{
+		path: cfg.Textfile.Path,
+		reg:  prometheus.NewPedanticRegistry(),
+		lastWrite: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: cfg.Namespace + "_textfile_last_write_timestamp_seconds",
+			Help: "Time the metrics in this file were collected, in seconds since the epoch",
+		}),
+	}
+	// Only Kea metrics are written, as node_exporter already exports Go and
+	// process metrics of its own.
+	tw.reg.MustRegister(kc, tw.lastWrite)
+	return tw
+}
+
+// write collects the metrics and replaces the file with them. Targets that
+// fail are logged and written with kea_up 0 and none of their other
+// metrics, so they do not keep the others from being updated.
+func (tw *textfileWriter) write() error {
+	tw.lastWrite.SetToCurrentTime()
+	mfs, _ := partialGatherer(newScrapeContext(context.Background()), tw.reg).Gather()
+	var b bytes.Buffer
+	for _, mf := range mfs {
+		if _, err := expfmt.MetricFamilyToText(&b, mf); err != nil {
+			return err
+		}
+	}
+	if err := writeFileAtomic(tw.path, b.Bytes(), 0o644); err != nil {
+		return fmt.Errorf("could not write '%s': %w", tw.path, err)
+	}
+	return nil
+}
+
+// runTextfile writes the metrics file every textfile.interval until it is
+// terminated.
+func runTextfile(cfg *Config) int {
+	if cfg.Textfile.Path == "" {
+		logger.Error("Textfile mode requires -textfile.path or textfile.path in the configuration file")
+		return 2
+	}
+	kc := &collectorSet{}
+	kc.update(cfg)
+	tw := newTextfileWriter(cfg, kc)
+	if cfg.Textfile.Interval == 0 {
+		if err := tw.write(); err != nil {
+			logger.Error("Could not write metrics file", "error", err)
+			return 1
+		}
+		return 0
+	}
+	r := &reloader{path: *configFile, collectors: kc}
+	go r.watchSignals()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	logger.Info("Writing metrics file", "path", tw.path, "interval", cfg.Textfile.Interval)
+	ticker := time.NewTicker(cfg.Textfile.Interval)
+	defer ticker.Stop()
+	for {
+		if err := tw.write(); err != nil {
+			logger.Error("Could not write metrics file", "error", err)
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			logger.Info("Exiting on signal")
+			return 0
+		}
+	}
+}
+
+func (cfg TextfileConfig) validate() error {
+	if cfg.Interval < 0 {
+		return fmt.Errorf("textfile.interval: must not be negative, got %s", cfg.Interval)
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTextfileWrite(t *testing.T) {
+	cfg := fixtureConfig("kea-2.4")
+	dir := t.TempDir()
+	cfg.Textfile.Path = filepath.Join(dir, "kea.prom")
+	kc := &collectorSet{}
+	kc.update(cfg)
+	tw := newTextfileWriter(cfg, kc)
+	before := time.Now()
+	if err := tw.write(); err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(cfg.Textfile.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := string(b)
+	for _, want := range []string{
+		`kea_subnet_addresses{subnet="192.0.2.0/24",subnetidx="1"} 191`,
+		"# TYPE kea_textfile_last_write_timestamp_seconds gauge",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("metrics file does not contain %q", want)
+		}
+	}
+	if strings.Contains(got, "go_goroutines") {
+		t.Errorf("metrics file contains Go runtime metrics, which node_exporter already exports")
+	}
+	fi, err := os.Stat(cfg.Textfile.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0o644 {
+		t.Errorf("metrics file has mode %v, want 0644", fi.Mode().Perm())
+	}
+	if fi.ModTime().Before(before.Add(-time.Second)) {
+		t.Errorf("metrics file not updated")
+	}
+
+	// A failing target is written as down, the others as usual.
+	cfg.Targets = fixtureConfig("kea-2.4", "kea-2.6").Targets
+	cfg.Targets[1].StatsFile = filepath.Join(dir, "missing.json")
+	kc.update(cfg)
+	if err := tw.write(); err != nil {
+		t.Fatal(err)
+	}
+	b, err = os.ReadFile(cfg.Textfile.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		`kea_up{target="kea-2.4"} 1`,
+		`kea_up{target="kea-2.6"} 0`,
+		`kea_subnet_addresses{subnet="192.0.2.0/24",subnetidx="1",target="kea-2.4"} 191`,
+	} {
+		if !strings.Contains(string(b), want+"\n") {
+			t.Errorf("metrics file with a failing target does not contain %q:\n%s", want, b)
+		}
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		if strings.Contains(line, `target="kea-2.6"`) && !strings.HasPrefix(line, "kea_up{") {
+			t.Errorf("metrics file has %s of the failing target", line)
+		}
+	}
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 1 {
+		t.Errorf("directory contains %d files, want only the metrics file", len(entries))
+	}
+}
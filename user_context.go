@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// UserContextConfig selects keys of the Kea user-context of subnets, pools
+// and shared networks that become labels of the subnet and pool metrics.
+type UserContextConfig struct {
+	Labels []UserContextLabel `yaml:"labels"`
+}
+
+// UserContextLabel turns the user-context key Key into a label. Label
+// defaults to Key with every character not allowed in label names replaced
+// by "_". Subnets and pools without the key get the value Default.
+type UserContextLabel struct {
+	Key     string `yaml:"key"`
+	Label   string `yaml:"label"`
+	Default string `yaml:"default"`
+}
+
+var invalidLabelChars = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+
+// sanitizeLabelName turns s into a valid label name.
+func sanitizeLabelName(s string) string {
+	s = invalidLabelChars.ReplaceAllString(s, "_")
+	if s != "" && s[0] >= '0' && s[0] <= '9' {
+		s = "_" + s
+	}
+	return s
+}
+
+// name returns the name of the label.
+func (l UserContextLabel) name() string {
+	if l.Label != "" {
+		return l.Label
+	}
+	return sanitizeLabelName(l.Key)
+}
+
+// names returns the names of the labels, in configuration order.
+func (cfg UserContextConfig) names() []string {
+	names := make([]string, 0, len(cfg.Labels))
+	for _, l := range cfg.Labels {
+		names = append(names, l.name())
+	}
+	return names
+}
+
+// values returns the values of the labels, in configuration order. Each key
+// is looked up in contexts in order, so a pool's own context comes before
+// that of its subnet, which comes before that of the shared network.
+// Strings are used as they are, other values in their JSON form.
+func (cfg UserContextConfig) values(contexts ...map[string]any) []string {
+	values := make([]string, 0, len(cfg.Labels))
+	for _, l := range cfg.Labels {
+		v := l.Default
+		for _, c := range contexts {
+			raw, ok := c[l.Key]
+			if !ok || raw == nil {
+				continue
+			}
+			if s, ok := raw.(string); ok {
+				v = s
+			} else if b, err := json.Marshal(raw); err == nil {
+				v = string(b)
+			}
+			break
+		}
+		values = append(values, v)
+	}
+	return values
+}
+
+// reservedLabels are the labels the subnet and pool metrics, and the subnet
+// info metric, can have.
+var reservedLabels = slices.Concat([]string{"target", "daemon", "subnetidx", "subnet", "poolidx", "horizon"}, identityLabels, subnetInfoLabels)
+
+func (cfg UserContextConfig) validate() error {
+	var errs []error
+	seen := make(map[string]int)
+	for i, l := range cfg.Labels {
+		field := fmt.Sprintf("user_context.labels[%d]", i)
+		if l.Key == "" {
+			errs = append(errs, fmt.Errorf("%s.key: must not be empty", field))
+			continue
+		}
+		name := l.name()
+		switch prev, ok := seen[name]; {
+		case !labelNameRE.MatchString(name) || strings.HasPrefix(name, "__"):
+			errs = append(errs, fmt.Errorf("%s.label: '%s' is not a valid label name", field, name))
+		case slices.Contains(reservedLabels, name):
+			errs = append(errs, fmt.Errorf("%s.label: '%s' is reserved", field, name))
+		case ok:
+			errs = append(errs, fmt.Errorf("%s.label: '%s' already used by user_context.labels[%d]", field, name, prev))
+		default:
+			seen[name] = i
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"pkg.i-no.de/pkg/gkse/keatest"
+)
+
+func TestUserContextValues(t *testing.T) {
+	cfg := UserContextConfig{Labels: []UserContextLabel{
+		{Key: "site"},
+		{Key: "vlan-id"},
+		{Key: "owner", Default: "none"},
+		{Key: "tags", Label: "tags"},
+	}}
+	if got, want := cfg.names(), []string{"site", "vlan_id", "owner", "tags"}; !slices.Equal(got, want) {
+		t.Errorf("names() = %q, want %q", got, want)
+	}
+	pool := map[string]any{"owner": "research"}
+	subnet := map[string]any{"vlan-id": 30.0, "owner": nil, "tags": []any{"a", "b"}}
+	shared := map[string]any{"site": "lab", "owner": "ops"}
+	if got, want := cfg.values(pool, subnet, shared), []string{"lab", "30", "research", `["a","b"]`}; !slices.Equal(got, want) {
+		t.Errorf("values() = %q, want %q", got, want)
+	}
+	if got, want := cfg.values(nil, subnet, shared), []string{"lab", "30", "ops", `["a","b"]`}; !slices.Equal(got, want) {
+		t.Errorf("values() without pool context = %q, want %q", got, want)
+	}
+	if got, want := cfg.values(), []string{"", "", "none", ""}; !slices.Equal(got, want) {
+		t.Errorf("values() without contexts = %q, want %q", got, want)
+	}
+}
+
+func TestSanitizeLabelName(t *testing.T) {
+	for in, want := range map[string]string{
+		"site":       "site",
+		"vlan-id":    "vlan_id",
+		"9th.floor":  "_9th_floor",
+		"Gebäude":    "Geb_ude",
+		"under_line": "under_line",
+	} {
+		if got := sanitizeLabelName(in); got != want {
+			t.Errorf("sanitizeLabelName(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestUserContextValidate(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Labels = map[string]string{"dc": "ams"}
+	cfg.UserContext.Labels = []UserContextLabel{
+		{Key: ""},
+		{Key: "subnet"},
+		{Key: "site"},
+		{Key: "site-name", Label: "site"},
+		{Key: "__meta"},
+		{Key: "datacenter", Label: "dc"},
+	}
+	err := cfg.validate()
+	if err == nil {
+		t.Fatal("validate() succeeded, want errors")
+	}
+	for _, want := range []string{
+		"user_context.labels[0].key: must not be empty",
+		"user_context.labels[1].label: 'subnet' is reserved",
+		"user_context.labels[3].label: 'site' already used by user_context.labels[2]",
+		"user_context.labels[4].label: '__meta' is not a valid label name",
+		"user_context.labels[5].label: 'dc' is also set in labels",
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("validate() = %v, want an error containing %q", err, want)
+		}
+	}
+}
+
+func TestMetricsUserContextLabels(t *testing.T) {
+	kea := newFixtureServer(t, "kea-2.6")
+	kea.Handle(configCommand, keatest.File(t, "testdata/config-get-user-context.json"))
+	cfg := defaultConfig()
+	cfg.Targets = []TargetConfig{{Name: "dhcp1", Socket: kea.SocketPath, Timeout: time.Second}}
+	cfg.UserContext.Labels = []UserContextLabel{{Key: "site"}, {Key: "owner", Default: "unowned"}}
+	if err := cfg.validate(); err != nil {
+		t.Fatal(err)
+	}
+	currentCfg.Store(cfg)
+	kc := &collectorSet{}
+	kc.update(cfg)
+	srv := httptest.NewServer(newMux(kc, &reloader{collectors: kc}))
+	t.Cleanup(srv.Close)
+
+	got := scrapeKeaMetrics(t, srv.URL)
+	for _, want := range []string{
+		`kea_subnet_addresses{owner="unowned",site="ams1",subnet="192.0.2.0/24",subnetidx="1"} 191`,
+		`kea_subnet_addresses{owner="voice",site="ams1",subnet="198.51.100.0/24",subnetidx="2"} 100`,
+		// Subnet 3 inherits the site of its shared network, its pool has
+		// an owner of its own.
+		`kea_subnet_addresses{owner="unowned",site="lab",subnet="203.0.113.0/25",subnetidx="3"} 100`,
+		`kea_subnet_pool_addresses{owner="research",poolidx="0",site="lab",subnet="203.0.113.0/25",subnetidx="3"} 100`,
+	} {
+		if !strings.Contains(got, want+"\n") {
+			t.Errorf("/metrics has no line %s", want)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/prometheus/exporter-toolkit/web"
+)
+
+var webConfigFile = flag.String("web.config.file", "", "Path to Prometheus web configuration file for TLS and authentication")
+
+const unixListenPrefix = "unix:"
+
+// stringList is a flag.Value that can be given multiple times. The first
+// explicit use replaces the default.
+type stringList struct {
+	values []string
+	set    bool
+}
+
+func (l *stringList) String() string {
+	if l == nil {
+		return ""
+	}
+	return strings.Join(l.values, ",")
+}
+
+func (l *stringList) Set(v string) error {
+	if !l.set {
+		l.values = nil
+		l.set = true
+	}
+	l.values = append(l.values, v)
+	return nil
+}
+
+func stringListFlag(name string, def []string, usage string) *stringList {
+	l := &stringList{values: def}
+	flag.Var(l, name, usage)
+	return l
+}
+
+// openListeners opens a listener for every address. Addresses of the form
+// unix:/path/to/socket listen on a unix domain socket, everything else is
+// treated as a TCP host:port.
+func openListeners(addrs []string) ([]net.Listener, error) {
+	var ls []net.Listener
+	for _, addr := range addrs {
+		l, err := listenOne(addr)
+		if err != nil {
+			for _, o := range ls {
+				o.Close()
+			}
+			return nil, fmt.Errorf("could not listen on '%s': %w", addr, err)
+		}
+		ls = append(ls, l)
+	}
+	return ls, nil
+}
+
+func listenOne(addr string) (net.Listener, error) {
+	path, ok := strings.CutPrefix(addr, unixListenPrefix)
+	if !ok {
+		return net.Listen("tcp", addr)
+	}
+	// Remove a stale socket left behind by a previous run, but never
+	// anything that is not a socket, nor a socket something listens on.
+	if fi, err := os.Stat(path); err == nil && fi.Mode().Type() == fs.ModeSocket {
+		if c, err := net.Dial("unix", path); err == nil {
+			c.Close()
+			return nil, fmt.Errorf("socket is in use by another process")
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	return net.Listen("unix", path)
+}
+
+// serve runs srv on all configured listen addresses, applying TLS and
+// authentication settings from the web configuration file, if any.
+func serve(srv *http.Server, cfg WebConfig) error {
+	ls, err := openListeners(cfg.ListenAddresses)
+	if err != nil {
+		return err
+	}
+	configFile := cfg.ConfigFile
+	return web.ServeMultiple(ls, srv, &web.FlagConfig{WebConfigFile: &configFile}, logger)
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestStringList(t *testing.T) {
+	l := &stringList{values: []string{":9988"}}
+	if got := l.String(); got != ":9988" {
+		t.Errorf("String() of the default = %q, want :9988", got)
+	}
+	for _, v := range []string{":1", "unix:/run/gkse.sock"} {
+		if err := l.Set(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The first Set replaces the default, later ones add to it.
+	if want := []string{":1", "unix:/run/gkse.sock"}; !slices.Equal(l.values, want) {
+		t.Errorf("values = %q, want %q", l.values, want)
+	}
+	if got := l.String(); got != ":1,unix:/run/gkse.sock" {
+		t.Errorf("String() = %q, want :1,unix:/run/gkse.sock", got)
+	}
+	if got := (*stringList)(nil).String(); got != "" {
+		t.Errorf("String() of nil = %q, want it empty", got)
+	}
+}
+
+func TestOpenListeners(t *testing.T) {
+	sock := filepath.Join(t.TempDir(), "gkse.sock")
+	ls, err := openListeners([]string{"127.0.0.1:0", unixListenPrefix + sock})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := ls[0].Addr().Network(); got != "tcp" {
+		t.Errorf("listener 0 is on %s, want tcp", got)
+	}
+	if got := ls[1].Addr().String(); got != sock {
+		t.Errorf("listener 1 is on %s, want %s", got, sock)
+	}
+	for _, l := range ls {
+		l.Close()
+	}
+
+	// If one address fails, the listeners opened so far are closed.
+	_, err = openListeners([]string{unixListenPrefix + sock, "127.0.0.1:-1"})
+	if err == nil || !strings.HasPrefix(err.Error(), "could not listen on '127.0.0.1:-1': ") {
+		t.Errorf("openListeners() = %v, want an error for 127.0.0.1:-1", err)
+	}
+	if _, err := os.Stat(sock); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("socket of the closed listener still exists: %v", err)
+	}
+}
+
+func TestListenOne(t *testing.T) {
+	dir := t.TempDir()
+
+	// A socket left behind by a previous run is replaced.
+	stale := filepath.Join(dir, "stale.sock")
+	l, err := net.Listen("unix", stale)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	l.Close()
+	l, err = listenOne(unixListenPrefix + stale)
+	if err != nil {
+		t.Fatalf("listenOne() of a stale socket: %v", err)
+	}
+	l.Close()
+
+	// A socket in use is left alone.
+	live := filepath.Join(dir, "live.sock")
+	l, err = net.Listen("unix", live)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if _, err := listenOne(unixListenPrefix + live); err == nil {
+		t.Error("listenOne() of a socket in use succeeded")
+	}
+	if c, err := net.Dial("unix", live); err != nil {
+		t.Errorf("socket in use no longer accepts connections: %v", err)
+	} else {
+		c.Close()
+	}
+
+	// Anything else is never removed.
+	file := filepath.Join(dir, "file")
+	if err := os.WriteFile(file, []byte("data"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := listenOne(unixListenPrefix + file); err == nil {
+		t.Error("listenOne() of a regular file succeeded")
+	}
+	if b, err := os.ReadFile(file); err != nil || string(b) != "data" {
+		t.Errorf("regular file was changed: %q, %v", b, err)
+	}
+}